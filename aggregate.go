@@ -0,0 +1,46 @@
+// aggregate.go
+//go:build aggregate
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+)
+
+// Tính lại size/number_files/subtree_size/subtree_files của fs_folders cho DB
+// đã quét từ trước (bản scanner cũ chưa ghi các cột này).
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	dbFile := flag.String("dbfile", "", "Path to the scan.db file (e.g., ./output_scans/scan_....db)")
+	flag.Parse()
+
+	if *dbFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := openDBSQLite(*dbFile)
+	if err != nil {
+		log.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	start := time.Now()
+	log.Printf("Computing folder aggregates for %s ...", *dbFile)
+
+	stats, err := updateFolderAggregates(ctx, db)
+	if err != nil {
+		log.Fatalf("aggregate failed: %v", err)
+	}
+
+	log.Printf("DONE: folders=%d files=%d size=%.2fGB orphans=%d linked_copies=%d (%.2fGB) duration=%s",
+		stats.Folders, stats.RootFiles, float64(stats.RootSize)/(1024*1024*1024), stats.Orphans,
+		stats.Hardlinks.LinkedFiles, float64(stats.Hardlinks.LinkedSize)/(1024*1024*1024), time.Since(start).Round(time.Millisecond))
+}
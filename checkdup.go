@@ -6,46 +6,25 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strings"
 	"time"
 )
 
+// Nhóm duplicate là các file cùng (hash_algo, hash_value): hash của hai thuật toán khác nhau không được so với nhau.
+// Digest của mỗi thuật toán có độ dài riêng nên hash_value vẫn đủ làm khoá của duplicate_groups và mốc -from-hash.
 type dupGroupRow struct {
+	HashAlgo  sql.NullString
 	HashValue string
 	FileCount int64
 	TotalSize int64
 	FirstSeen time.Time
-}
-
-func parseSQLiteTime(s string) (time.Time, error) {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return time.Time{}, fmt.Errorf("empty time")
-	}
-	layouts := []string{
-		time.RFC3339Nano,
-		time.RFC3339,
-		// SQLite TEXT với timezone offset (có dấu cách thay vì 'T')
-		"2006-01-02 15:04:05.999999999Z07:00",
-		"2006-01-02 15:04:05Z07:00",
-		"2006-01-02 15:04:05.999999999",
-		"2006-01-02 15:04:05",
-		"2006-01-02T15:04:05.999999999Z07:00",
-		"2006-01-02T15:04:05Z07:00",
-	}
-	var lastErr error
-	for _, layout := range layouts {
-		if t, err := time.Parse(layout, s); err == nil {
-			return t, nil
-		} else {
-			lastErr = err
-		}
-	}
-	return time.Time{}, fmt.Errorf("cannot parse time %q: %w", s, lastErr)
+	Outcome   *verifyOutcome // kết quả xác minh (-verify); nil = đánh dấu theo hash như cũ
 }
 
 func configureDBForCheckDup(db *sql.DB) {
@@ -63,13 +42,7 @@ func configureDBForCheckDup(db *sql.DB) {
 
 func ensureDuplicateProgressTables(ctx context.Context, db *sql.DB) error {
 	stmts := []string{
-		`CREATE TABLE IF NOT EXISTS duplicate_groups (
-		  hash_value TEXT PRIMARY KEY,
-		  file_count INTEGER NOT NULL,
-		  total_size BIGINT NOT NULL,
-		  first_seen DATETIME NOT NULL,
-		  last_updated DATETIME NOT NULL
-		)`,
+		duplicateGroupsDDL,
 		`CREATE INDEX IF NOT EXISTS idx_duplicate_groups_size ON duplicate_groups (total_size DESC)`,
 		`CREATE INDEX IF NOT EXISTS idx_duplicate_groups_count ON duplicate_groups (file_count DESC)`,
 
@@ -105,8 +78,8 @@ func countDuplicateGroups(ctx context.Context, db *sql.DB, fromHash string) (int
 		FROM (
 			SELECT 1
 			FROM fs_files
-			WHERE hash_value IS NOT NULL AND hash_value != '' AND hash_value > ?
-			GROUP BY hash_value
+			WHERE hash_value IS NOT NULL AND hash_value != '' AND hardlink_of IS NULL AND hash_value > ?
+			GROUP BY hash_algo, hash_value
 			HAVING COUNT(*) > 1
 		) t
 	`, fromHash).Scan(&total)
@@ -163,9 +136,10 @@ func commitDupBatch(ctx context.Context, db *sql.DB, runID int64, batch []dupGro
 	defer tx.Rollback()
 
 	ins, err := tx.PrepareContext(ctx, `
-		INSERT INTO duplicate_groups (hash_value, file_count, total_size, first_seen, last_updated)
-		VALUES (?, ?, ?, ?, ?)
-		ON CONFLICT(hash_value) DO UPDATE SET
+		INSERT INTO duplicate_groups (hash_value, hash_algo, file_count, total_size, first_seen, last_updated)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(hash_value, class) DO UPDATE SET
+		  hash_algo = excluded.hash_algo,
 		  file_count = excluded.file_count,
 		  total_size = excluded.total_size,
 		  first_seen = excluded.first_seen,
@@ -180,19 +154,33 @@ func commitDupBatch(ctx context.Context, db *sql.DB, runID int64, batch []dupGro
 	hashes := make([]any, 0, len(batch))
 
 	for _, g := range batch {
-		if _, err := ins.ExecContext(ctx, g.HashValue, g.FileCount, g.TotalSize, g.FirstSeen, now); err != nil {
+		*processedGroups++
+		*lastHash = sql.NullString{String: g.HashValue, Valid: true}
+		if g.Outcome != nil {
+			// Đã xác minh: chỉ đánh dấu các lớp còn là bản trùng, ghi verified_at và hash_collisions
+			kept, err := applyVerifiedGroup(ctx, tx, g.HashAlgo, g.HashValue, g.FirstSeen, *g.Outcome, now)
+			if err != nil {
+				return err
+			}
+			for _, class := range kept {
+				for _, m := range class {
+					*processedFiles++
+					*processedSize += m.Size
+				}
+			}
+			continue
+		}
+		if _, err := ins.ExecContext(ctx, g.HashValue, g.HashAlgo, g.FileCount, g.TotalSize, g.FirstSeen, now); err != nil {
 			return err
 		}
 		hashes = append(hashes, g.HashValue)
-		*processedGroups++
 		*processedFiles += g.FileCount
 		*processedSize += g.TotalSize
-		*lastHash = sql.NullString{String: g.HashValue, Valid: true}
 	}
 
 	// Mark is_duplicate theo batch group hash_value
 	if len(hashes) > 0 {
-		q := fmt.Sprintf(`UPDATE fs_files SET is_duplicate = 1 WHERE hash_value IN (%s)`, buildInPlaceholders(len(hashes)))
+		q := fmt.Sprintf(`UPDATE fs_files SET is_duplicate = 1 WHERE hash_value IN (%s) AND hardlink_of IS NULL`, buildInPlaceholders(len(hashes)))
 		if _, err := tx.ExecContext(ctx, q, hashes...); err != nil {
 			return err
 		}
@@ -211,7 +199,27 @@ func commitDupBatch(ctx context.Context, db *sql.DB, runID int64, batch []dupGro
 	return tx.Commit()
 }
 
-func runCheckDup(ctx context.Context, db *sql.DB, dbFile string, reset bool, fromHash string, batchSize int, progressEvery int) error {
+// verifyGroup xác minh nội dung nhóm g (verify: bytes | hash) và log file không đọc được, nhóm bị tách
+func verifyGroup(ctx context.Context, db *sql.DB, g *dupGroupRow, verify string) error {
+	members, err := loadDupMembers(ctx, db, g.HashAlgo, g.HashValue)
+	if err != nil {
+		return err
+	}
+	out, err := verifyDupGroup(ctx, members, verify, g.HashAlgo.String, nil)
+	if err != nil {
+		return err
+	}
+	for _, u := range out.Unreadable {
+		log.Printf("WARN: cannot verify %s (hash=%s), left out of group: %v", u.Member.Path, g.HashValue, u.Err)
+	}
+	if out.Split() {
+		log.Printf("COLLISION: hash=%s algo=%s verify=%s split into %d classes: %v", g.HashValue, g.HashAlgo.String, verify, len(out.Classes), collisionPaths(out))
+	}
+	g.Outcome = &out
+	return nil
+}
+
+func runCheckDup(ctx context.Context, db *sql.DB, dbFile string, reset bool, fromHash string, batchSize int, progressEvery int, verify string) error {
 	if err := ensureDuplicateProgressTables(ctx, db); err != nil {
 		return fmt.Errorf("ensure tables: %w", err)
 	}
@@ -228,22 +236,25 @@ func runCheckDup(ctx context.Context, db *sql.DB, dbFile string, reset bool, fro
 		return fmt.Errorf("count groups: %w", err)
 	}
 
-	runID, err := startRun(ctx, db, totalGroups, fmt.Sprintf("dbfile=%s reset=%v fromHash=%q", dbFile, reset, fromHash))
+	runID, err := startRun(ctx, db, totalGroups, fmt.Sprintf("dbfile=%s reset=%v fromHash=%q verify=%s", dbFile, reset, fromHash, verify))
 	if err != nil {
 		return fmt.Errorf("start run: %w", err)
 	}
 
+	// Batch và trạng thái run vẫn được ghi khi nhận SIGINT/SIGTERM
+	writeCtx := context.WithoutCancel(ctx)
+
 	var lastHash sql.NullString
 	status := "failed"
-	defer func() { finishRun(ctx, db, runID, status, lastHash) }()
+	defer func() { finishRun(writeCtx, db, runID, status, lastHash) }()
 
 	log.Printf("Start checkdup run_id=%d total_groups=%d ...", runID, totalGroups)
 
 	rows, err := db.QueryContext(ctx, `
-		SELECT hash_value, COUNT(*) as file_count, SUM(size) as total_size, MIN(st_mtime) as first_seen
+		SELECT hash_algo, hash_value, COUNT(*) as file_count, SUM(size) as total_size, MIN(st_mtime) as first_seen
 		FROM fs_files
-		WHERE hash_value IS NOT NULL AND hash_value != '' AND hash_value > ?
-		GROUP BY hash_value
+		WHERE hash_value IS NOT NULL AND hash_value != '' AND hardlink_of IS NULL AND hash_value > ?
+		GROUP BY hash_algo, hash_value
 		HAVING COUNT(*) > 1
 		ORDER BY hash_value
 	`, fromHash)
@@ -264,17 +275,17 @@ func runCheckDup(ctx context.Context, db *sql.DB, dbFile string, reset bool, fro
 		if len(batch) == 0 {
 			return nil
 		}
-		if err := commitDupBatch(ctx, db, runID, batch, &processedGroups, &processedFiles, &processedSize, &lastHash); err != nil {
+		if err := commitDupBatch(writeCtx, db, runID, batch, &processedGroups, &processedFiles, &processedSize, &lastHash); err != nil {
 			return err
 		}
 		batch = batch[:0]
 		return nil
 	}
 
-	for rows.Next() {
+	for ctx.Err() == nil && rows.Next() {
 		var g dupGroupRow
 		var firstSeenRaw sql.NullString
-		if err := rows.Scan(&g.HashValue, &g.FileCount, &g.TotalSize, &firstSeenRaw); err != nil {
+		if err := rows.Scan(&g.HashAlgo, &g.HashValue, &g.FileCount, &g.TotalSize, &firstSeenRaw); err != nil {
 			return fmt.Errorf("scan group row: %w", err)
 		}
 		if firstSeenRaw.Valid {
@@ -288,6 +299,14 @@ func runCheckDup(ctx context.Context, db *sql.DB, dbFile string, reset bool, fro
 		} else {
 			g.FirstSeen = time.Now()
 		}
+		if verify != "off" {
+			if err := verifyGroup(ctx, db, &g, verify); err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return fmt.Errorf("verify group %s: %w", g.HashValue, err)
+			}
+		}
 		batch = append(batch, g)
 
 		if len(batch) >= batchSize {
@@ -307,13 +326,20 @@ func runCheckDup(ctx context.Context, db *sql.DB, dbFile string, reset bool, fro
 				processedGroups, totalGroups, pct, processedFiles, float64(processedSize)/(1024*1024*1024), speed, lastHash.String)
 		}
 	}
-	if err := rows.Err(); err != nil {
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
 		return fmt.Errorf("iterate groups: %w", err)
 	}
 	if err := flush(); err != nil {
 		return fmt.Errorf("final commit: %w", err)
 	}
 
+	if ctx.Err() != nil {
+		status = "interrupted"
+		log.Printf("INTERRUPTED: run_id=%d groups=%d files=%d last=%s", runID, processedGroups, processedFiles, lastHash.String)
+		log.Printf("Resume with: -dbfile %s -reset=false -from-hash %s", dbFile, lastHash.String)
+		return ctx.Err()
+	}
+
 	// Done
 	status = "done"
 	log.Printf("DONE: run_id=%d groups=%d files=%d size=%.2fGB last=%s",
@@ -328,6 +354,7 @@ func main() {
 	fromHash := flag.String("from-hash", "", "Start from hash_value > this value (useful to resume manually)")
 	batchSize := flag.Int("batch", 500, "Batch size (number of duplicate groups per transaction)")
 	progressEvery := flag.Int("progress", 2000, "Log progress every N processed groups (0 to disable)")
+	verify := flag.String("verify", "off", "Verify each group before marking: off, bytes (byte-by-byte) or hash (second independent hash); mismatches are split and logged to hash_collisions")
 	flag.Parse()
 
 	if *dbFile == "" {
@@ -337,8 +364,16 @@ func main() {
 	if *batchSize <= 0 {
 		log.Fatal("batch must be > 0")
 	}
+	*verify = strings.ToLower(*verify)
+	if !slices.Contains(verifyModes, *verify) {
+		log.Fatalf("invalid -verify %q (want %s)", *verify, strings.Join(verifyModes, ", "))
+	}
+
+	ctx, stop := notifyShutdown(context.Background(), func(sig os.Signal) {
+		log.Printf("Received %s, committing current batch ...", sig)
+	})
+	defer stop()
 
-	ctx := context.Background()
 	db, err := openDBSQLite(*dbFile)
 	if err != nil {
 		log.Fatalf("open db: %v", err)
@@ -347,7 +382,11 @@ func main() {
 
 	configureDBForCheckDup(db)
 
-	if err := runCheckDup(ctx, db, *dbFile, *reset, *fromHash, *batchSize, *progressEvery); err != nil {
+	if err := runCheckDup(ctx, db, *dbFile, *reset, *fromHash, *batchSize, *progressEvery, *verify); err != nil {
+		if errors.Is(err, context.Canceled) {
+			db.Close()
+			os.Exit(exitInterrupted)
+		}
 		log.Fatalf("checkdup failed: %v", err)
 	}
 }
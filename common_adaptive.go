@@ -0,0 +1,328 @@
+// common_adaptive.go
+//go:build scanner || hasher
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Điều chỉnh số worker theo tải thực tế (ADAPTIVE): mỗi ADAPTIVE_INTERVAL giây DynamicConfig đọc CPU bận,
+// iowait (/proc/stat) và RAM đã dùng (/proc/meminfo) rồi đổi giới hạn của các pool đang chạy (duyệt thư mục
+// Phase 1, hash Phase 2) qua workerGate: vượt ngưỡng thì giảm 1/4 số worker, dư tải rõ rệt thì tăng 1
+// đến trần của pool. Riêng iowait cao chỉ thu lại worker đã tăng thêm, không giảm dưới số worker cấu hình:
+// trên NAS/share mạng iowait cao là bình thường, giảm tiếp chỉ làm chậm quét. Mỗi lần đổi được log kèm lý do và số đo.
+
+// sysSample: bộ đếm hệ thống tại một thời điểm (readSysSample, theo nền tảng)
+type sysSample struct {
+	cpuTotal, cpuIdle, cpuIOWait uint64 // jiffies cộng dồn từ lúc boot
+	memTotal, memAvailable       uint64 // bytes
+}
+
+// SystemLoad: tải đo được giữa hai lần lấy mẫu
+type SystemLoad struct {
+	CPU    float64 // % CPU bận (không tính idle, iowait)
+	IOWait float64 // % thời gian CPU chờ I/O
+	Mem    float64 // % RAM đã dùng (MemTotal - MemAvailable)
+	HeapMB uint64  // heap của tiến trình
+	System bool    // có số đo /proc (false = chỉ có HeapMB)
+}
+
+// workerGate giới hạn số worker của một pool được chạy cùng lúc; giới hạn đổi được khi pool đang chạy.
+// Pool khởi động sẵn số goroutine bằng trần, mỗi worker gọi enter/leave quanh từng việc.
+// nil = không giới hạn.
+type workerGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+	closed bool
+}
+
+// newWorkerGate: gate với giới hạn ban đầu limit; khi ctx bị huỷ mọi worker đang chờ được đánh thức
+func newWorkerGate(ctx context.Context, limit int) *workerGate {
+	g := &workerGate{limit: max(1, limit)}
+	g.cond = sync.NewCond(&g.mu)
+	context.AfterFunc(ctx, func() {
+		g.mu.Lock()
+		g.closed = true
+		g.mu.Unlock()
+		g.cond.Broadcast()
+	})
+	return g
+}
+
+// enter chờ đến khi còn chỗ; false nếu ctx đã bị huỷ
+func (g *workerGate) enter() bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.active >= g.limit && !g.closed {
+		g.cond.Wait()
+	}
+	if g.closed {
+		return false
+	}
+	g.active++
+	return true
+}
+
+func (g *workerGate) leave() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	g.cond.Signal()
+}
+
+func (g *workerGate) Limit() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.limit
+}
+
+func (g *workerGate) setLimit(n int) {
+	g.mu.Lock()
+	g.limit = max(1, n)
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+// adaptivePool: một pool đang chạy do DynamicConfig điều chỉnh
+type adaptivePool struct {
+	name     string
+	gate     *workerGate
+	min, max int
+	base     int // số worker cấu hình: sàn khi giảm do iowait
+}
+
+// DynamicConfig implements runtime configuration adjustment
+type DynamicConfig struct {
+	*Config
+	logger   *ScannerLogger
+	memLimit int64 // bytes; heap vượt 90% cũng tính là thiếu RAM (0 = không xét)
+
+	// Giá trị lúc khởi động: số root quét song song, batch insert (không đổi khi đang chạy)
+	AdjustedBatchSize int
+	AdjustedWorkers   int
+
+	throttle *ioThrottle // HASH_BWLIMIT/HASH_IOPS/tạm dừng của Phase 2 (common_throttle.go)
+
+	mu       sync.Mutex
+	pools    []*adaptivePool
+	prev     sysSample
+	havePrev bool
+	noSystem bool // đã cảnh báo không đọc được /proc
+}
+
+// NewDynamicConfig creates a new dynamic configuration
+func NewDynamicConfig(baseCfg *Config, memLimitMB int64, logger *ScannerLogger) *DynamicConfig {
+	// Config dựng tay (hasher) không qua loadConfig: dùng ngưỡng mặc định
+	if baseCfg.AdaptiveMinWorkers <= 0 {
+		baseCfg.AdaptiveMinWorkers = 1
+	}
+	if baseCfg.AdaptiveCPUHigh <= 0 {
+		baseCfg.AdaptiveCPUHigh = defaultAdaptiveCPUHigh
+	}
+	if baseCfg.AdaptiveIOWaitHigh <= 0 {
+		baseCfg.AdaptiveIOWaitHigh = defaultAdaptiveIOWaitHigh
+	}
+	if baseCfg.AdaptiveMemHigh <= 0 {
+		baseCfg.AdaptiveMemHigh = defaultAdaptiveMemHigh
+	}
+	if baseCfg.AdaptiveInterval <= 0 {
+		baseCfg.AdaptiveInterval = defaultAdaptiveInterval
+	}
+	return &DynamicConfig{
+		Config:            baseCfg,
+		logger:            logger,
+		memLimit:          memLimitMB * 1024 * 1024, // Convert to bytes
+		AdjustedBatchSize: baseCfg.BatchSize,
+		AdjustedWorkers:   baseCfg.MaxWorkers,
+		throttle:          newIOThrottle(baseCfg.HashBandwidth, baseCfg.HashIOPS),
+	}
+}
+
+// Throttle: bộ giới hạn I/O dùng chung của các worker hash (nil khi dc nil = không giới hạn)
+func (dc *DynamicConfig) Throttle() *ioThrottle {
+	if dc == nil {
+		return nil
+	}
+	return dc.throttle
+}
+
+// NewGate tạo gate cho pool name (initial worker, trần maxWorkers) và đưa vào danh sách điều chỉnh.
+// Trả về nil (không giới hạn) khi tắt ADAPTIVE; dc nil cũng được (mainLegacy).
+func (dc *DynamicConfig) NewGate(ctx context.Context, name string, initial, maxWorkers int) *workerGate {
+	if dc == nil || !dc.Adaptive {
+		return nil
+	}
+	maxWorkers = max(maxWorkers, initial, 1)
+	g := newWorkerGate(ctx, initial)
+	dc.mu.Lock()
+	dc.pools = append(dc.pools, &adaptivePool{name: name, gate: g, min: min(dc.AdaptiveMinWorkers, maxWorkers), max: maxWorkers, base: max(initial, 1)})
+	dc.mu.Unlock()
+	return g
+}
+
+// Release bỏ gate khỏi danh sách điều chỉnh khi pool kết thúc
+func (dc *DynamicConfig) Release(g *workerGate) {
+	if dc == nil || g == nil {
+		return
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for i, p := range dc.pools {
+		if p.gate == g {
+			dc.pools = append(dc.pools[:i], dc.pools[i+1:]...)
+			return
+		}
+	}
+}
+
+// Run theo dõi HASH_CONTROL_FILE và tín hiệu điều khiển hash, rồi gọi AutoAdjust mỗi ADAPTIVE_INTERVAL giây
+// (khi bật ADAPTIVE) đến khi ctx bị huỷ
+func (dc *DynamicConfig) Run(ctx context.Context) {
+	if dc.HashBandwidth > 0 || dc.HashIOPS > 0 || dc.HashControlFile != "" {
+		dc.logger.logger.WithFields(dc.throttle.fields()).WithField("controlFile", dc.HashControlFile).Info("Hash I/O throttling enabled")
+	}
+	ctl := &throttleControl{t: dc.throttle, path: dc.HashControlFile, bps: dc.HashBandwidth, iops: dc.HashIOPS, logger: dc.logger}
+	go ctl.watch(ctx)
+
+	if !dc.Adaptive {
+		return
+	}
+	dc.logger.logger.WithFields(logrus.Fields{
+		"minWorkers": dc.AdaptiveMinWorkers,
+		"cpuHigh":    dc.AdaptiveCPUHigh,
+		"iowaitHigh": dc.AdaptiveIOWaitHigh,
+		"memHigh":    dc.AdaptiveMemHigh,
+		"interval":   dc.AdaptiveInterval,
+	}).Info("Adaptive concurrency enabled")
+	dc.mu.Lock()
+	dc.sample() // mẫu gốc để lần đầu đã tính được tải
+	dc.mu.Unlock()
+	tick := time.NewTicker(time.Duration(dc.AdaptiveInterval) * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			dc.AutoAdjust()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sample đo tải từ lần lấy mẫu trước; false khi chưa đủ hai mẫu /proc và cũng không xét được heap
+func (dc *DynamicConfig) sample() (SystemLoad, bool) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	load := SystemLoad{HeapMB: m.HeapAlloc >> 20}
+
+	cur, err := readSysSample()
+	if err != nil {
+		if !dc.noSystem {
+			dc.noSystem = true
+			dc.logger.logger.WithError(err).Warn("Adaptive concurrency: system load unavailable, adjusting on Go heap only")
+		}
+		return load, dc.memLimit > 0
+	}
+	prev, ok := dc.prev, dc.havePrev
+	dc.prev, dc.havePrev = cur, true
+	if !ok || cur.cpuTotal <= prev.cpuTotal {
+		return load, false
+	}
+	total := float64(cur.cpuTotal - prev.cpuTotal)
+	idle := float64(cur.cpuIdle - prev.cpuIdle)
+	iowait := float64(cur.cpuIOWait - prev.cpuIOWait)
+	load.CPU = 100 * (total - idle - iowait) / total
+	load.IOWait = 100 * iowait / total
+	if cur.memTotal > 0 {
+		load.Mem = 100 * (1 - float64(cur.memAvailable)/float64(cur.memTotal))
+	}
+	load.System = true
+	return load, true
+}
+
+// decide: -1 giảm, +1 tăng, 0 giữ nguyên, kèm lý do; ioOnly = giảm chỉ vì iowait
+func (dc *DynamicConfig) decide(load SystemLoad) (action int, reason string, ioOnly bool) {
+	heapHigh := dc.memLimit > 0 && load.HeapMB<<20 > uint64(float64(dc.memLimit)*0.9)
+	heapLow := dc.memLimit == 0 || load.HeapMB<<20 < uint64(float64(dc.memLimit)*0.7)
+	cpuHigh, ioHigh, memHigh := float64(dc.AdaptiveCPUHigh), float64(dc.AdaptiveIOWaitHigh), float64(dc.AdaptiveMemHigh)
+
+	switch {
+	case load.System && load.Mem >= memHigh:
+		return -1, fmt.Sprintf("memory pressure: %.1f%% RAM used (limit %d%%)", load.Mem, dc.AdaptiveMemHigh), false
+	case heapHigh:
+		return -1, fmt.Sprintf("memory pressure: Go heap %d MB above 90%% of MEM_LIMIT_MB", load.HeapMB), false
+	case load.System && load.CPU >= cpuHigh:
+		return -1, fmt.Sprintf("CPU busy: %.1f%% (limit %d%%)", load.CPU, dc.AdaptiveCPUHigh), false
+	case load.System && load.IOWait >= ioHigh:
+		return -1, fmt.Sprintf("I/O saturated: iowait %.1f%% (limit %d%%)", load.IOWait, dc.AdaptiveIOWaitHigh), true
+	case load.System && heapLow && load.CPU < cpuHigh-20 && load.IOWait < ioHigh/2 && load.Mem < memHigh-10:
+		return 1, fmt.Sprintf("headroom: CPU %.1f%%, iowait %.1f%%, RAM %.1f%%", load.CPU, load.IOWait, load.Mem), false
+	}
+	return 0, "", false
+}
+
+// AutoAdjust đo tải một lần và đổi giới hạn worker của các pool đang chạy
+func (dc *DynamicConfig) AutoAdjust() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	load, ok := dc.sample()
+	if !ok || len(dc.pools) == 0 {
+		return
+	}
+	action, reason, ioOnly := dc.decide(load)
+	if action == 0 {
+		return
+	}
+	for _, p := range dc.pools {
+		old := p.gate.Limit()
+		n := old
+		if action > 0 {
+			n = min(p.max, old+1)
+		} else {
+			floor := p.min
+			if ioOnly {
+				floor = max(p.min, p.base)
+			}
+			// pool đã dưới sàn (giảm do RAM/CPU trước đó) thì giữ nguyên, không tăng lại
+			n = min(old, max(floor, old-max(1, old/4)))
+		}
+		if n == old {
+			continue
+		}
+		p.gate.setLimit(n)
+
+		fields := logrus.Fields{
+			"pool":       p.name,
+			"oldWorkers": old,
+			"newWorkers": n,
+			"reason":     reason,
+			"heapMB":     load.HeapMB,
+		}
+		if load.System {
+			fields["cpu"] = fmt.Sprintf("%.1f%%", load.CPU)
+			fields["iowait"] = fmt.Sprintf("%.1f%%", load.IOWait)
+			fields["memUsed"] = fmt.Sprintf("%.1f%%", load.Mem)
+		}
+		msg := "Adaptive concurrency: increasing workers"
+		if action < 0 {
+			msg = "Adaptive concurrency: reducing workers"
+		}
+		dc.logger.logger.WithFields(fields).Info(msg)
+	}
+}
@@ -0,0 +1,311 @@
+// common_aggregate.go
+//go:build scanner || deleter || aggregate
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// FolderAggStats (dùng chung): kết quả tính tổng hợp thư mục
+type FolderAggStats struct {
+	Folders   int64
+	RootFiles int64 // tổng subtree_files của các thư mục gốc
+	RootSize  int64 // tổng subtree_size của các thư mục gốc
+	Orphans   int64 // thư mục có parent_id trỏ tới folder không tồn tại
+	Hardlinks HardlinkStats
+}
+
+// HardlinkStats (dùng chung): kết quả nhận diện hardlink theo (st_dev, st_ino)
+type HardlinkStats struct {
+	Groups      int64 // số inode có từ 2 đường dẫn trở lên trong DB
+	LinkedFiles int64 // số bản liên kết (hardlink_of IS NOT NULL)
+	LinkedSize  int64 // dung lượng của các bản liên kết, không bị tính lặp
+}
+
+// linkedSizeSQL: size chỉ tính cho file chính, bản liên kết (hardlink) cộng 0
+const linkedSizeSQL = `CASE WHEN hardlink_of IS NULL THEN size ELSE 0 END`
+
+// markHardlinksTx gom file theo (st_dev, st_ino): file có id nhỏ nhất là file chính, các đường dẫn
+// còn lại được gán hardlink_of = id file chính. Chỉ xét st_nlink > 1 nên nhanh trên DB lớn;
+// DB cũ chưa có st_ino thì không file nào bị coi là hardlink.
+func markHardlinksTx(ctx context.Context, tx *sql.Tx) (HardlinkStats, error) {
+	var hs HardlinkStats
+	if _, err := tx.ExecContext(ctx, `UPDATE fs_files SET hardlink_of = NULL WHERE hardlink_of IS NOT NULL`); err != nil {
+		return hs, fmt.Errorf("reset hardlinks: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE fs_files
+		SET hardlink_of = g.primary_id
+		FROM (
+			SELECT st_dev, st_ino, MIN(id) AS primary_id
+			FROM fs_files
+			WHERE st_nlink > 1 AND st_ino IS NOT NULL
+			GROUP BY st_dev, st_ino
+			HAVING COUNT(*) > 1
+		) AS g
+		WHERE fs_files.st_nlink > 1
+		  AND fs_files.st_dev = g.st_dev AND fs_files.st_ino = g.st_ino
+		  AND fs_files.id != g.primary_id
+	`); err != nil {
+		return hs, fmt.Errorf("mark hardlinks: %w", err)
+	}
+	err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(DISTINCT hardlink_of), COUNT(*), COALESCE(SUM(size), 0)
+		FROM fs_files WHERE hardlink_of IS NOT NULL
+	`).Scan(&hs.Groups, &hs.LinkedFiles, &hs.LinkedSize)
+	if err != nil {
+		return hs, fmt.Errorf("count hardlinks: %w", err)
+	}
+	return hs, nil
+}
+
+// updateFolderAggregates nhận diện lại hardlink rồi tính lại toàn bộ size/number_files (trực tiếp) và
+// subtree_size/subtree_files (đệ quy theo parent_id) cho mọi thư mục. Bản liên kết vẫn được đếm
+// trong number_files nhưng dung lượng chỉ tính một lần (ở thư mục của file chính).
+func updateFolderAggregates(ctx context.Context, db *sql.DB) (FolderAggStats, error) {
+	var stats FolderAggStats
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	if stats.Hardlinks, err = markHardlinksTx(ctx, tx); err != nil {
+		return stats, err
+	}
+
+	// 1) Tổng trực tiếp theo folder_id
+	if _, err := tx.ExecContext(ctx, `UPDATE fs_folders SET size = 0, number_files = 0`); err != nil {
+		return stats, fmt.Errorf("reset direct totals: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE fs_folders
+		SET size = a.total_size, number_files = a.file_count
+		FROM (
+			SELECT folder_id, COALESCE(SUM(`+linkedSizeSQL+`), 0) AS total_size, COUNT(*) AS file_count
+			FROM fs_files
+			GROUP BY folder_id
+		) AS a
+		WHERE fs_folders.id = a.folder_id
+	`); err != nil {
+		return stats, fmt.Errorf("update direct totals: %w", err)
+	}
+
+	// 2) Tổng đệ quy: load cây thư mục (id, parent_id) vào RAM rồi cộng dồn từ lá lên gốc
+	type node struct {
+		parent     int64
+		size       int64
+		files      int64
+		subSize    int64
+		subFiles   int64
+		depth      int
+		depthKnown bool
+	}
+	nodes := map[int64]*node{}
+	rows, err := tx.QueryContext(ctx, `SELECT id, COALESCE(parent_id, 0), size, number_files FROM fs_folders`)
+	if err != nil {
+		return stats, fmt.Errorf("load folders: %w", err)
+	}
+	for rows.Next() {
+		var id int64
+		n := &node{}
+		if err := rows.Scan(&id, &n.parent, &n.size, &n.files); err != nil {
+			rows.Close()
+			return stats, fmt.Errorf("scan folder: %w", err)
+		}
+		n.subSize, n.subFiles = n.size, n.files
+		nodes[id] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return stats, fmt.Errorf("iterate folders: %w", err)
+	}
+
+	var depthOf func(id int64, n *node) int
+	depthOf = func(id int64, n *node) int {
+		if n.depthKnown {
+			return n.depth
+		}
+		n.depthKnown = true // chặn vòng lặp nếu dữ liệu parent_id bị hỏng
+		if p, ok := nodes[n.parent]; ok && n.parent != id {
+			n.depth = depthOf(n.parent, p) + 1
+		}
+		return n.depth
+	}
+	ids := make([]int64, 0, len(nodes))
+	for id, n := range nodes {
+		depthOf(id, n)
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return nodes[ids[i]].depth > nodes[ids[j]].depth })
+
+	for _, id := range ids {
+		n := nodes[id]
+		if n.parent == 0 {
+			stats.RootSize += n.subSize
+			stats.RootFiles += n.subFiles
+			continue
+		}
+		p, ok := nodes[n.parent]
+		if !ok {
+			stats.Orphans++
+			continue
+		}
+		p.subSize += n.subSize
+		p.subFiles += n.subFiles
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `UPDATE fs_folders SET subtree_size = ?, subtree_files = ? WHERE id = ?`)
+	if err != nil {
+		return stats, fmt.Errorf("prepare subtree update: %w", err)
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		n := nodes[id]
+		if _, err := stmt.ExecContext(ctx, n.subSize, n.subFiles, id); err != nil {
+			return stats, fmt.Errorf("update subtree totals of folder %d: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return stats, err
+	}
+	stats.Folders = int64(len(nodes))
+	return stats, nil
+}
+
+// refreshFolderAggregates cập nhật lại tổng hợp cho các thư mục bị ảnh hưởng (và toàn bộ
+// thư mục tổ tiên của chúng) sau khi xoá/sửa một phần dữ liệu. ID không còn tồn tại bị bỏ qua.
+func refreshFolderAggregates(ctx context.Context, db *sql.DB, folderIDs []int64) (int, error) {
+	if len(folderIDs) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Bản liên kết mất file chính (file chính vừa bị xoá) trở thành file chính mới: thư mục của
+	// chúng đổi dung lượng nên cũng phải tính lại
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT f.folder_id FROM fs_files f
+		WHERE f.hardlink_of IS NOT NULL
+		  AND NOT EXISTS (SELECT 1 FROM fs_files p WHERE p.id = f.hardlink_of)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("find orphaned hardlinks: %w", err)
+	}
+	var relinked []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan orphaned hardlink folder: %w", err)
+		}
+		relinked = append(relinked, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterate orphaned hardlinks: %w", err)
+	}
+	if len(relinked) > 0 {
+		if _, err := markHardlinksTx(ctx, tx); err != nil {
+			return 0, err
+		}
+		folderIDs = append(folderIDs, relinked...)
+	}
+
+	// Thu thập các folder còn tồn tại + toàn bộ tổ tiên (parentOf: 0 = thư mục gốc)
+	parentOf := map[int64]int64{}
+	direct := map[int64]bool{}
+	for _, id := range folderIDs {
+		cur := id
+		for cur > 0 {
+			if _, seen := parentOf[cur]; seen {
+				break
+			}
+			var parent sql.NullInt64
+			err := tx.QueryRowContext(ctx, `SELECT parent_id FROM fs_folders WHERE id = ?`, cur).Scan(&parent)
+			if err == sql.ErrNoRows {
+				break
+			}
+			if err != nil {
+				return 0, fmt.Errorf("lookup folder %d: %w", cur, err)
+			}
+			parentOf[cur] = parent.Int64
+			cur = parent.Int64
+		}
+		if _, ok := parentOf[id]; ok {
+			direct[id] = true
+		}
+	}
+
+	depth := map[int64]int{}
+	var depthOf func(id int64, guard int) int
+	depthOf = func(id int64, guard int) int {
+		if d, ok := depth[id]; ok {
+			return d
+		}
+		d := 0
+		if p, ok := parentOf[id]; ok && p > 0 && guard < len(parentOf) {
+			if _, known := parentOf[p]; known {
+				d = depthOf(p, guard+1) + 1
+			}
+		}
+		depth[id] = d
+		return d
+	}
+	for id := range parentOf {
+		depthOf(id, 0)
+	}
+
+	directStmt, err := tx.PrepareContext(ctx, `
+		UPDATE fs_folders
+		SET size = (SELECT COALESCE(SUM(`+linkedSizeSQL+`), 0) FROM fs_files WHERE folder_id = ?),
+		    number_files = (SELECT COUNT(*) FROM fs_files WHERE folder_id = ?)
+		WHERE id = ?
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer directStmt.Close()
+	for id := range direct {
+		if _, err := directStmt.ExecContext(ctx, id, id, id); err != nil {
+			return 0, fmt.Errorf("update direct totals of folder %d: %w", id, err)
+		}
+	}
+
+	ids := make([]int64, 0, len(depth))
+	for id := range depth {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return depth[ids[i]] > depth[ids[j]] })
+
+	subStmt, err := tx.PrepareContext(ctx, `
+		UPDATE fs_folders
+		SET subtree_size = size + (SELECT COALESCE(SUM(c.subtree_size), 0) FROM fs_folders c WHERE c.parent_id = ?),
+		    subtree_files = number_files + (SELECT COALESCE(SUM(c.subtree_files), 0) FROM fs_folders c WHERE c.parent_id = ?)
+		WHERE id = ?
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer subStmt.Close()
+	for _, id := range ids {
+		if _, err := subStmt.ExecContext(ctx, id, id, id); err != nil {
+			return 0, fmt.Errorf("update subtree totals of folder %d: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
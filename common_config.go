@@ -1,60 +1,574 @@
 // common_config.go
-//go:build scanner || deleter || reporter || reporter_optimized || checkdup
+//go:build scanner || deleter || reporter || reporter_optimized || checkdup || aggregate || hasher
 
 package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/go-ini/ini"
 )
 
-// loadConfig tải cấu hình từ config.ini
-func loadConfig(path string) (*Config, error) {
-	cfg, err := ini.Load(path)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+// Ngưỡng mặc định của ADAPTIVE (cũng dùng cho Config dựng tay, xem NewDynamicConfig)
+const (
+	defaultAdaptiveCPUHigh    = 85
+	defaultAdaptiveIOWaitHigh = 30
+	defaultAdaptiveMemHigh    = 90
+	defaultAdaptiveInterval   = 10
+)
+
+// Thuật toán hash của Phase 2 (HASH_ALGO), xem newHasher trong common_hash.go
+const defaultHashAlgo = "sha256"
+
+var hashAlgos = []string{"sha256", "blake2b", "xxh64", "md5"}
+
+// hashModes: giá trị của HASH_MODE (suspects = chỉ file trùng size, catalog = mọi file)
+var hashModes = []string{"suspects", "catalog"}
+
+// hashCacheFileName: file cache hash mặc định trong output_dir (HASH_CACHE_FILE rỗng)
+const hashCacheFileName = "hash_cache.db"
+
+// verifyModes: giá trị của VERIFY_DUPLICATES (off = chỉ dựa trên hash)
+var verifyModes = []string{"off", "bytes", "hash"}
+
+// envPrefix: tiền tố biến môi trường ghi đè cấu hình (ví dụ SCANDIR_MAX_WORKERS=8)
+const envPrefix = "SCANDIR_"
+
+// loadConfig tải cấu hình từ config.ini rồi áp dụng biến môi trường SCANDIR_* và apply (cờ dòng lệnh),
+// cuối cùng kiểm tra root trùng/lồng nhau (resolveRootOverlaps).
+// path rỗng = không đọc file, chỉ dùng giá trị mặc định + biến môi trường (dùng cho container).
+func loadConfig(path string, apply ...func(*Config)) (*Config, error) {
+	cfg := ini.Empty()
+	if path != "" {
+		var err error
+		if cfg, err = ini.Load(path); err != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", path, err)
+		}
 	}
 
 	secOut := cfg.Section("output")
 	outDir := secOut.Key("output_dir").MustString("./output_scans")
-	if err := os.MkdirAll(outDir, 0755); err != nil {
-		return nil, fmt.Errorf("cannot create output dir %s: %w", outDir, err)
-	}
 
 	secScan := cfg.Section("scan")
 	batch := secScan.Key("BATCH_SIZE").MustInt(5000)
 	workers := secScan.Key("MAX_WORKERS").MustInt(4)
+	memLimit := secScan.Key("MEM_LIMIT_MB").MustInt64(2048)
 	excl := secScan.Key("EXCLUDE_DIRS").MustString(".git,.streams,@Recently-Snapshot,@Recycle,COREBanking")
-	exclude := map[string]struct{}{}
-	for _, n := range strings.Split(excl, ",") {
-		n = strings.TrimSpace(n)
-		if n != "" {
-			exclude[n] = struct{}{}
+
+	incremental := secScan.Key("INCREMENTAL").MustBool(false)
+	prevDB := strings.TrimSpace(secScan.Key("PREVIOUS_DB").String())
+	skipUnchanged := secScan.Key("SKIP_UNCHANGED_DIRS").MustBool(false)
+	resume := secScan.Key("RESUME").MustBool(false)
+	rootWorkers := secScan.Key("ROOT_WORKERS").MustInt(4)
+	followSymlinks := secScan.Key("FOLLOW_SYMLINKS").MustBool(false)
+	oneFS := secScan.Key("ONE_FILESYSTEM").MustBool(false)
+	overlap := secScan.Key("OVERLAPPING_ROOTS").MustString("error")
+	thumucDepth := secScan.Key("THUMUC_DEPTH").MustInt(0)
+	adaptive := secScan.Key("ADAPTIVE").MustBool(true)
+	adaptiveMin := secScan.Key("ADAPTIVE_MIN_WORKERS").MustInt(1)
+	adaptiveMax := secScan.Key("ADAPTIVE_MAX_WORKERS").MustInt(0)
+	adaptiveCPU := secScan.Key("ADAPTIVE_CPU_HIGH").MustInt(defaultAdaptiveCPUHigh)
+	adaptiveIOWait := secScan.Key("ADAPTIVE_IOWAIT_HIGH").MustInt(defaultAdaptiveIOWaitHigh)
+	adaptiveMem := secScan.Key("ADAPTIVE_MEM_HIGH").MustInt(defaultAdaptiveMemHigh)
+	adaptiveInterval := secScan.Key("ADAPTIVE_INTERVAL").MustInt(defaultAdaptiveInterval)
+	hashBW, err := parseByteRate(secScan.Key("HASH_BWLIMIT").MustString("0"))
+	if err != nil {
+		return nil, fmt.Errorf("HASH_BWLIMIT: %w", err)
+	}
+	hashIOPS := secScan.Key("HASH_IOPS").MustInt(0)
+	hashControl := strings.TrimSpace(secScan.Key("HASH_CONTROL_FILE").String())
+	hashDevWorkers := secScan.Key("HASH_DEVICE_WORKERS").MustInt(0)
+	hashOrder := secScan.Key("HASH_ORDER").MustString("inode")
+	partialHash := secScan.Key("PARTIAL_HASH").MustBool(true)
+	partialMin := secScan.Key("PARTIAL_HASH_MIN_SIZE").MustInt64(1 << 20)
+	hashAlgo := secScan.Key("HASH_ALGO").MustString(defaultHashAlgo)
+	hashRehash := secScan.Key("HASH_REHASH").MustString("lazy")
+	verifyDuplicates := secScan.Key("VERIFY_DUPLICATES").MustString("off")
+	hashMode := secScan.Key("HASH_MODE").MustString("suspects")
+	hashCatalogTags := splitNonEmpty(secScan.Key("HASH_CATALOG_TAGS").String(), ",")
+	hashCatalogExts := splitNonEmpty(secScan.Key("HASH_CATALOG_EXTENSIONS").String(), ",")
+	hashCache := secScan.Key("HASH_CACHE").MustBool(true)
+	hashCacheFile := strings.TrimSpace(secScan.Key("HASH_CACHE_FILE").String())
+	hashCacheMaxAge := secScan.Key("HASH_CACHE_MAX_AGE").MustInt(90)
+
+	// Mỗi key trong [exclude] / [exclude.<Tag>] là một mẫu loại trừ
+	excludePatterns := sectionValues(cfg.Section("exclude"))
+	rootExcludes := map[string][]string{}
+	for _, sec := range cfg.Sections() {
+		if tag, ok := strings.CutPrefix(sec.Name(), "exclude."); ok && tag != "" {
+			rootExcludes[tag] = sectionValues(sec)
+		}
+	}
+
+	// [thumuc]: Tag = N (độ sâu thumuc riêng cho root); [tags.<kind>]: giá trị tag = regex
+	rootDepths := map[string]int{}
+	for _, k := range cfg.Section("thumuc").Keys() {
+		n, err := k.Int()
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid [thumuc] %s = %q (want depth >= 0)", k.Name(), k.Value())
 		}
+		rootDepths[k.Name()] = n
+	}
+	// [hash_devices]: Tag = N (số worker hash đọc cùng lúc trên thiết bị chứa root có tag đó)
+	rootDevWorkers := map[string]int{}
+	for _, k := range cfg.Section("hash_devices").Keys() {
+		n, err := k.Int()
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid [hash_devices] %s = %q (want workers >= 0)", k.Name(), k.Value())
+		}
+		rootDevWorkers[k.Name()] = n
+	}
+	tagRules, err := loadTagRules(path)
+	if err != nil {
+		return nil, err
 	}
 
 	secPaths := cfg.Section("paths")
 	paths := [][2]string{}
+	overrides := map[string]int{}
 	for _, k := range secPaths.Keys() {
-		v := k.Value()
-		if p, t, ok := strings.Cut(v, ":"); ok {
-			paths = append(paths, [2]string{strings.TrimSpace(p), strings.TrimSpace(t)})
-		} else if v != "" {
-			paths = append(paths, [2]string{v, filepath.Base(v)})
+		if p, n, ok := parsePathSpec(k.Value()); ok {
+			paths = append(paths, p)
+			if n > 0 {
+				overrides[filepath.Clean(p[0])] = n
+			}
 		}
 	}
 
-	return &Config{
+	c := &Config{
 		OutputDir:  outDir,
 		BatchSize:  batch,
 		MaxWorkers: workers,
-		Exclude:    exclude,
+		MemLimitMB: memLimit,
+		Exclude:    parseExcludeList(excl),
 		Paths:      paths,
-	}, nil
+
+		Incremental:       incremental,
+		PreviousDB:        prevDB,
+		SkipUnchangedDirs: skipUnchanged,
+		Resume:            resume,
+
+		RootWorkers:         rootWorkers,
+		RootWorkersOverride: overrides,
+
+		ExcludePatterns:     excludePatterns,
+		RootExcludePatterns: rootExcludes,
+
+		FollowSymlinks: followSymlinks,
+		OneFileSystem:  oneFS,
+
+		OverlappingRoots: overlap,
+
+		ThuMucDepth:     thumucDepth,
+		RootThuMucDepth: rootDepths,
+		TagRules:        tagRules,
+
+		Adaptive:           adaptive,
+		AdaptiveMinWorkers: adaptiveMin,
+		AdaptiveMaxWorkers: adaptiveMax,
+		AdaptiveCPUHigh:    adaptiveCPU,
+		AdaptiveIOWaitHigh: adaptiveIOWait,
+		AdaptiveMemHigh:    adaptiveMem,
+		AdaptiveInterval:   adaptiveInterval,
+
+		HashBandwidth:   hashBW,
+		HashIOPS:        hashIOPS,
+		HashControlFile: hashControl,
+
+		HashDeviceWorkers:     hashDevWorkers,
+		RootHashDeviceWorkers: rootDevWorkers,
+		HashOrder:             hashOrder,
+
+		PartialHash:        partialHash,
+		PartialHashMinSize: partialMin,
+
+		HashAlgo:   hashAlgo,
+		HashRehash: hashRehash,
+
+		VerifyDuplicates: verifyDuplicates,
+
+		HashMode:              hashMode,
+		HashCatalogTags:       hashCatalogTags,
+		HashCatalogExtensions: hashCatalogExts,
+
+		HashCache:       hashCache,
+		HashCacheFile:   hashCacheFile,
+		HashCacheMaxAge: hashCacheMaxAge,
+	}
+
+	if err := applyEnvOverrides(c); err != nil {
+		return nil, err
+	}
+	for _, fn := range apply {
+		fn(c)
+	}
+	if c.HashOrder != "inode" && c.HashOrder != "path" {
+		return nil, fmt.Errorf("invalid HASH_ORDER %q (want inode or path)", c.HashOrder)
+	}
+	c.HashAlgo = strings.ToLower(c.HashAlgo)
+	if !slices.Contains(hashAlgos, c.HashAlgo) {
+		return nil, fmt.Errorf("invalid HASH_ALGO %q (want %s)", c.HashAlgo, strings.Join(hashAlgos, ", "))
+	}
+	if c.HashRehash != "lazy" && c.HashRehash != "all" {
+		return nil, fmt.Errorf("invalid HASH_REHASH %q (want lazy or all)", c.HashRehash)
+	}
+	c.VerifyDuplicates = strings.ToLower(c.VerifyDuplicates)
+	if !slices.Contains(verifyModes, c.VerifyDuplicates) {
+		return nil, fmt.Errorf("invalid VERIFY_DUPLICATES %q (want %s)", c.VerifyDuplicates, strings.Join(verifyModes, ", "))
+	}
+	c.HashMode = strings.ToLower(c.HashMode)
+	if !slices.Contains(hashModes, c.HashMode) {
+		return nil, fmt.Errorf("invalid HASH_MODE %q (want %s)", c.HashMode, strings.Join(hashModes, ", "))
+	}
+	c.HashCatalogExtensions = normalizeExtensions(c.HashCatalogExtensions)
+	if err := c.resolveRootOverlaps(); err != nil {
+		return nil, err
+	}
+	if c.HashCacheFile == "" {
+		c.HashCacheFile = filepath.Join(c.OutputDir, hashCacheFileName)
+	}
+	return c, nil
+}
+
+// applyEnvOverrides ghi đè từng field của Config bằng biến môi trường SCANDIR_<KEY>
+// (KEY trùng tên key trong config.ini). SCANDIR_PATHS là danh sách path:Tag ngăn cách bởi ';'.
+func applyEnvOverrides(c *Config) error {
+	var firstErr error
+	envString := func(key string, dst *string) {
+		if v, ok := os.LookupEnv(envPrefix + key); ok {
+			*dst = strings.TrimSpace(v)
+		}
+	}
+	envInt := func(key string, dst *int) {
+		if v, ok := os.LookupEnv(envPrefix + key); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s%s=%q: %w", envPrefix, key, v, err)
+			}
+			if err == nil {
+				*dst = n
+			}
+		}
+	}
+	envInt64 := func(key string, dst *int64) {
+		if v, ok := os.LookupEnv(envPrefix + key); ok {
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s%s=%q: %w", envPrefix, key, v, err)
+			}
+			if err == nil {
+				*dst = n
+			}
+		}
+	}
+	envBool := func(key string, dst *bool) {
+		if v, ok := os.LookupEnv(envPrefix + key); ok {
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("invalid %s%s=%q: %w", envPrefix, key, v, err)
+			}
+			if err == nil {
+				*dst = b
+			}
+		}
+	}
+
+	envString("OUTPUT_DIR", &c.OutputDir)
+	envInt("BATCH_SIZE", &c.BatchSize)
+	envInt("MAX_WORKERS", &c.MaxWorkers)
+	envInt64("MEM_LIMIT_MB", &c.MemLimitMB)
+	if v, ok := os.LookupEnv(envPrefix + "EXCLUDE_DIRS"); ok {
+		c.Exclude = parseExcludeList(v)
+	}
+	if v, ok := os.LookupEnv(envPrefix + "PATHS"); ok {
+		c.Paths, c.RootWorkersOverride = parsePathList(v)
+	}
+	envBool("INCREMENTAL", &c.Incremental)
+	envString("PREVIOUS_DB", &c.PreviousDB)
+	envBool("SKIP_UNCHANGED_DIRS", &c.SkipUnchangedDirs)
+	envBool("RESUME", &c.Resume)
+	envInt("ROOT_WORKERS", &c.RootWorkers)
+	if v, ok := os.LookupEnv(envPrefix + "EXCLUDE_PATTERNS"); ok {
+		c.ExcludePatterns = splitNonEmpty(v, ";")
+	}
+	envBool("FOLLOW_SYMLINKS", &c.FollowSymlinks)
+	envBool("ONE_FILESYSTEM", &c.OneFileSystem)
+	envString("OVERLAPPING_ROOTS", &c.OverlappingRoots)
+	envInt("THUMUC_DEPTH", &c.ThuMucDepth)
+	envBool("ADAPTIVE", &c.Adaptive)
+	envInt("ADAPTIVE_MIN_WORKERS", &c.AdaptiveMinWorkers)
+	envInt("ADAPTIVE_MAX_WORKERS", &c.AdaptiveMaxWorkers)
+	envInt("ADAPTIVE_CPU_HIGH", &c.AdaptiveCPUHigh)
+	envInt("ADAPTIVE_IOWAIT_HIGH", &c.AdaptiveIOWaitHigh)
+	envInt("ADAPTIVE_MEM_HIGH", &c.AdaptiveMemHigh)
+	envInt("ADAPTIVE_INTERVAL", &c.AdaptiveInterval)
+	if v, ok := os.LookupEnv(envPrefix + "HASH_BWLIMIT"); ok {
+		n, err := parseByteRate(v)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("invalid %sHASH_BWLIMIT: %w", envPrefix, err)
+		}
+		if err == nil {
+			c.HashBandwidth = n
+		}
+	}
+	envInt("HASH_IOPS", &c.HashIOPS)
+	envString("HASH_CONTROL_FILE", &c.HashControlFile)
+	envInt("HASH_DEVICE_WORKERS", &c.HashDeviceWorkers)
+	envString("HASH_ORDER", &c.HashOrder)
+	envBool("PARTIAL_HASH", &c.PartialHash)
+	envInt64("PARTIAL_HASH_MIN_SIZE", &c.PartialHashMinSize)
+	envString("HASH_ALGO", &c.HashAlgo)
+	envString("HASH_REHASH", &c.HashRehash)
+	envString("VERIFY_DUPLICATES", &c.VerifyDuplicates)
+	envString("HASH_MODE", &c.HashMode)
+	if v, ok := os.LookupEnv(envPrefix + "HASH_CATALOG_TAGS"); ok {
+		c.HashCatalogTags = splitNonEmpty(v, ",")
+	}
+	if v, ok := os.LookupEnv(envPrefix + "HASH_CATALOG_EXTENSIONS"); ok {
+		c.HashCatalogExtensions = splitNonEmpty(v, ",")
+	}
+	envBool("HASH_CACHE", &c.HashCache)
+	envString("HASH_CACHE_FILE", &c.HashCacheFile)
+	envInt("HASH_CACHE_MAX_AGE", &c.HashCacheMaxAge)
+
+	return firstErr
+}
+
+// parsePathSpec tách "path:Tag[:N]" (tag mặc định = tên thư mục cuối; N = số worker riêng cho root, 0 = ROOT_WORKERS)
+func parsePathSpec(v string) ([2]string, int, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return [2]string{}, 0, false
+	}
+	p, t, ok := strings.Cut(v, ":")
+	if !ok {
+		return [2]string{v, filepath.Base(v)}, 0, true
+	}
+	workers := 0
+	if tag, n, ok := strings.Cut(t, ":"); ok {
+		t = tag
+		if w, err := strconv.Atoi(strings.TrimSpace(n)); err == nil && w > 0 {
+			workers = w
+		}
+	}
+	p = strings.TrimSpace(p)
+	if t = strings.TrimSpace(t); t == "" {
+		t = filepath.Base(p)
+	}
+	return [2]string{p, t}, workers, true
+}
+
+// parsePathList tách danh sách "path:Tag[:N]" ngăn cách bởi ';' (dùng cho SCANDIR_PATHS và cờ -roots)
+func parsePathList(v string) ([][2]string, map[string]int) {
+	paths := [][2]string{}
+	overrides := map[string]int{}
+	for _, spec := range strings.Split(v, ";") {
+		if p, n, ok := parsePathSpec(spec); ok {
+			paths = append(paths, p)
+			if n > 0 {
+				overrides[filepath.Clean(p[0])] = n
+			}
+		}
+	}
+	return paths, overrides
+}
+
+// resolveRootOverlaps phát hiện root trùng nhau hoặc lồng nhau trong Paths (so theo đường dẫn tuyệt đối
+// sau khi resolve symlink) rồi xử lý theo OverlappingRoots:
+//
+//	error   không chạy, báo các cặp root bị chồng lấn
+//	merge   bỏ root con (và root trùng), nội dung được quét một lần với tag của root cha
+//	nested  giữ root con với tag riêng; root cha bỏ qua thư mục đó khi duyệt (NestedRoots)
+//
+// Root trùng nhau luôn chỉ giữ lần khai báo đầu tiên (trừ chế độ error).
+func (c *Config) resolveRootOverlaps() error {
+	mode := strings.ToLower(strings.TrimSpace(c.OverlappingRoots))
+	switch mode {
+	case "":
+		mode = "error"
+	case "error", "merge", "nested":
+	default:
+		return fmt.Errorf("invalid OVERLAPPING_ROOTS %q (want error, merge or nested)", c.OverlappingRoots)
+	}
+	c.OverlappingRoots = mode
+
+	type rootRef struct {
+		path, tag, abs, real string
+	}
+	refs := make([]rootRef, len(c.Paths))
+	for i, p := range c.Paths {
+		r := rootRef{path: p[0], tag: p[1], abs: p[0]}
+		if abs, err := filepath.Abs(p[0]); err == nil {
+			r.abs = abs
+		}
+		r.real = r.abs
+		if real, err := filepath.EvalSymlinks(r.abs); err == nil {
+			r.real = real
+		}
+		refs[i] = r
+	}
+
+	inside := func(p, dir string) bool {
+		rel, err := filepath.Rel(dir, p)
+		return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+
+	c.NestedRoots = map[string][]string{}
+	drop := make([]bool, len(refs))
+	var conflicts []string
+	for i, a := range refs {
+		for j, b := range refs {
+			if i == j || drop[i] || drop[j] {
+				continue
+			}
+			switch {
+			case a.real == b.real && i < j:
+				conflicts = append(conflicts, fmt.Sprintf("%s:%s and %s:%s are the same directory", a.path, a.tag, b.path, b.tag))
+				drop[j] = mode != "error"
+			case inside(b.real, a.real):
+				conflicts = append(conflicts, fmt.Sprintf("%s:%s is inside %s:%s", b.path, b.tag, a.path, a.tag))
+				switch mode {
+				case "merge":
+					drop[j] = true
+				case "nested":
+					rel, _ := filepath.Rel(a.real, b.real)
+					c.NestedRoots[a.abs] = append(c.NestedRoots[a.abs], filepath.Join(a.abs, rel))
+				}
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	if mode == "error" {
+		return fmt.Errorf("overlapping roots in [paths] (set OVERLAPPING_ROOTS = merge or nested to allow): %s",
+			strings.Join(conflicts, "; "))
+	}
+
+	for _, msg := range conflicts {
+		log.Printf("WARN: overlapping roots (%s): %s", mode, msg)
+	}
+	paths := c.Paths[:0]
+	for i, p := range c.Paths {
+		if !drop[i] {
+			paths = append(paths, p)
+		}
+	}
+	c.Paths = paths
+	return nil
+}
+
+// thumucDepth: độ sâu cột thumuc cho root có tag tag ([thumuc] > THUMUC_DEPTH)
+func (c *Config) thumucDepth(tag string) int {
+	if n, ok := c.RootThuMucDepth[tag]; ok {
+		return n
+	}
+	return c.ThuMucDepth
+}
+
+// workersForRoot: số worker liệt kê thư mục trong một root (path:Tag:N > ROOT_WORKERS, tối thiểu 1)
+func (c *Config) workersForRoot(root string) int {
+	if n, ok := c.RootWorkersOverride[filepath.Clean(root)]; ok && n > 0 {
+		return n
+	}
+	if c.RootWorkers > 0 {
+		return c.RootWorkers
+	}
+	return 1
+}
+
+// hashDeviceWorkers: số worker hash đọc cùng lúc trên thiết bị chứa root có tag tag
+// ([hash_devices] > HASH_DEVICE_WORKERS; 0 = không giới hạn riêng)
+func (c *Config) hashDeviceWorkers(tag string) int {
+	if n, ok := c.RootHashDeviceWorkers[tag]; ok {
+		return n
+	}
+	return c.HashDeviceWorkers
+}
+
+// sectionValues: giá trị (khác rỗng) của mọi key trong một section, theo thứ tự trong file
+func sectionValues(sec *ini.Section) []string {
+	var out []string
+	for _, k := range sec.Keys() {
+		if v := strings.TrimSpace(k.Value()); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// normalizeExtensions: phần mở rộng dạng ".pdf" chữ thường (như LOWER(fileExt)); nhận cả "pdf", "*.PDF"
+func normalizeExtensions(exts []string) []string {
+	out := make([]string, 0, len(exts))
+	for _, e := range exts {
+		e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), "*"))
+		if e == "" || e == "." {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// loadTagRules đọc các luật [tags.<kind>] của file cấu hình path (rỗng = không có luật). Key là giá trị tag nên
+// cùng một giá trị (thường gặp: ${1}) có thể lặp lại với nhiều regex: file được đọc riêng với AllowShadows để
+// giữ mọi dòng theo thứ tự — go-ini mặc định chỉ giữ dòng cuối, còn đọc chung thì các section khác (ví dụ [paths])
+// sẽ đổi sang giữ dòng đầu.
+func loadTagRules(path string) ([]TagRuleSpec, error) {
+	if path == "" {
+		return nil, nil
+	}
+	cfg, err := ini.LoadSources(ini.LoadOptions{AllowShadows: true, AllowDuplicateShadowValues: true}, path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	var rules []TagRuleSpec
+	for _, sec := range cfg.Sections() {
+		kind, ok := strings.CutPrefix(sec.Name(), "tags.")
+		if !ok || kind == "" {
+			continue
+		}
+		for _, k := range sec.Keys() {
+			for _, v := range k.ValueWithShadows() {
+				if v = strings.TrimSpace(v); v != "" {
+					rules = append(rules, TagRuleSpec{Kind: kind, Value: k.Name(), Pattern: v})
+				}
+			}
+		}
+	}
+	return rules, nil
+}
+
+// splitNonEmpty tách v theo sep, bỏ khoảng trắng và phần tử rỗng
+func splitNonEmpty(v, sep string) []string {
+	var out []string
+	for _, p := range strings.Split(v, sep) {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// parseExcludeList tách danh sách tên thư mục loại trừ ngăn cách bởi dấu phẩy
+func parseExcludeList(excl string) map[string]struct{} {
+	exclude := map[string]struct{}{}
+	for _, n := range strings.Split(excl, ",") {
+		n = strings.TrimSpace(n)
+		if n != "" {
+			exclude[n] = struct{}{}
+		}
+	}
+	return exclude
 }
 
 // topFolder (dùng chung)
@@ -67,4 +581,31 @@ func topFolder(path string, depth int) string {
 		return parts[len(parts)-1]
 	}
 	return ""
-}
\ No newline at end of file
+}
+
+// parseByteRate đọc băng thông dạng "0", "1048576", "500K", "20M", "1G" (bytes/giây, hệ số 1024; có thể thêm "B", "/s")
+func parseByteRate(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	s = strings.TrimSuffix(s, "/S")
+	s = strings.TrimSuffix(s, "B")
+	s = strings.TrimSuffix(s, "I")
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte rate %q (want e.g. 0, 500K, 20M, 1G)", v)
+	}
+	return int64(n * float64(mult)), nil
+}
@@ -0,0 +1,127 @@
+// common_config_test.go
+//go:build scanner || deleter || reporter || reporter_optimized || checkdup || aggregate || hasher
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"500K", 500 << 10, false},
+		{" 10k ", 10 << 10, false},
+		{"20M", 20 << 20, false},
+		{"20MB", 20 << 20, false},
+		{"20MiB", 20 << 20, false},
+		{"20M/s", 20 << 20, false},
+		{"1.5M", 3 << 19, false},
+		{"1G", 1 << 30, false},
+		{"", 0, true},
+		{"-1", 0, true},
+		{"abc", 0, true},
+		{"M", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseByteRate(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseByteRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResolveRootOverlaps(t *testing.T) {
+	base := t.TempDir()
+	for _, d := range []string{"share/a/b", "other"} {
+		if err := os.MkdirAll(filepath.Join(base, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	share, child, other := filepath.Join(base, "share"), filepath.Join(base, "share", "a"), filepath.Join(base, "other")
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(share, link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		paths   [][2]string
+		want    [][2]string
+		nested  map[string][]string
+		wantErr string
+	}{
+		{
+			name:   "disjoint",
+			paths:  [][2]string{{share, "S"}, {other, "O"}},
+			want:   [][2]string{{share, "S"}, {other, "O"}},
+			nested: map[string][]string{},
+		},
+		{
+			name:    "nested rejected by default",
+			paths:   [][2]string{{share, "S"}, {child, "C"}},
+			wantErr: "is inside",
+		},
+		{
+			name:    "same directory through symlink rejected",
+			mode:    "error",
+			paths:   [][2]string{{share, "S"}, {link, "L"}},
+			wantErr: "same directory",
+		},
+		{
+			name:   "merge drops child and duplicate",
+			mode:   "merge",
+			paths:  [][2]string{{child, "C"}, {share, "S"}, {link, "L"}, {other, "O"}},
+			want:   [][2]string{{share, "S"}, {other, "O"}},
+			nested: map[string][]string{},
+		},
+		{
+			name:   "nested keeps child",
+			mode:   "Nested",
+			paths:  [][2]string{{share, "S"}, {child, "C"}},
+			want:   [][2]string{{share, "S"}, {child, "C"}},
+			nested: map[string][]string{share: {child}},
+		},
+		{
+			name:    "invalid mode",
+			mode:    "skip",
+			paths:   [][2]string{{share, "S"}},
+			wantErr: "invalid OVERLAPPING_ROOTS",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{OverlappingRoots: tt.mode, Paths: append([][2]string(nil), tt.paths...)}
+			err := c.resolveRootOverlaps()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.Paths, tt.want) {
+				t.Errorf("Paths = %v, want %v", c.Paths, tt.want)
+			}
+			if !reflect.DeepEqual(c.NestedRoots, tt.nested) {
+				t.Errorf("NestedRoots = %v, want %v", c.NestedRoots, tt.nested)
+			}
+		})
+	}
+}
@@ -1,5 +1,5 @@
 // common_db.go
-//go:build scanner || deleter || reporter || reporter_optimized || checkdup
+//go:build scanner || deleter || reporter || reporter_optimized || checkdup || aggregate || hasher
 
 package main
 
@@ -8,6 +8,10 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3" // Import driver SQLite
 )
@@ -25,26 +29,9 @@ func ensureSchemaUpgrades(db *sql.DB) error {
 		return fmt.Errorf("check sqlite_master(fs_folders): %w", err)
 	}
 
-	cols := map[string]bool{}
-	rows, err := db.Query(`PRAGMA table_info(fs_folders);`)
+	cols, err := tableColumns(db, "fs_folders")
 	if err != nil {
-		return fmt.Errorf("PRAGMA table_info(fs_folders): %w", err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var cid int
-		var name, ctype string
-		var notnull int
-		var dflt sql.NullString
-		var pk int
-		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
-			return fmt.Errorf("scan PRAGMA table_info(fs_folders): %w", err)
-		}
-		cols[name] = true
-	}
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("iterate PRAGMA table_info(fs_folders): %w", err)
+		return err
 	}
 
 	// Add folder stats columns if missing (non-destructive).
@@ -68,6 +55,128 @@ func ensureSchemaUpgrades(db *sql.DB) error {
 			return fmt.Errorf("ALTER TABLE fs_folders ADD COLUMN subtree_files: %w", err)
 		}
 	}
+	if !cols["incomplete"] {
+		if _, err := db.Exec(`ALTER TABLE fs_folders ADD COLUMN incomplete BOOLEAN NOT NULL DEFAULT 0;`); err != nil {
+			return fmt.Errorf("ALTER TABLE fs_folders ADD COLUMN incomplete: %w", err)
+		}
+	}
+
+	// Cột metadata stat đầy đủ (DB tạo bởi bản cũ chỉ có st_mtime)
+	for _, table := range []string{"fs_folders", "fs_files"} {
+		have, err := tableColumns(db, table)
+		if err != nil {
+			return err
+		}
+		for _, col := range statColumnsDDL {
+			name := strings.Fields(col)[0]
+			if have[name] {
+				continue
+			}
+			if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s;`, table, col)); err != nil {
+				return fmt.Errorf("ALTER TABLE %s ADD COLUMN %s: %w", table, name, err)
+			}
+		}
+	}
+	fileCols, err := tableColumns(db, "fs_files")
+	if err != nil {
+		return err
+	}
+	if !fileCols["hardlink_of"] {
+		if _, err := db.Exec(`ALTER TABLE fs_files ADD COLUMN hardlink_of INTEGER NULL;`); err != nil {
+			return fmt.Errorf("ALTER TABLE fs_files ADD COLUMN hardlink_of: %w", err)
+		}
+	}
+	if !fileCols["partial_hash"] {
+		if _, err := db.Exec(`ALTER TABLE fs_files ADD COLUMN partial_hash TEXT NULL;`); err != nil {
+			return fmt.Errorf("ALTER TABLE fs_files ADD COLUMN partial_hash: %w", err)
+		}
+	}
+	if !fileCols["hash_algo"] {
+		if _, err := db.Exec(`ALTER TABLE fs_files ADD COLUMN hash_algo TEXT NULL;`); err != nil {
+			return fmt.Errorf("ALTER TABLE fs_files ADD COLUMN hash_algo: %w", err)
+		}
+		// DB cũ chỉ có MD5; Phase 2 hash lại các row này dần dần theo HASH_REHASH
+		if _, err := db.Exec(`UPDATE fs_files SET hash_algo = 'md5' WHERE hash_value IS NOT NULL;`); err != nil {
+			return fmt.Errorf("set hash_algo of existing hashes: %w", err)
+		}
+	}
+	if !fileCols["verified_at"] {
+		if _, err := db.Exec(`ALTER TABLE fs_files ADD COLUMN verified_at DATETIME NULL;`); err != nil {
+			return fmt.Errorf("ALTER TABLE fs_files ADD COLUMN verified_at: %w", err)
+		}
+	}
+	if !fileCols["dup_class"] {
+		if _, err := db.Exec(`ALTER TABLE fs_files ADD COLUMN dup_class INTEGER NULL;`); err != nil {
+			return fmt.Errorf("ALTER TABLE fs_files ADD COLUMN dup_class: %w", err)
+		}
+	}
+	if dupCols, err := tableColumns(db, "duplicate_groups"); err != nil {
+		return err
+	} else if len(dupCols) > 0 {
+		if !dupCols["hash_algo"] {
+			if _, err := db.Exec(`ALTER TABLE duplicate_groups ADD COLUMN hash_algo TEXT NULL;`); err != nil {
+				return fmt.Errorf("ALTER TABLE duplicate_groups ADD COLUMN hash_algo: %w", err)
+			}
+			if _, err := db.Exec(`UPDATE duplicate_groups SET hash_algo = 'md5';`); err != nil {
+				return fmt.Errorf("set hash_algo of existing duplicate groups: %w", err)
+			}
+		}
+		if !dupCols["verified_at"] {
+			if _, err := db.Exec(`ALTER TABLE duplicate_groups ADD COLUMN verified_at DATETIME NULL;`); err != nil {
+				return fmt.Errorf("ALTER TABLE duplicate_groups ADD COLUMN verified_at: %w", err)
+			}
+		}
+		if !dupCols["class"] {
+			if err := upgradeDuplicateGroupsClass(db); err != nil {
+				return fmt.Errorf("add duplicate_groups.class: %w", err)
+			}
+		}
+	}
+	if !fileCols["tag_set"] {
+		if _, err := db.Exec(`ALTER TABLE fs_files ADD COLUMN tag_set TEXT NULL;`); err != nil {
+			return fmt.Errorf("ALTER TABLE fs_files ADD COLUMN tag_set: %w", err)
+		}
+	}
+	for _, stmt := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_file_owner ON fs_files (owner);`,
+		`CREATE INDEX IF NOT EXISTS idx_file_dev_ino ON fs_files (st_dev, st_ino) WHERE st_nlink > 1;`,
+		`CREATE INDEX IF NOT EXISTS idx_file_hardlink_of ON fs_files (hardlink_of) WHERE hardlink_of IS NOT NULL;`,
+		`CREATE INDEX IF NOT EXISTS idx_file_algo_hash ON fs_files (hash_algo, hash_value) WHERE hash_value IS NOT NULL;`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+
+	// Bảng theo dõi lần quét và bảng entry đặc biệt (DB tạo bởi bản cũ chưa có)
+	for _, stmt := range append(scanRunDDL, specialDDL...) {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("create scan run tables: %w", err)
+		}
+	}
+	for _, stmt := range tagDDL {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("create fs_tags: %w", err)
+		}
+	}
+	for _, stmt := range collisionDDL {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("create hash_collisions: %w", err)
+		}
+	}
+	rootCols, err := tableColumns(db, "scan_roots")
+	if err != nil {
+		return err
+	}
+	for _, col := range scanRootVolumeDDL {
+		name := strings.Fields(col)[0]
+		if rootCols[name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE scan_roots ADD COLUMN %s;`, col)); err != nil {
+			return fmt.Errorf("ALTER TABLE scan_roots ADD COLUMN %s: %w", name, err)
+		}
+	}
 
 	// Helpful indexes (no-op if already exists).
 	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_folder_size ON fs_folders (size DESC);`); err != nil {
@@ -82,10 +191,482 @@ func ensureSchemaUpgrades(db *sql.DB) error {
 	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_folder_subtree_files ON fs_folders (subtree_files DESC);`); err != nil {
 		return fmt.Errorf("CREATE INDEX idx_folder_subtree_files: %w", err)
 	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_folder_incomplete ON fs_folders (incomplete) WHERE incomplete = 1;`); err != nil {
+		return fmt.Errorf("CREATE INDEX idx_folder_incomplete: %w", err)
+	}
 
 	return nil
 }
 
+// statColumnsDDL: cột metadata stat của fs_files/fs_folders (trùng với initDDL), dùng để nâng cấp DB cũ
+var statColumnsDDL = []string{
+	"st_uid INTEGER",
+	"st_gid INTEGER",
+	"owner TEXT",
+	"st_mode INTEGER",
+	"st_atime DATETIME",
+	"st_ctime DATETIME",
+	"st_ino INTEGER",
+	"st_dev INTEGER",
+	"st_nlink INTEGER",
+	"st_blocks INTEGER",
+}
+
+// duplicateGroupsDDL: bảng nhóm trùng, khoá (hash_value, class)
+const duplicateGroupsDDL = `CREATE TABLE IF NOT EXISTS duplicate_groups (
+		  hash_value TEXT NOT NULL,
+		  class INTEGER NOT NULL DEFAULT 0, -- fs_files.dup_class (0 = nhóm không bị tách)
+		  hash_algo TEXT NULL,
+		  file_count INTEGER NOT NULL,
+		  total_size BIGINT NOT NULL,
+		  first_seen DATETIME NOT NULL,
+		  last_updated DATETIME NOT NULL,
+		  verified_at DATETIME NULL, -- NULL = chưa xác minh, chỉ dựa trên hash
+		  PRIMARY KEY (hash_value, class)
+		)`
+
+// upgradeDuplicateGroupsClass dựng lại duplicate_groups (khoá cũ chỉ có hash_value) với cột class, giữ dữ liệu
+func upgradeDuplicateGroupsClass(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`ALTER TABLE duplicate_groups RENAME TO duplicate_groups_old`,
+		duplicateGroupsDDL,
+		`INSERT INTO duplicate_groups (hash_value, class, hash_algo, file_count, total_size, first_seen, last_updated, verified_at)
+		 SELECT hash_value, 0, hash_algo, file_count, total_size, first_seen, last_updated, verified_at FROM duplicate_groups_old`,
+		`DROP TABLE duplicate_groups_old`,
+		`CREATE INDEX IF NOT EXISTS idx_duplicate_groups_size ON duplicate_groups (total_size DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_duplicate_groups_count ON duplicate_groups (file_count DESC)`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// tableColumns trả về tập tên cột của table (PRAGMA table_info)
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s);`, table))
+	if err != nil {
+		return nil, fmt.Errorf("PRAGMA table_info(%s): %w", table, err)
+	}
+	defer rows.Close()
+
+	cols := map[string]bool{}
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return nil, fmt.Errorf("scan PRAGMA table_info(%s): %w", table, err)
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// scanRunDDL: bảng checkpoint của Phase 1 (scan_runs: mỗi lần chạy scanner, scan_roots: trạng thái từng root)
+var scanRunDDL = []string{
+	`CREATE TABLE IF NOT EXISTS scan_runs (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  started_at DATETIME NOT NULL,
+	  finished_at DATETIME NULL,
+	  status TEXT NOT NULL, -- running|done|failed|interrupted
+	  host TEXT,
+	  mode TEXT, -- full|incremental|resume
+	  resumed_from INTEGER NULL,
+	  config TEXT, -- JSON snapshot của Config
+	  total_files INTEGER DEFAULT 0,
+	  note TEXT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_scan_runs_started_at ON scan_runs (started_at DESC);`,
+	`CREATE TABLE IF NOT EXISTS scan_excludes (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  run_id INTEGER NOT NULL,
+	  root_id INTEGER NOT NULL, -- scan_roots.id
+	  scope TEXT NOT NULL, -- global | tag của root ([exclude.<Tag>])
+	  kind TEXT NOT NULL, -- dirname|name|path|rel|regex|scanignore
+	  pattern TEXT NOT NULL, -- với scanignore: đường dẫn file .scanignore
+	  hits INTEGER DEFAULT 0 -- số entry bị bỏ qua (thư mục bị loại trừ tính 1, không tính nội dung bên trong)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_scan_excludes_run ON scan_excludes (run_id, root_id);`,
+	`CREATE TABLE IF NOT EXISTS scan_roots (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  run_id INTEGER NOT NULL,
+	  root_path TEXT NOT NULL,
+	  loaithumuc TEXT,
+	  status TEXT NOT NULL, -- pending|running|done|skipped|failed|interrupted
+	  started_at DATETIME NULL,
+	  finished_at DATETIME NULL,
+	  file_count INTEGER DEFAULT 0,
+	  error TEXT NULL,
+	  st_dev INTEGER NULL, -- volume chứa root
+	  mount_point TEXT NULL,
+	  fs_type TEXT NULL,
+	  mount_source TEXT NULL,
+
+	  FOREIGN KEY (run_id) REFERENCES scan_runs (id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_scan_roots_run_id ON scan_roots (run_id);`,
+	`CREATE TABLE IF NOT EXISTS scan_errors (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  run_id INTEGER NULL,
+	  root_id INTEGER NULL, -- scan_roots.id
+	  folder_id INTEGER NULL, -- fs_folders.id bị đánh dấu incomplete
+	  path TEXT NOT NULL,
+	  op TEXT NOT NULL, -- lstat|readdir|readlink
+	  errno INTEGER NULL,
+	  error TEXT,
+	  attempts INTEGER DEFAULT 1, -- số lần thử (lỗi tạm thời được retry có backoff)
+	  occurred_at DATETIME NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_scan_errors_run ON scan_errors (run_id, root_id);`,
+	`CREATE INDEX IF NOT EXISTS idx_scan_errors_path ON scan_errors (path);`,
+	`CREATE TABLE IF NOT EXISTS scan_mounts (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  run_id INTEGER NULL,
+	  root_id INTEGER NULL, -- scan_roots.id
+	  parent_id INTEGER NOT NULL, -- fs_folders.id của thư mục chứa mount point
+	  path TEXT NOT NULL,
+	  st_dev INTEGER,
+	  fs_type TEXT NULL,
+	  mount_source TEXT NULL,
+	  descended BOOLEAN NOT NULL DEFAULT 1, -- 0 = không duyệt vào (ONE_FILESYSTEM)
+	  seen_at DATETIME NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_scan_mounts_run ON scan_mounts (run_id, root_id);`,
+	`CREATE INDEX IF NOT EXISTS idx_scan_mounts_parent ON scan_mounts (parent_id) WHERE descended = 0;`,
+}
+
+// scanRootVolumeDDL: cột volume của scan_roots (trùng với scanRunDDL), dùng để nâng cấp DB cũ
+var scanRootVolumeDDL = []string{
+	"st_dev INTEGER NULL",
+	"mount_point TEXT NULL",
+	"fs_type TEXT NULL",
+	"mount_source TEXT NULL",
+}
+
+// specialDDL: bảng fs_special chứa symlink, socket, fifo, device... (entry không phải file thường/thư mục)
+var specialDDL = []string{
+	`CREATE TABLE IF NOT EXISTS fs_special (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  folder_id INTEGER NOT NULL,
+	  path TEXT NOT NULL,
+	  dir_path TEXT NOT NULL,
+	  filename TEXT NOT NULL,
+	  entry_type TEXT NOT NULL, -- symlink|socket|fifo|blockdev|chardev|other
+	  link_target TEXT NULL, -- symlink: nguyên văn readlink
+	  target_path TEXT NULL, -- symlink: đường dẫn thật sau khi resolve, NULL nếu link hỏng
+	  target_type TEXT NULL, -- symlink: file|dir|other
+	  target_ok BOOLEAN DEFAULT 0, -- symlink: target tồn tại
+	  outside_root BOOLEAN DEFAULT 0, -- symlink: target nằm ngoài root đang quét
+	  followed BOOLEAN DEFAULT 0, -- FOLLOW_SYMLINKS: đã duyệt thư mục target
+	  follow_note TEXT NULL, -- lý do không duyệt: inside_root|loop|visited
+	  loaithumuc TEXT,
+	  st_mtime DATETIME,
+	  st_uid INTEGER,
+	  st_gid INTEGER,
+	  owner TEXT,
+	  st_mode INTEGER,
+	  st_atime DATETIME,
+	  st_ctime DATETIME,
+	  st_ino INTEGER,
+	  st_dev INTEGER,
+	  st_nlink INTEGER,
+	  st_blocks INTEGER,
+
+	  FOREIGN KEY (folder_id) REFERENCES fs_folders (id)
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_special_path ON fs_special (path);`,
+	`CREATE INDEX IF NOT EXISTS idx_special_folder_id ON fs_special (folder_id);`,
+	`CREATE INDEX IF NOT EXISTS idx_special_dir_path ON fs_special (dir_path);`,
+	`CREATE INDEX IF NOT EXISTS idx_special_type ON fs_special (entry_type);`,
+	`CREATE INDEX IF NOT EXISTS idx_special_link_problem ON fs_special (entry_type) WHERE entry_type = 'symlink' AND (target_ok = 0 OR outside_root = 1);`,
+}
+
+// tagDDL: bảng fs_tags (tag của file theo luật [tags.<kind>]); trigger xoá tag khi file bị xoá khỏi fs_files
+// (prune khi quét incremental, deleter) vì scanner không bật foreign_keys
+var tagDDL = []string{
+	`CREATE TABLE IF NOT EXISTS fs_tags (
+	  file_id INTEGER NOT NULL, -- fs_files.id
+	  kind TEXT NOT NULL, -- department|project|cost_center... (tên section [tags.<kind>])
+	  tag TEXT NOT NULL,
+
+	  PRIMARY KEY (file_id, kind, tag)
+	) WITHOUT ROWID`,
+	`CREATE INDEX IF NOT EXISTS idx_tags_kind_tag ON fs_tags (kind, tag);`,
+	`CREATE TRIGGER IF NOT EXISTS trg_fs_files_delete_tags AFTER DELETE ON fs_files
+	 BEGIN
+	   DELETE FROM fs_tags WHERE file_id = OLD.id;
+	 END`,
+}
+
+// collisionDDL: nhóm cùng hash nhưng khác nội dung, phát hiện khi xác minh nhóm trùng (xem common_verify.go).
+// Các file cùng class có nội dung giống nhau; mỗi lần phát hiện ghi thêm dòng mới.
+var collisionDDL = []string{
+	`CREATE TABLE IF NOT EXISTS hash_collisions (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  detected_at DATETIME NOT NULL,
+	  hash_algo TEXT NULL,
+	  hash_value TEXT NOT NULL,
+	  verify_mode TEXT NOT NULL, -- bytes|hash
+	  class INTEGER NOT NULL, -- 0 = lớp được giữ làm nhóm trùng (nếu có từ 2 file)
+	  file_id INTEGER NOT NULL, -- fs_files.id
+	  path TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_hash_collisions_hash ON hash_collisions (hash_value);`,
+}
+
+// loadTagUsage (dùng cho reporter): số file/dung lượng theo từng tag trong fs_tags (hardlink chỉ tính dung lượng một lần)
+func loadTagUsage(ctx context.Context, db *sql.DB) ([]TagUsage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.kind, t.tag, COUNT(*), COALESCE(SUM(CASE WHEN f.hardlink_of IS NULL THEN f.size ELSE 0 END), 0)
+		FROM fs_tags t JOIN fs_files f ON f.id = t.file_id
+		GROUP BY t.kind, t.tag
+		ORDER BY t.kind, 4 DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query fs_tags: %w", err)
+	}
+	defer rows.Close()
+	var out []TagUsage
+	for rows.Next() {
+		var u TagUsage
+		if err := rows.Scan(&u.Kind, &u.Tag, &u.FileCount, &u.TotalSize); err != nil {
+			return nil, fmt.Errorf("scan fs_tags: %w", err)
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// loadLatestScanRun (dùng cho reporter): lần quét mới nhất trong DB, nil nếu DB không có scan_runs
+func loadLatestScanRun(ctx context.Context, db *sql.DB) (*ScanRunInfo, error) {
+	var ri ScanRunInfo
+	var finished sql.NullTime
+	var host, mode sql.NullString
+	var resumedFrom, totalFiles sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT id, started_at, finished_at, status, host, mode, resumed_from, total_files
+		FROM scan_runs ORDER BY id DESC LIMIT 1
+	`).Scan(&ri.ID, &ri.StartedAt, &finished, &ri.Status, &host, &mode, &resumedFrom, &totalFiles)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query scan_runs: %w", err)
+	}
+	ri.FinishedAt = finished.Time
+	ri.Host, ri.Mode = host.String, mode.String
+	ri.ResumedFrom, ri.TotalFiles = resumedFrom.Int64, totalFiles.Int64
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT root_path, COALESCE(loaithumuc, ''), status, COALESCE(file_count, 0)
+		FROM scan_roots WHERE run_id = ? ORDER BY id
+	`, ri.ID)
+	if err != nil {
+		return nil, fmt.Errorf("query scan_roots: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r ScanRootInfo
+		if err := rows.Scan(&r.Path, &r.Tag, &r.Status, &r.FileCount); err != nil {
+			return nil, fmt.Errorf("scan scan_roots: %w", err)
+		}
+		ri.Roots = append(ri.Roots, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM scan_errors WHERE run_id = ?`, ri.ID).Scan(&ri.Errors); err != nil {
+		return nil, fmt.Errorf("query scan_errors: %w", err)
+	}
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM fs_folders WHERE incomplete = 1`).Scan(&ri.IncompleteFolders); err != nil {
+		return nil, fmt.Errorf("count incomplete folders: %w", err)
+	}
+	return &ri, nil
+}
+
+// loadVolumeUsage (dùng cho reporter): số file/dung lượng theo st_dev, gắn mount point của root hoặc
+// mount point gặp khi duyệt; thêm các mount point bị bỏ qua (ONE_FILESYSTEM) của lần quét mới nhất
+func loadVolumeUsage(ctx context.Context, db *sql.DB) ([]VolumeUsage, error) {
+	type label struct {
+		mount, fsType, source string
+		roots                 []string
+	}
+	labels := map[int64]*label{}
+
+	// Mount point gặp khi duyệt: st_dev của chính thư mục mount
+	rows, err := db.QueryContext(ctx, `
+		SELECT st_dev, path, COALESCE(fs_type, ''), COALESCE(mount_source, '')
+		FROM scan_mounts WHERE descended = 1 AND st_dev IS NOT NULL ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query scan_mounts: %w", err)
+	}
+	for rows.Next() {
+		var dev int64
+		var l label
+		if err := rows.Scan(&dev, &l.mount, &l.fsType, &l.source); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan scan_mounts: %w", err)
+		}
+		labels[dev] = &l
+	}
+	rows.Close()
+
+	// Volume của các root (ưu tiên hơn mount point gặp khi duyệt)
+	rows, err = db.QueryContext(ctx, `
+		SELECT st_dev, root_path, COALESCE(mount_point, ''), COALESCE(fs_type, ''), COALESCE(mount_source, '')
+		FROM scan_roots
+		WHERE st_dev IS NOT NULL AND id IN (SELECT MAX(id) FROM scan_roots GROUP BY root_path)
+		ORDER BY root_path
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query scan_roots: %w", err)
+	}
+	for rows.Next() {
+		var dev int64
+		var root, mount, fsType, source string
+		if err := rows.Scan(&dev, &root, &mount, &fsType, &source); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan scan_roots: %w", err)
+		}
+		l := labels[dev]
+		if l == nil {
+			l = &label{}
+			labels[dev] = l
+		}
+		if len(l.roots) == 0 {
+			l.mount, l.fsType, l.source = mount, fsType, source
+		}
+		l.roots = append(l.roots, root)
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT COALESCE(st_dev, 0), COUNT(*), COALESCE(SUM(CASE WHEN hardlink_of IS NULL THEN size ELSE 0 END), 0)
+		FROM fs_files GROUP BY COALESCE(st_dev, 0) ORDER BY 3 DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query fs_files by st_dev: %w", err)
+	}
+	var out []VolumeUsage
+	for rows.Next() {
+		var v VolumeUsage
+		if err := rows.Scan(&v.Device, &v.FileCount, &v.TotalSize); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan fs_files by st_dev: %w", err)
+		}
+		if l := labels[v.Device]; l != nil {
+			v.MountPoint, v.FsType, v.Source = l.mount, l.fsType, l.source
+			v.Roots = strings.Join(l.roots, ", ")
+		}
+		out = append(out, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT DISTINCT COALESCE(st_dev, 0), path, COALESCE(fs_type, ''), COALESCE(mount_source, '')
+		FROM scan_mounts
+		WHERE descended = 0 AND run_id = (SELECT MAX(id) FROM scan_runs)
+		ORDER BY path
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query skipped mounts: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		v := VolumeUsage{Skipped: true}
+		if err := rows.Scan(&v.Device, &v.MountPoint, &v.FsType, &v.Source); err != nil {
+			return nil, fmt.Errorf("scan skipped mounts: %w", err)
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// Label: mount point kèm loại filesystem, "st_dev N" nếu không tra được mount (DB cũ, Windows)
+func (v VolumeUsage) Label() string {
+	label := v.MountPoint
+	if label == "" {
+		label = fmt.Sprintf("st_dev %d", v.Device)
+	}
+	if v.FsType != "" {
+		label += " (" + v.FsType + ")"
+	}
+	if v.Skipped {
+		label += " [not scanned: one-filesystem]"
+	}
+	return label
+}
+
+// loadLinkIssues (dùng cho reporter): symlink hỏng hoặc trỏ ra ngoài root, sắp theo path
+func loadLinkIssues(ctx context.Context, db *sql.DB) ([]LinkIssue, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT path, COALESCE(link_target, ''), COALESCE(target_path, ''), target_ok, outside_root, COALESCE(loaithumuc, '')
+		FROM fs_special
+		WHERE entry_type = 'symlink' AND (target_ok = 0 OR outside_root = 1)
+		ORDER BY path
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query fs_special: %w", err)
+	}
+	defer rows.Close()
+
+	var out []LinkIssue
+	for rows.Next() {
+		var li LinkIssue
+		var ok bool
+		if err := rows.Scan(&li.Path, &li.LinkTarget, &li.TargetPath, &ok, &li.Outside, &li.LoaiThuMuc); err != nil {
+			return nil, fmt.Errorf("scan fs_special: %w", err)
+		}
+		li.Broken = !ok
+		out = append(out, li)
+	}
+	return out, rows.Err()
+}
+
+// Problem: mô tả ngắn lỗi của link (broken, outside_root hoặc cả hai)
+func (li LinkIssue) Problem() string {
+	switch {
+	case li.Broken && li.Outside:
+		return "broken, outside_root"
+	case li.Broken:
+		return "broken"
+	default:
+		return "outside_root"
+	}
+}
+
+// Summary mô tả ngắn lần quét để in vào đầu báo cáo
+func (ri *ScanRunInfo) Summary() string {
+	if ri == nil {
+		return "unknown (database has no scan_runs record)"
+	}
+	finished := "not finished"
+	if !ri.FinishedAt.IsZero() {
+		finished = ri.FinishedAt.Format("2006-01-02 15:04:05")
+	}
+	s := fmt.Sprintf("run #%d (%s) on %s, started %s, finished %s, status %s, %d files",
+		ri.ID, ri.Mode, ri.Host, ri.StartedAt.Format("2006-01-02 15:04:05"), finished, ri.Status, ri.TotalFiles)
+	if ri.ResumedFrom > 0 {
+		s += fmt.Sprintf(", resumed from run #%d", ri.ResumedFrom)
+	}
+	if ri.Errors > 0 || ri.IncompleteFolders > 0 {
+		s += fmt.Sprintf(", %d scan errors, %d incomplete folders (data below them may be missing)", ri.Errors, ri.IncompleteFolders)
+	}
+	return s
+}
+
 // makeDBSQLite (dùng cho scanner)
 func makeDBSQLite(dbPath string) (*sql.DB, error) {
 	_ = os.Remove(dbPath) // Xóa file cũ nếu tồn tại
@@ -106,6 +687,47 @@ func makeDBSQLite(dbPath string) (*sql.DB, error) {
 	return db, nil
 }
 
+// cloneDBSQLite (dùng cho scanner incremental): copy DB lần trước sang dbPath
+// bằng VACUUM INTO rồi mở bản copy để cập nhật, DB cũ giữ nguyên làm snapshot.
+func cloneDBSQLite(srcPath, dbPath string) (*sql.DB, error) {
+	if _, err := os.Stat(srcPath); err != nil {
+		return nil, fmt.Errorf("previous db %s: %w", srcPath, err)
+	}
+	_ = os.Remove(dbPath)
+
+	src, err := openDBSQLite(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := src.Exec(`VACUUM INTO ?`, dbPath); err != nil {
+		src.Close()
+		return nil, fmt.Errorf("VACUUM INTO %s: %w", dbPath, err)
+	}
+	if err := src.Close(); err != nil {
+		return nil, err
+	}
+
+	db, err := openDBSQLite(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // Ghi đơn luồng trong Phase 1
+	return db, nil
+}
+
+// findLatestScanDB trả về file scan_*.db mới nhất trong outDir (tên file chứa timestamp).
+func findLatestScanDB(outDir string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(outDir, "scan_*.db"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no scan_*.db found in %s", outDir)
+	}
+	sort.Strings(matches)
+	return matches[len(matches)-1], nil
+}
+
 // openDBSQLite (dùng cho deleter)
 func openDBSQLite(dbPath string) (*sql.DB, error) {
 	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_synchronous=NORMAL", dbPath)
@@ -139,6 +761,17 @@ func initDDL(ctx context.Context, db *sql.DB) error {
 		  number_files INTEGER NOT NULL DEFAULT 0,
 		  subtree_size BIGINT NOT NULL DEFAULT 0,
 		  subtree_files INTEGER NOT NULL DEFAULT 0,
+		  incomplete BOOLEAN NOT NULL DEFAULT 0, -- liệt kê thư mục lỗi (xem scan_errors): dữ liệu bên trong có thể thiếu
+		  st_uid INTEGER,
+		  st_gid INTEGER,
+		  owner TEXT,
+		  st_mode INTEGER,
+		  st_atime DATETIME,
+		  st_ctime DATETIME,
+		  st_ino INTEGER,
+		  st_dev INTEGER,
+		  st_nlink INTEGER,
+		  st_blocks INTEGER,
 
 		  FOREIGN KEY (parent_id) REFERENCES fs_folders (id)
 		)`,
@@ -150,6 +783,7 @@ func initDDL(ctx context.Context, db *sql.DB) error {
 		`CREATE INDEX idx_folder_number_files ON fs_folders (number_files DESC);`,
 		`CREATE INDEX idx_folder_subtree_size ON fs_folders (subtree_size DESC);`,
 		`CREATE INDEX idx_folder_subtree_files ON fs_folders (subtree_files DESC);`,
+		`CREATE INDEX idx_folder_incomplete ON fs_folders (incomplete) WHERE incomplete = 1;`,
 
 		// Bảng Files
 		`CREATE TABLE fs_files (
@@ -162,9 +796,25 @@ func initDDL(ctx context.Context, db *sql.DB) error {
 		  size BIGINT NOT NULL,
 		  st_mtime DATETIME NOT NULL,
 		  hash_value TEXT NULL, -- Sẽ được tool 'hasher' cập nhật
+		  hash_algo TEXT NULL, -- thuật toán của hash_value (HASH_ALGO: sha256|blake2b|xxh64|md5)
+		  verified_at DATETIME NULL, -- lúc nội dung được xác minh giống các file cùng hash (VERIFY_DUPLICATES)
+		  dup_class INTEGER NULL, -- lớp nội dung khi xác minh tách nhóm cùng hash (hash_collisions.class); NULL = không tách
+		  partial_hash TEXT NULL, -- MD5 của mẫu đầu/giữa/cuối file (bước partial của Phase 2)
 		  is_duplicate BOOLEAN DEFAULT 0, -- Đánh dấu file là duplicate
 		  loaithumuc TEXT,
 		  thumuc TEXT,
+		  tag_set TEXT NULL, -- các tag trong fs_tags ("kind=tag;..."), để upsert nhận ra tag thay đổi
+		  hardlink_of INTEGER NULL, -- id của file chính cùng (st_dev, st_ino); NULL = file chính / không phải hardlink
+		  st_uid INTEGER,
+		  st_gid INTEGER,
+		  owner TEXT,
+		  st_mode INTEGER,
+		  st_atime DATETIME,
+		  st_ctime DATETIME,
+		  st_ino INTEGER,
+		  st_dev INTEGER,
+		  st_nlink INTEGER,
+		  st_blocks INTEGER,
 
 		  FOREIGN KEY (folder_id) REFERENCES fs_folders (id)
 		)`,
@@ -182,21 +832,21 @@ func initDDL(ctx context.Context, db *sql.DB) error {
 		`CREATE INDEX idx_file_dir_path ON fs_files (dir_path);`,
 		`CREATE INDEX idx_file_extension ON fs_files (fileExt) WHERE fileExt IS NOT NULL;`,
 		`CREATE INDEX idx_file_loaithumuc ON fs_files (loaithumuc);`,
+		`CREATE INDEX idx_file_owner ON fs_files (owner);`,
+		`CREATE INDEX idx_file_dev_ino ON fs_files (st_dev, st_ino) WHERE st_nlink > 1;`,
+		`CREATE INDEX idx_file_hardlink_of ON fs_files (hardlink_of) WHERE hardlink_of IS NOT NULL;`,
 
 		// Composite indexes for common query patterns
 		`CREATE INDEX idx_file_folder_loaithumuc_size ON fs_files (folder_id, loaithumuc, size DESC);`,
 		`CREATE INDEX idx_file_size_mtime ON fs_files (size DESC, st_mtime DESC);`,
 		`CREATE INDEX idx_file_hash_null_size ON fs_files (hash_value IS NULL, size DESC) WHERE hash_value IS NULL;`,
 		`CREATE INDEX idx_file_hash_duplicate ON fs_files (hash_value, is_duplicate) WHERE hash_value IS NOT NULL AND is_duplicate = 1;`,
+		`CREATE INDEX idx_file_algo_hash ON fs_files (hash_algo, hash_value) WHERE hash_value IS NOT NULL;`,
 
-		// Bảng Duplicate Groups (để query nhanh hơn)
-		`CREATE TABLE duplicate_groups (
-		  hash_value TEXT PRIMARY KEY,
-		  file_count INTEGER NOT NULL,
-		  total_size BIGINT NOT NULL,
-		  first_seen DATETIME NOT NULL,
-		  last_updated DATETIME NOT NULL
-		)`,
+		// Bảng Duplicate Groups (để query nhanh hơn). Mỗi thuật toán có độ dài digest khác nhau
+		// nên hash_value vẫn đủ làm khoá khi DB có hash của nhiều thuật toán; class tách các lớp nội dung
+		// khác nhau của cùng một hash (fs_files.dup_class).
+		duplicateGroupsDDL,
 		`CREATE INDEX idx_duplicate_groups_size ON duplicate_groups (total_size DESC);`,
 		`CREATE INDEX idx_duplicate_groups_count ON duplicate_groups (file_count DESC);`,
 
@@ -216,6 +866,10 @@ func initDDL(ctx context.Context, db *sql.DB) error {
 		`CREATE INDEX idx_duplicate_runs_status ON duplicate_runs (status);`,
 		`CREATE INDEX idx_duplicate_runs_started_at ON duplicate_runs (started_at DESC);`,
 	}
+	stmts = append(stmts, scanRunDDL...)
+	stmts = append(stmts, specialDDL...)
+	stmts = append(stmts, tagDDL...)
+	stmts = append(stmts, collisionDDL...)
 
 	for i, s := range stmts {
 		if _, err := db.ExecContext(ctx, s); err != nil {
@@ -224,3 +878,31 @@ func initDDL(ctx context.Context, db *sql.DB) error {
 	}
 	return nil
 }
+
+// parseSQLiteTime đọc giá trị DATETIME dạng TEXT (ví dụ kết quả của MIN(st_mtime))
+func parseSQLiteTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, fmt.Errorf("empty time")
+	}
+	layouts := []string{
+		time.RFC3339Nano,
+		time.RFC3339,
+		// SQLite TEXT với timezone offset (có dấu cách thay vì 'T')
+		"2006-01-02 15:04:05.999999999Z07:00",
+		"2006-01-02 15:04:05Z07:00",
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05.999999999Z07:00",
+		"2006-01-02T15:04:05Z07:00",
+	}
+	var lastErr error
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		} else {
+			lastErr = err
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse time %q: %w", s, lastErr)
+}
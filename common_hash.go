@@ -0,0 +1,1393 @@
+// common_hash.go
+//go:build scanner || hasher
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ScannerLogger provides structured logging capabilities
+type ScannerLogger struct {
+	logger *logrus.Logger
+}
+
+// NewScannerLogger creates a new structured logger
+func NewScannerLogger() *ScannerLogger {
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+	return &ScannerLogger{logger: logger}
+}
+
+// LogFileProcessed logs file processing metrics
+func (sl *ScannerLogger) LogFileProcessed(path string, size int64, duration time.Duration) {
+	sl.logger.WithFields(logrus.Fields{
+		"path":       path,
+		"size":       size,
+		"duration":   duration.Milliseconds(),
+		"throughput": float64(size) / duration.Seconds() / 1024 / 1024, // MB/s
+	}).Info("File processed")
+}
+
+// LogBatchOperation logs batch operation metrics
+func (sl *ScannerLogger) LogBatchOperation(operation string, count int, duration time.Duration, err error) {
+	fields := logrus.Fields{
+		"operation": operation,
+		"count":     count,
+		"duration":  duration.Milliseconds(),
+	}
+
+	if err != nil {
+		fields["error"] = err.Error()
+		sl.logger.WithFields(fields).Error("Batch operation failed")
+	} else {
+		sl.logger.WithFields(fields).Info("Batch operation completed")
+	}
+}
+
+// calculateHashWithContext calculates hash with context support (Optimized Version)
+// algo: thuật toán (xem newHasher); thr (có thể nil) giới hạn băng thông/IOPS và dừng giữa hai lần đọc khi hash bị tạm dừng
+func calculateHashWithContext(ctx context.Context, filePath, algo string, thr *ioThrottle) (sql.NullString, error) {
+	// Check if file exists and get size
+	f, err := os.Open(filePath)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return sql.NullString{}, err
+	}
+
+	fileSize := fi.Size()
+
+	// Skip empty files
+	if fileSize == 0 {
+		return sql.NullString{Valid: false}, nil
+	}
+
+	h, err := newHasher(algo)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+
+	// Dynamic buffer size based on file size for better performance
+	// Small files: smaller buffer, large files: larger buffer
+	var bufSize int
+	switch {
+	case fileSize < 1024*1024: // < 1MB
+		bufSize = 32 * 1024 // 32KB
+	case fileSize < 100*1024*1024: // < 100MB
+		bufSize = 128 * 1024 // 128KB
+	default: // >= 100MB
+		bufSize = 256 * 1024 // 256KB
+	}
+
+	buf := make([]byte, bufSize)
+	var totalRead int64 = 0
+	checkInterval := int64(1024 * 1024) // Check context every 1MB
+
+	// Read file in chunks with optimized context checking
+	for {
+		// Check context periodically (every 1MB) to avoid overhead
+		if totalRead > 0 && totalRead%checkInterval == 0 {
+			select {
+			case <-ctx.Done():
+				return sql.NullString{}, ctx.Err()
+			default:
+			}
+		}
+
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, writeErr := h.Write(buf[:n]); writeErr != nil {
+				return sql.NullString{}, writeErr
+			}
+			totalRead += int64(n)
+			if err := thr.wait(ctx, n); err != nil {
+				return sql.NullString{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sql.NullString{}, err
+		}
+
+		// Check context before next read (non-blocking)
+		select {
+		case <-ctx.Done():
+			return sql.NullString{}, ctx.Err()
+		default:
+		}
+	}
+
+	hashStr := hex.EncodeToString(h.Sum(nil))
+	return sql.NullString{String: hashStr, Valid: true}, nil
+}
+
+// Mẫu của partial hash: partialHashSample bytes ở đầu và cuối file, thêm một mẫu ở giữa với file
+// từ partialHashMiddleMin trở lên. Đổi các hằng này làm partial_hash cũ không còn so được với giá trị mới.
+const (
+	partialHashSample    = 64 * 1024
+	partialHashMiddleMin = 16 * 1024 * 1024
+)
+
+// hashProgressInterval: log tiến độ hash ít nhất mỗi khoảng này
+const hashProgressInterval = 30 * time.Second
+
+// hashCatalogFilter (HASH_MODE=catalog): điều kiện SQL trên alias (kèm tham số) chọn các file phải có hash dù
+// không nghi trùng — mọi file, hoặc file thuộc HASH_CATALOG_TAGS (loaithumuc) hay có phần mở rộng trong
+// HASH_CATALOG_EXTENSIONS (hợp của hai tập). "" = chế độ suspects. Điều kiện nằm trong from của hashStage nên
+// tham số phải đứng trước scopeArgs.
+func (c *Config) hashCatalogFilter(alias string) (string, []any) {
+	if c.HashMode != "catalog" {
+		return "", nil
+	}
+	var clauses []string
+	var args []any
+	if len(c.HashCatalogTags) > 0 {
+		clauses = append(clauses, fmt.Sprintf("%s.loaithumuc IN (%s)", alias, sqlPlaceholders(len(c.HashCatalogTags))))
+		for _, t := range c.HashCatalogTags {
+			args = append(args, t)
+		}
+	}
+	if len(c.HashCatalogExtensions) > 0 {
+		clauses = append(clauses, fmt.Sprintf("LOWER(%s.fileExt) IN (%s)", alias, sqlPlaceholders(len(c.HashCatalogExtensions))))
+		for _, e := range c.HashCatalogExtensions {
+			args = append(args, e)
+		}
+	}
+	if len(clauses) == 0 {
+		return "1", nil
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// sqlPlaceholders: n tham số SQL (?,?,...)
+func sqlPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// partialHashMinSize: file lớn hơn giá trị này mới qua bước partial (math.MaxInt64 = tắt PARTIAL_HASH).
+// Tối thiểu 3 mẫu: file nhỏ hơn thì đọc mẫu cũng gần bằng đọc cả file.
+func (c *Config) partialHashMinSize() int64 {
+	if !c.PartialHash {
+		return math.MaxInt64
+	}
+	return max(c.PartialHashMinSize, 3*partialHashSample)
+}
+
+// partialSampleOffsets: vị trí các mẫu của file size bytes (size > 3*partialHashSample)
+func partialSampleOffsets(size int64) []int64 {
+	offs := []int64{0}
+	if size >= partialHashMiddleMin {
+		offs = append(offs, size/2-partialHashSample/2)
+	}
+	return append(offs, size-partialHashSample)
+}
+
+// partialSampleBytes: số bytes bước partial đọc của file size bytes
+func partialSampleBytes(size int64) int64 {
+	return int64(len(partialSampleOffsets(size))) * partialHashSample
+}
+
+// calculatePartialHash: MD5 của các mẫu đầu/giữa/cuối file. Hai file cùng size khác partial hash chắc chắn
+// khác nội dung; trùng partial hash thì phải hash toàn bộ để khẳng định. Partial hash chỉ để lọc, không phụ
+// thuộc HASH_ALGO nên đổi thuật toán không làm mất partial_hash đã có.
+func calculatePartialHash(ctx context.Context, filePath string, size int64, thr *ioThrottle) (sql.NullString, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	if fi.Size() != size {
+		return sql.NullString{}, fmt.Errorf("size changed since scan (%d -> %d bytes)", size, fi.Size())
+	}
+
+	h := md5.New()
+	buf := make([]byte, partialHashSample)
+	for _, off := range partialSampleOffsets(size) {
+		if err := ctx.Err(); err != nil {
+			return sql.NullString{}, err
+		}
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return sql.NullString{}, err
+		}
+		h.Write(buf[:n])
+		if err := thr.wait(ctx, n); err != nil {
+			return sql.NullString{}, err
+		}
+	}
+	return sql.NullString{String: hex.EncodeToString(h.Sum(nil)), Valid: true}, nil
+}
+
+// =================================================================
+// PHASE 2: HASHING (DUPLICATES)
+// =================================================================
+
+// where trả về điều kiện SQL (bắt đầu bằng " AND ...") giới hạn file theo scope, alias là bảng fs_files
+func (sc HashScope) where(alias string) (string, []any) {
+	var clauses []string
+	var args []any
+	if len(sc.Tags) > 0 {
+		clauses = append(clauses, fmt.Sprintf("%s.loaithumuc IN (%s)", alias, strings.TrimRight(strings.Repeat("?,", len(sc.Tags)), ",")))
+		for _, t := range sc.Tags {
+			args = append(args, t)
+		}
+	}
+	if len(sc.PathPrefixes) > 0 {
+		ors := make([]string, 0, len(sc.PathPrefixes))
+		for _, p := range sc.PathPrefixes {
+			p = strings.TrimRight(p, "/")
+			ors = append(ors, fmt.Sprintf("%s.dir_path = ? OR %s.dir_path LIKE ?", alias, alias))
+			args = append(args, p, p+"/%")
+		}
+		clauses = append(clauses, "("+strings.Join(ors, " OR ")+")")
+	}
+	if sc.MinSize > 0 {
+		clauses = append(clauses, alias+".size >= ?")
+		args = append(args, sc.MinSize)
+	}
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(clauses, " AND "), args
+}
+
+// runHashingPhaseOptimized (Phase 2 - Optimized Version)
+// scope rỗng = toàn bộ DB; chỉ file có hash_value IS NULL được hash nên chạy lại sẽ tiếp tục từ chỗ dừng.
+// dyn (có thể nil) điều chỉnh số worker hash đang chạy theo tải của máy (ADAPTIVE) và giữ giới hạn I/O,
+// trạng thái tạm dừng của Phase 2 (HASH_BWLIMIT, HASH_IOPS, HASH_CONTROL_FILE).
+//
+// Hai bước (PARTIAL_HASH): bước "partial" hash vài mẫu của file lớn hơn PARTIAL_HASH_MIN_SIZE vào
+// partial_hash, bước "full" chỉ hash toàn bộ (HASH_ALGO) file nhỏ và file có partial_hash còn trùng với file khác cùng size.
+// Hash của thuật toán khác (DB cũ dùng MD5) được hash lại theo HASH_REHASH, xem invalidateStaleHashes.
+// File không đổi từ lần quét trước lấy hash từ cache (HASH_CACHE, xem common_hashcache.go) thay vì đọc lại.
+// HASH_MODE=catalog hash thêm mọi file (hoặc tập con theo tag/phần mở rộng) để có hash đầy đủ làm mốc toàn vẹn.
+func runHashingPhaseOptimized(ctx context.Context, db *sql.DB, cfg *Config, dyn *DynamicConfig, scope HashScope) {
+	logger := NewScannerLogger()
+	logger.logger.Info("-------------------------------------------------------")
+	logger.logger.Info("Phase 2: Hashing potential duplicates starting...")
+
+	// Nhóm size vẫn tính trên toàn DB: file trong scope có thể trùng với file ngoài scope
+	scopeSQL, scopeArgs := scope.where("f1")
+	if scopeSQL != "" {
+		logger.logger.WithFields(logrus.Fields{
+			"tags":         scope.Tags,
+			"pathPrefixes": scope.PathPrefixes,
+			"minSize":      scope.MinSize,
+		}).Info("Phase 2: Hashing restricted to scope")
+	}
+
+	// Configure optimized database connections
+	configureDB(db, "hash", cfg.MaxWorkers)
+
+	algo := hashAlgoName(cfg.HashAlgo)
+	partialMin := cfg.partialHashMinSize()
+
+	// HASH_MODE=catalog: file thuộc catalog được hash toàn bộ (bỏ qua bước partial) dù không trùng size với file nào
+	countFrom, fullFrom, partialFrom := suspectsSQL, fullSuspectsSQL(partialMin), partialSuspectsSQL(partialMin)
+	// stageArgs: tham số của các from trên (điều kiện catalog) rồi tới scopeArgs
+	catalog, catalogArgs := cfg.hashCatalogFilter("f1")
+	stageArgs := scopeArgs
+	if catalog != "" {
+		countFrom = catalogSQL(suspectsSQL, catalog)
+		fullFrom = catalogSQL(fullFrom, catalog)
+		partialFrom += " AND NOT " + catalog
+		stageArgs = append(append([]any{}, catalogArgs...), scopeArgs...)
+		logger.logger.WithFields(logrus.Fields{
+			"tags":       cfg.HashCatalogTags,
+			"extensions": cfg.HashCatalogExtensions,
+		}).Info("Phase 2: Catalog mode, hashing every file in the catalog")
+	}
+
+	if n, err := invalidateStaleHashes(ctx, db, algo, cfg.HashRehash, catalog, scopeSQL, stageArgs); err != nil {
+		if ctx.Err() != nil {
+			logger.logger.Warn("Phase 2: Interrupted before hashing started")
+			return
+		}
+		logger.logger.Fatalf("Phase 2: Failed to queue old-algorithm hashes for rehash: %v", err)
+	} else if n > 0 {
+		logger.logger.WithFields(logrus.Fields{
+			"files":  n,
+			"algo":   algo,
+			"rehash": cfg.HashRehash,
+		}).Info("Phase 2: Hashes of other algorithms queued for rehash")
+	}
+
+	// 1) Đếm tổng số file nghi trùng (để progress và để so với cách hash toàn bộ) nhưng KHÔNG load rows vào RAM.
+	// Nhóm size tính trên toàn bộ file (kể cả file đã có hash từ lần quét trước) để file mới
+	// trùng size với file cũ vẫn được hash ở chế độ incremental. Bản liên kết (hardlink_of) không
+	// được tính vào nhóm size và không bị hash lại: chúng nhận hash của file chính.
+	logger.logger.Info("Phase 2: Counting files needing hash (no in-memory buffering)...")
+	var totalSuspects, totalSuspectBytes int64
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(f1.size), 0)`+countFrom+scopeSQL, stageArgs...).Scan(&totalSuspects, &totalSuspectBytes)
+	if err != nil && ctx.Err() != nil {
+		logger.logger.Warn("Phase 2: Interrupted before hashing started")
+		return
+	}
+	if err != nil {
+		logger.logger.Fatalf("Phase 2: Failed to count files needing hash: %v", err)
+	}
+
+	if totalSuspects == 0 {
+		propagateHardlinkHashes(ctx, db, logger)
+		logger.logger.Info("Phase 2: No potential duplicates found. Hashing complete.")
+		if verifyModeName(cfg.VerifyDuplicates) != "off" {
+			// Nhóm trùng từ lần hash trước chưa được xác minh (mới bật VERIFY_DUPLICATES, lần trước bị ngắt)
+			markDuplicates(ctx, db, cfg, dyn.Throttle(), logger)
+		}
+		logger.logger.Info("-------------------------------------------------------")
+		return
+	}
+
+	fields := logrus.Fields{
+		"totalFiles":  totalSuspects,
+		"totalSize":   totalSuspectBytes,
+		"algo":        algo,
+		"partialHash": cfg.PartialHash,
+	}
+	if cfg.PartialHash {
+		fields["partialMinSize"] = partialMin
+	}
+	logger.logger.WithFields(fields).Info("Phase 2: Found files needing hashing")
+
+	// Cache hash của các lần quét trước (HASH_CACHE): file không đổi nhận hash mà không phải đọc lại
+	var cacheStats hashCacheStats
+	useCache := cfg.HashCache && cfg.HashCacheFile != ""
+	if useCache {
+		cacheStats = lookupHashCache(ctx, db, cfg, algo, countFrom, partialFrom, scopeSQL, stageArgs, logger)
+	}
+	// File nhận hash từ cache không được đọc, không tính vào mốc so sánh của bước partial
+	toHash, toHashBytes := totalSuspects, totalSuspectBytes
+	if cacheStats.Hits > 0 {
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(f1.size), 0)`+countFrom+scopeSQL, stageArgs...).Scan(&toHash, &toHashBytes)
+		if err != nil && ctx.Err() == nil {
+			logger.logger.WithError(err).Warn("Phase 2: Failed to count files left after hash cache lookup")
+		}
+	}
+
+	var partial, full hashStageStats
+	if cfg.PartialHash {
+		partial = runHashStage(ctx, db, cfg, dyn, hashStage{
+			name:   "partial",
+			column: "partial_hash",
+			from:   partialFrom,
+			hash: func(ctx context.Context, job FileToHash, thr *ioThrottle) (sql.NullString, int64, error) {
+				h, err := calculatePartialHash(ctx, job.Path, job.Size, thr)
+				return h, partialSampleBytes(job.Size), err
+			},
+		}, scopeSQL, stageArgs, logger)
+	}
+	if ctx.Err() == nil {
+		full = runHashStage(ctx, db, cfg, dyn, hashStage{
+			name:   "full",
+			column: "hash_value",
+			algo:   algo,
+			from:   fullFrom,
+			hash: func(ctx context.Context, job FileToHash, thr *ioThrottle) (sql.NullString, int64, error) {
+				h, err := calculateHashWithContext(ctx, job.Path, algo, thr)
+				return h, job.Size, err
+			},
+		}, scopeSQL, stageArgs, logger)
+	}
+
+	// So với cách cũ (đọc toàn bộ mọi file nghi trùng còn phải hash sau cache): bytes bước partial giúp không phải đọc.
+	// Bytes lấy từ cache được báo riêng (cacheHitBytes).
+	if cfg.PartialHash && ctx.Err() == nil {
+		read := partial.BytesRead + full.BytesRead
+		saved := toHashBytes - read
+		logger.logger.WithFields(logrus.Fields{
+			"suspectFiles":     toHash,
+			"suspectBytes":     toHashBytes,
+			"cacheHitFiles":    totalSuspects - toHash,
+			"cacheHitBytes":    totalSuspectBytes - toHashBytes,
+			"partialFiles":     partial.Hashed,
+			"partialBytesRead": partial.BytesRead,
+			"fullFiles":        full.Hashed,
+			"fullBytesRead":    full.BytesRead,
+			"skippedFiles":     max(toHash-full.Planned, 0),
+			"savedBytes":       saved,
+			"savedPercent":     fmt.Sprintf("%.1f%%", float64(saved)*100/float64(max(toHashBytes, 1))),
+		}).Info("Phase 2: Partial hash savings")
+	}
+
+	// Khi bị huỷ (SIGINT/SIGTERM) các hash đã tính xong đã được commit trong runHashStage
+	propagateHardlinkHashes(context.WithoutCancel(ctx), db, logger)
+
+	if useCache {
+		storeHashCache(context.WithoutCancel(ctx), db, cfg, cacheStats, full.Planned, scopeSQL, scopeArgs, logger)
+	}
+
+	if ctx.Err() != nil {
+		logger.logger.WithField("totalUpdated", partial.Updated+full.Updated).Warn("Phase 2: Interrupted, hashed files committed; rerun to hash the rest")
+		return
+	}
+
+	// 6. Đánh dấu duplicate files ngay sau khi hash xong
+	markDuplicates(ctx, db, cfg, dyn.Throttle(), logger)
+
+	logger.logger.Info("-------------------------------------------------------")
+}
+
+// lookupHashCache điền hash từ cache (HASH_CACHE) cho file nghi trùng trước khi các bước hash chọn file cần đọc.
+// fullFrom, partialFrom: tập file của bước full/partial (from của hashStage).
+// Kết nối đã ATTACH được trả về pool ngay sau đó; storeHashCache mở lại khi ghi cache.
+func lookupHashCache(ctx context.Context, db *sql.DB, cfg *Config, algo, fullFrom, partialFrom, scopeSQL string, scopeArgs []any, logger *ScannerLogger) hashCacheStats {
+	var stats hashCacheStats
+	cacheLog := logger.logger.WithField("cacheFile", cfg.HashCacheFile)
+	cache, err := openHashCache(ctx, db, cfg.HashCacheFile)
+	if err != nil {
+		cacheLog.WithError(err).Warn("Phase 2: Hash cache unavailable, hashing without it")
+		return stats
+	}
+	defer cache.Close()
+
+	if !cfg.PartialHash {
+		partialFrom = ""
+	}
+	stats.Hits, stats.PartialHits, err = cache.lookup(ctx, algo, fullFrom, partialFrom, scopeSQL, scopeArgs)
+	if err != nil && ctx.Err() == nil {
+		cacheLog.WithError(err).Warn("Phase 2: Hash cache lookup failed")
+	}
+	cacheLog.WithFields(logrus.Fields{
+		"hits":        stats.Hits,
+		"partialHits": stats.PartialHits,
+	}).Info("Phase 2: Hashes taken from cache")
+	return stats
+}
+
+// storeHashCache ghi hash của DB quét vào cache (HASH_CACHE), xoá row quá HASH_CACHE_MAX_AGE
+// và log số file nghi trùng lấy hash từ cache (hits) / vẫn phải hash toàn bộ (misses)
+func storeHashCache(ctx context.Context, db *sql.DB, cfg *Config, stats hashCacheStats, misses int64, scopeSQL string, scopeArgs []any, logger *ScannerLogger) {
+	cacheLog := logger.logger.WithField("cacheFile", cfg.HashCacheFile)
+	cache, err := openHashCache(ctx, db, cfg.HashCacheFile)
+	if err != nil {
+		cacheLog.WithError(err).Warn("Phase 2: Hash cache unavailable, new hashes not cached")
+		return
+	}
+	defer cache.Close()
+
+	now := time.Now()
+	if stats.Stored, err = cache.store(ctx, now, scopeSQL, scopeArgs); err != nil {
+		cacheLog.WithError(err).Warn("Phase 2: Failed to store hashes in cache")
+	}
+	if stats.Pruned, err = cache.prune(ctx, now, cfg.HashCacheMaxAge); err != nil {
+		cacheLog.WithError(err).Warn("Phase 2: Failed to prune hash cache")
+	}
+	cacheLog.WithFields(logrus.Fields{
+		"hits":        stats.Hits,
+		"misses":      misses,
+		"hitRate":     fmt.Sprintf("%.1f%%", float64(stats.Hits)*100/float64(max(stats.Hits+misses, 1))),
+		"partialHits": stats.PartialHits,
+		"stored":      stats.Stored,
+		"pruned":      stats.Pruned,
+	}).Info("Phase 2: Hash cache summary")
+}
+
+// markDuplicates đánh dấu (và xác minh nếu bật VERIFY_DUPLICATES, đọc file qua thr) các nhóm trùng
+func markDuplicates(ctx context.Context, db *sql.DB, cfg *Config, thr *ioThrottle, logger *ScannerLogger) {
+	logger.logger.Info("Phase 2: Marking duplicate files...")
+	duplicateStats := markDuplicateFiles(ctx, db, verifyModeName(cfg.VerifyDuplicates), thr.wait, logger)
+	logger.logger.WithFields(logrus.Fields{
+		"duplicateGroups": duplicateStats.Groups,
+		"duplicateFiles":  duplicateStats.Files,
+		"duplicateSize":   duplicateStats.TotalSize,
+	}).Info("Phase 2: Duplicate marking complete")
+}
+
+// hashStage: một bước của Phase 2 — tập file cần xử lý (from: FROM ... WHERE ..., alias f1),
+// hàm hash (trả về cả số bytes đã đọc) và cột lưu kết quả
+type hashStage struct {
+	name   string // partial | full
+	column string // partial_hash | hash_value
+	algo   string // ghi vào hash_algo cùng column ("" = không ghi)
+	from   string
+	hash   func(ctx context.Context, job FileToHash, thr *ioThrottle) (sql.NullString, int64, error)
+}
+
+// hashStageStats: kết quả một bước
+type hashStageStats struct {
+	Planned   int64 // số file cần xử lý lúc bắt đầu
+	Hashed    int64
+	Errors    int64
+	BytesRead int64
+	Updated   int64
+}
+
+// runHashStage chạy một bước: chia file theo thiết bị, hash song song (gate ADAPTIVE, giới hạn I/O, tạm dừng)
+// và commit kết quả theo batch. Khi bị huỷ vẫn commit các kết quả đã tính xong.
+func runHashStage(ctx context.Context, db *sql.DB, cfg *Config, dyn *DynamicConfig, stage hashStage, scopeSQL string, scopeArgs []any, logger *ScannerLogger) hashStageStats {
+	var stats hashStageStats
+	stageLog := logger.logger.WithField("stage", stage.name)
+
+	devices, err := hashDevicePlan(ctx, db, cfg, stage.from, scopeSQL, scopeArgs)
+	if err != nil && ctx.Err() != nil {
+		stageLog.Warn("Phase 2: Interrupted before hashing started")
+		return stats
+	}
+	if err != nil {
+		stageLog.Fatalf("Phase 2: Failed to count files needing hash: %v", err)
+	}
+	var totalSuspects, totalBytes int64
+	for _, d := range devices {
+		totalSuspects += d.Files
+		totalBytes += d.Size
+	}
+	stats.Planned = totalSuspects
+	stageLog.WithFields(logrus.Fields{
+		"files":   totalSuspects,
+		"size":    totalBytes,
+		"devices": len(devices),
+	}).Info("Phase 2: Hash stage starting")
+	if totalSuspects == 0 {
+		return stats
+	}
+
+	// 2. Setup worker pool and channels
+	results := make(chan HashResult, cfg.MaxWorkers*2)
+
+	// 3. Start hash workers (simplified, efficient version) with detailed logging
+	// ADAPTIVE: khởi động sẵn tới trần ADAPTIVE_MAX_WORKERS, gate cho MAX_WORKERS worker chạy lúc đầu.
+	// Không ADAPTIVE: gate cố định MAX_WORKERS, tổng số worker đang đọc của mọi thiết bị không vượt quá nó.
+	workers := cfg.MaxWorkers
+	maxWorkers := cfg.AdaptiveMaxWorkers
+	if maxWorkers <= 0 {
+		maxWorkers = 2 * cfg.MaxWorkers
+	}
+	gate := dyn.NewGate(ctx, "hash", cfg.MaxWorkers, maxWorkers)
+	defer dyn.Release(gate)
+	if gate != nil {
+		workers = max(maxWorkers, cfg.MaxWorkers)
+	} else {
+		gate = newWorkerGate(ctx, workers)
+	}
+	thr := dyn.Throttle()
+
+	// Mỗi thiết bị giữ một truy vấn đang stream: đủ kết nối cho chúng và cho commit, nếu không commit
+	// chờ kết nối trong khi producer chờ worker, worker chờ commit
+	db.SetMaxOpenConns(workers + len(devices) + 2)
+
+	var wgWorkers sync.WaitGroup
+	var hashStats struct {
+		mu           sync.Mutex
+		totalHashed  int64
+		successCount int64
+		errorCount   int64
+		totalSize    int64
+		sizeDone     int64 // tổng size các file đã xử lý (kể cả lỗi), để ước lượng thời gian còn lại theo dung lượng
+		startTime    time.Time
+	}
+	hashStats.startTime = time.Now()
+
+	hashWorker := func(workerID int, jobs <-chan FileToHash) {
+		defer wgWorkers.Done()
+		for job := range jobs {
+			if !gate.enter() {
+				continue // bị huỷ: bỏ qua, file vẫn chưa có kết quả
+			}
+			hashStartTime := time.Now()
+			hash, n, err := stage.hash(ctx, job, thr)
+			hashDuration := time.Since(hashStartTime)
+			gate.leave()
+
+			hashStats.mu.Lock()
+			hashStats.totalHashed++
+			hashStats.sizeDone += job.Size
+			if err == nil && hash.Valid {
+				hashStats.successCount++
+				hashStats.totalSize += n
+			} else {
+				hashStats.errorCount++
+				if err != nil {
+					stageLog.WithFields(logrus.Fields{
+						"workerID": workerID,
+						"fileID":   job.ID,
+						"path":     job.Path,
+						"error":    err.Error(),
+						"duration": hashDuration.Milliseconds(),
+					}).Debug("Hash calculation failed")
+				}
+			}
+			hashStats.mu.Unlock()
+
+			results <- HashResult{ID: job.ID, Hash: hash, Err: err}
+		}
+	}
+
+	// 4. Mỗi thiết bị một hàng đợi riêng: producer stream file của thiết bị theo HASH_ORDER,
+	// tối đa dev.Workers worker đọc song song trên thiết bị đó
+	stageLog.Info("Phase 2: Streaming files needing hash to workers...")
+	workerID := 0
+	for _, dev := range devices {
+		n := workers
+		if dev.Workers > 0 {
+			n = min(dev.Workers, workers)
+		}
+		stageLog.WithFields(logrus.Fields{
+			"device":  dev.Dev,
+			"files":   dev.Files,
+			"size":    dev.Size,
+			"tags":    dev.Tags,
+			"workers": n,
+			"order":   hashOrderName(cfg.HashOrder),
+		}).Info("Phase 2: Device hash queue")
+
+		jobs := make(chan FileToHash, n*2)
+		for w := 0; w < n; w++ {
+			wgWorkers.Add(1)
+			go hashWorker(workerID, jobs)
+			workerID++
+		}
+		go streamHashJobs(ctx, db, dev.Dev, cfg.HashOrder, stage.from, scopeSQL, scopeArgs, jobs, logger)
+	}
+
+	// 5. Collect results and update database with MULTIPLE smaller transactions
+	stageLog.Info("Phase 2: Processing hash results and updating database...")
+
+	const commitBatchSize = 1000 // Commit every 1000 updates
+	var batch []HashResult
+	var processedCount int64 = 0
+
+	// Start a goroutine to close results channel when all workers are done
+	go func() {
+		wgWorkers.Wait()
+		close(results)
+	}()
+
+	// Khi bị huỷ (SIGINT/SIGTERM) vẫn drain results và commit các hash đã tính xong
+	commitCtx := context.WithoutCancel(ctx)
+
+	// Khi tạm dừng, commit ngay các hash đã tính xong thay vì chờ đủ commitBatchSize
+	pauseCheck := time.NewTicker(controlPollInterval)
+	defer pauseCheck.Stop()
+	pausedLogged := false
+	lastProgress := time.Now()
+
+	// Process results with periodic commits
+collect:
+	for {
+		var res HashResult
+		select {
+		case r, ok := <-results:
+			if !ok {
+				break collect
+			}
+			res = r
+		case <-pauseCheck.C:
+			if !thr.Paused() {
+				pausedLogged = false
+				continue
+			}
+			if len(batch) > 0 {
+				stats.Updated += int64(commitHashBatch(commitCtx, db, stage.column, stage.algo, batch, logger))
+				batch = batch[:0]
+			}
+			if !pausedLogged {
+				pausedLogged = true
+				stageLog.WithFields(logrus.Fields{
+					"processed": processedCount,
+					"total":     totalSuspects,
+					"updated":   stats.Updated,
+				}).Info("Phase 2: Paused, hashed files committed")
+			}
+			continue
+		}
+		processedCount++
+
+		if res.Err == nil && res.Hash.Valid {
+			batch = append(batch, res)
+		} else if res.Err != nil {
+			stageLog.WithFields(logrus.Fields{
+				"id":    res.ID,
+				"error": res.Err.Error(),
+			}).Debug("Hash calculation failed")
+		}
+
+		// Commit batch when it reaches commit size
+		if len(batch) >= commitBatchSize {
+			stats.Updated += int64(commitHashBatch(commitCtx, db, stage.column, stage.algo, batch, logger))
+			batch = batch[:0]
+		}
+
+		// Progress logging every 1000 files with detailed stats
+		// (hoặc sau hashProgressInterval: file lớn, ví dụ HASH_MODE=catalog, có thể mất lâu mới đủ 1000 file)
+		if processedCount%1000 == 0 || processedCount == totalSuspects || time.Since(lastProgress) >= hashProgressInterval {
+			lastProgress = time.Now()
+			hashStats.mu.Lock()
+			elapsed := time.Since(hashStats.startTime)
+			avgSpeed := float64(hashStats.totalHashed) / elapsed.Seconds()
+			successRate := float64(hashStats.successCount) / float64(hashStats.totalHashed) * 100
+			currentSuccess := hashStats.successCount
+			currentErrors := hashStats.errorCount
+			sizeDone := hashStats.sizeDone
+			hashStats.mu.Unlock()
+			// ETA theo dung lượng: với file lớn nhỏ lẫn lộn chính xác hơn theo số file
+			var eta time.Duration
+			if sizeDone > 0 {
+				eta = time.Duration(float64(elapsed) * float64(totalBytes-sizeDone) / float64(sizeDone)).Round(time.Second)
+			}
+
+			stageLog.WithFields(logrus.Fields{
+				"processed":    processedCount,
+				"total":        totalSuspects,
+				"updated":      stats.Updated,
+				"progress":     fmt.Sprintf("%.1f%%", float64(processedCount)*100/float64(totalSuspects)),
+				"hashed":       currentSuccess,
+				"errors":       currentErrors,
+				"successRate":  fmt.Sprintf("%.2f%%", successRate),
+				"avgSpeed":     fmt.Sprintf("%.2f files/sec", avgSpeed),
+				"elapsed":      elapsed.Seconds(),
+				"remainingEst": fmt.Sprintf("%.0f sec", float64(totalSuspects-processedCount)/avgSpeed),
+				"sizeProgress": fmt.Sprintf("%.1f%%", float64(sizeDone)*100/float64(max(totalBytes, 1))),
+				"eta":          eta.String(),
+			}).Info("Phase 2: Hashing progress")
+		}
+	}
+
+	// Commit remaining batch
+	if len(batch) > 0 {
+		stats.Updated += int64(commitHashBatch(commitCtx, db, stage.column, stage.algo, batch, logger))
+	}
+
+	// Final hash statistics
+	hashStats.mu.Lock()
+	totalElapsed := time.Since(hashStats.startTime)
+	finalSuccessRate := float64(hashStats.successCount) / float64(hashStats.totalHashed) * 100
+	finalAvgSpeed := float64(hashStats.totalHashed) / totalElapsed.Seconds()
+	stats.Hashed, stats.Errors, stats.BytesRead = hashStats.successCount, hashStats.errorCount, hashStats.totalSize
+	hashStats.mu.Unlock()
+
+	stageLog.WithFields(logrus.Fields{
+		"totalProcessed": processedCount,
+		"totalUpdated":   stats.Updated,
+		"totalHashed":    hashStats.totalHashed,
+		"successCount":   hashStats.successCount,
+		"errorCount":     hashStats.errorCount,
+		"bytesRead":      stats.BytesRead,
+		"successRate":    fmt.Sprintf("%.2f%%", finalSuccessRate),
+		"avgSpeed":       fmt.Sprintf("%.2f files/sec", finalAvgSpeed),
+		"totalDuration":  totalElapsed.Seconds(),
+	}).Info("Phase 2: Hashing complete")
+
+	return stats
+}
+
+// hashDevice: các file cần hash trên một thiết bị (st_dev; 0 = không rõ, ví dụ DB cũ/Windows)
+type hashDevice struct {
+	Dev     int64
+	Files   int64
+	Size    int64
+	Tags    []string // loaithumuc của các root có file trên thiết bị
+	Workers int      // số worker đọc cùng lúc ([hash_devices]/HASH_DEVICE_WORKERS; 0 = không giới hạn riêng)
+}
+
+// suspectsSQL: file cần hash (size > 0, trùng size với file khác, chưa có hash, không phải bản liên kết)
+const suspectsSQL = `
+	FROM fs_files f1
+	INNER JOIN (
+		SELECT size
+		FROM fs_files
+		WHERE size > 0 AND hardlink_of IS NULL
+		GROUP BY size
+		HAVING COUNT(*) > 1
+	) f2 ON f1.size = f2.size
+	WHERE f1.size > 0 AND f1.hash_value IS NULL AND f1.hardlink_of IS NULL`
+
+// partialSuspectsSQL: file cần partial hash — lớn hơn minSize, chưa có partial_hash, thuộc nhóm size còn file
+// chưa hash. Gồm cả file đã có hash_value từ lần quét trước để file mới so được partial_hash với chúng.
+func partialSuspectsSQL(minSize int64) string {
+	return fmt.Sprintf(`
+	FROM fs_files f1
+	INNER JOIN (
+		SELECT size
+		FROM fs_files
+		WHERE size > %d AND hardlink_of IS NULL
+		GROUP BY size
+		HAVING COUNT(*) > 1 AND SUM(hash_value IS NULL) > 0
+	) f2 ON f1.size = f2.size
+	WHERE f1.partial_hash IS NULL AND f1.hardlink_of IS NULL`, minSize)
+}
+
+// fullSuspectsSQL: file cần hash toàn bộ — file nghi trùng không lớn hơn minSize, hoặc có partial_hash trùng
+// (hay chưa biết partial_hash) với một file khác cùng size
+func fullSuspectsSQL(minSize int64) string {
+	return suspectsSQL + fmt.Sprintf(`
+	  AND (f1.size <= %d OR f1.partial_hash IS NULL OR EXISTS (
+		SELECT 1 FROM fs_files g
+		WHERE g.size = f1.size AND g.id != f1.id AND g.hardlink_of IS NULL
+		  AND (g.partial_hash IS NULL OR g.partial_hash = f1.partial_hash)
+	  ))`, minSize)
+}
+
+// catalogSQL (HASH_MODE=catalog): file chưa có hash thuộc catalog (filter trên alias f1) cùng các file của base
+// (file nghi trùng nằm ngoài catalog vẫn được hash như chế độ suspects)
+func catalogSQL(base, filter string) string {
+	return `
+	FROM fs_files f1
+	WHERE f1.size > 0 AND f1.hash_value IS NULL AND f1.hardlink_of IS NULL
+	  AND (` + filter + ` OR f1.id IN (SELECT f1.id` + base + `))`
+}
+
+// invalidateStaleHashes xoá hash_value của file (trong scope) có hash_algo khác algo để bước full hash lại
+// chúng bằng algo; trả về số file. Chỉ file nằm trong nhóm size mới cần hash để so:
+//   - lazy: file cùng size với một file chưa có hash (file mới/đã đổi) — DB cũ được chuyển dần, mỗi lần quét
+//     chỉ hash lại đúng những file cần so với file mới;
+//   - all: mọi file thuộc nhóm size có từ hai file trở lên — chuyển hết trong lần chạy này.
+//
+// File còn lại giữ hash cũ và chỉ được so với file cùng thuật toán (xem markDuplicateFiles).
+// catalog (hashCatalogFilter, "" = không dùng): file thuộc catalog luôn được hash lại bằng algo, bất kể mode;
+// tham số của catalog đứng đầu scopeArgs.
+func invalidateStaleHashes(ctx context.Context, db *sql.DB, algo, mode, catalog, scopeSQL string, scopeArgs []any) (int64, error) {
+	group := `SELECT size FROM fs_files WHERE size > 0 AND hardlink_of IS NULL AND hash_value IS NULL`
+	if mode == "all" {
+		group = `SELECT size FROM fs_files WHERE size > 0 AND hardlink_of IS NULL GROUP BY size HAVING COUNT(*) > 1`
+	}
+	cond := `f1.size IN (` + group + `)`
+	if catalog != "" {
+		cond = `(` + cond + ` OR ` + catalog + `)`
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE fs_files AS f1
+		SET hash_value = NULL, hash_algo = NULL, verified_at = NULL, dup_class = NULL
+		WHERE f1.hash_value IS NOT NULL AND f1.hash_algo IS NOT ? AND f1.hardlink_of IS NULL
+		  AND `+cond+scopeSQL, append([]any{algo}, scopeArgs...)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// hashDevicePlan đếm file của from (FROM ... WHERE ..., alias f1) theo thiết bị (nhiều file nhất trước). Giới hạn worker của thiết bị là
+// giá trị nhỏ nhất trong [hash_devices] của các root nằm trên nó (root chung một volume chia nhau một giới hạn).
+func hashDevicePlan(ctx context.Context, db *sql.DB, cfg *Config, from, scopeSQL string, scopeArgs []any) ([]hashDevice, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(f1.st_dev, 0), COALESCE(f1.loaithumuc, ''), COUNT(*), SUM(f1.size)`+from+scopeSQL+`
+		GROUP BY 1, 2`, scopeArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byDev := map[int64]*hashDevice{}
+	var devices []*hashDevice
+	for rows.Next() {
+		var dev, files, size int64
+		var tag string
+		if err := rows.Scan(&dev, &tag, &files, &size); err != nil {
+			return nil, err
+		}
+		d := byDev[dev]
+		if d == nil {
+			d = &hashDevice{Dev: dev}
+			byDev[dev] = d
+			devices = append(devices, d)
+		}
+		d.Files += files
+		d.Size += size
+		d.Tags = append(d.Tags, tag)
+		if n := cfg.hashDeviceWorkers(tag); n > 0 && (d.Workers == 0 || n < d.Workers) {
+			d.Workers = n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Files > devices[j].Files })
+	out := make([]hashDevice, len(devices))
+	for i, d := range devices {
+		out[i] = *d
+	}
+	return out, nil
+}
+
+// hashOrderName: thứ tự đọc trong một thiết bị (HASH_ORDER; rỗng = inode, cho Config dựng tay)
+func hashOrderName(order string) string {
+	if order == "path" {
+		return "path"
+	}
+	return "inode"
+}
+
+// streamHashJobs đưa file của from trên thiết bị dev vào jobs (backpressure qua channel, tránh giữ
+// 4-5 triệu rows trong RAM) theo inode hoặc đường dẫn để đọc gần như tuần tự trên đĩa, rồi đóng jobs
+func streamHashJobs(ctx context.Context, db *sql.DB, dev int64, order, from, scopeSQL string, scopeArgs []any, jobs chan<- FileToHash, logger *ScannerLogger) {
+	defer close(jobs)
+
+	orderBy := "f1.st_ino, f1.path" // st_ino NULL/0 (Windows, DB cũ): theo đường dẫn
+	if hashOrderName(order) == "path" {
+		orderBy = "f1.dir_path, f1.filename"
+	}
+	// from có thể chứa tham số (catalog) nằm đầu scopeArgs: điều kiện thiết bị đặt sau scopeSQL
+	args := append(append([]any{}, scopeArgs...), dev)
+	rows, err := db.QueryContext(ctx, `
+		SELECT f1.id, f1.path, f1.size`+from+scopeSQL+`
+		  AND COALESCE(f1.st_dev, 0) = ?
+		ORDER BY `+orderBy, args...)
+	if err != nil {
+		logger.logger.WithError(err).WithField("device", dev).Error("Phase 2: Failed to query files needing hash")
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var job FileToHash
+		if err := rows.Scan(&job.ID, &job.Path, &job.Size); err != nil {
+			logger.logger.WithError(err).Warn("Phase 2: Failed to scan file row")
+			continue
+		}
+
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.logger.WithError(err).WithField("device", dev).Warn("Phase 2: Row iteration error while streaming hash jobs")
+	}
+}
+
+// propagateHardlinkHashes chép hash của file chính sang các bản liên kết (cùng inode nên cùng nội dung)
+func propagateHardlinkHashes(ctx context.Context, db *sql.DB, logger *ScannerLogger) {
+	res, err := db.ExecContext(ctx, `
+		UPDATE fs_files
+		SET hash_value = p.hash_value, hash_algo = p.hash_algo
+		FROM fs_files AS p
+		WHERE fs_files.hardlink_of = p.id
+		  AND p.hash_value IS NOT NULL
+		  AND (fs_files.hash_value IS NOT p.hash_value OR fs_files.hash_algo IS NOT p.hash_algo)
+	`)
+	if err != nil {
+		logger.logger.WithError(err).Warn("Phase 2: Failed to copy hashes to hardlinked files")
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		logger.logger.WithField("linkedFiles", n).Info("Phase 2: Copied hashes to hardlinked files")
+	}
+}
+
+// DuplicateStats holds statistics about duplicate files
+type DuplicateStats struct {
+	Groups    int64
+	Files     int64
+	TotalSize int64
+}
+
+// duplicateGroup: một nhóm cùng (hash_algo, hash_value) có từ 2 file
+type duplicateGroup struct {
+	hashAlgo  sql.NullString
+	hashValue string
+	fileCount int
+	totalSize int64
+	firstSeen time.Time
+}
+
+// markDuplicateFiles marks files as duplicates based on hash_value.
+// Chỉ file cùng hash_algo mới thuộc một nhóm (DB đang chuyển thuật toán có cả hash cũ lẫn mới).
+// Bản liên kết (hardlink_of IS NOT NULL) không phải bản trùng: xoá chúng không giải phóng dung lượng.
+// verify (bytes | hash, xem common_verify.go): xác minh nội dung từng nhóm trước khi đánh dấu; off = chỉ dựa trên hash.
+func markDuplicateFiles(ctx context.Context, db *sql.DB, verify string, wait func(context.Context, int) error, logger *ScannerLogger) DuplicateStats {
+	startTime := time.Now()
+	logger.logger.Info("Phase 2: Starting duplicate detection and marking...")
+
+	// Xoá đánh dấu cũ (DB incremental mang theo kết quả của lần quét trước)
+	if _, err := db.ExecContext(ctx, `UPDATE fs_files SET is_duplicate = 0 WHERE is_duplicate = 1`); err != nil {
+		logger.logger.WithError(err).Error("Failed to reset previous duplicate markings")
+		return DuplicateStats{}
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM duplicate_groups`); err != nil {
+		logger.logger.WithError(err).Error("Failed to clear previous duplicate groups")
+		return DuplicateStats{}
+	}
+
+	// Query để tìm các hash có >= 2 files (duplicate groups)
+	rows, err := db.QueryContext(ctx, `
+		SELECT hash_algo, hash_value, COUNT(*) as file_count, SUM(size) as total_size, MIN(st_mtime) as first_seen
+		FROM fs_files
+		WHERE hash_value IS NOT NULL AND hash_value != '' AND hardlink_of IS NULL
+		GROUP BY hash_algo, hash_value
+		HAVING COUNT(*) > 1
+	`)
+	if err != nil {
+		logger.logger.WithError(err).Error("Failed to query duplicate groups")
+		return DuplicateStats{}
+	}
+	defer rows.Close()
+
+	var stats DuplicateStats
+	var duplicateHashes []string
+	var duplicateGroups []duplicateGroup
+
+	for rows.Next() {
+		var hashAlgo sql.NullString
+		var hashValue string
+		var fileCount int
+		var totalSize int64
+		var firstSeenRaw sql.NullString // MIN() mất kiểu DATETIME nên driver trả về TEXT
+		if err := rows.Scan(&hashAlgo, &hashValue, &fileCount, &totalSize, &firstSeenRaw); err != nil {
+			logger.logger.WithError(err).Warn("Failed to scan duplicate group")
+			continue
+		}
+		firstSeen, err := parseSQLiteTime(firstSeenRaw.String)
+		if err != nil {
+			firstSeen = time.Now()
+		}
+		duplicateHashes = append(duplicateHashes, hashValue)
+		duplicateGroups = append(duplicateGroups, duplicateGroup{hashAlgo, hashValue, fileCount, totalSize, firstSeen})
+		stats.Groups++
+		stats.Files += int64(fileCount)
+		stats.TotalSize += totalSize
+	}
+
+	if len(duplicateHashes) == 0 {
+		logger.logger.Info("Phase 2: No duplicate groups found")
+		return stats
+	}
+
+	logger.logger.WithFields(logrus.Fields{
+		"groupsFound": stats.Groups,
+		"filesFound":  stats.Files,
+		"totalSizeMB": float64(stats.TotalSize) / 1024 / 1024,
+	}).Info("Phase 2: Found duplicate groups, starting marking process...")
+
+	if verify != "off" {
+		return markVerifiedDuplicates(ctx, db, duplicateGroups, verify, wait, logger)
+	}
+
+	// 1. Đánh dấu is_duplicate = 1 cho tất cả file có hash trong duplicate groups
+	markStartTime := time.Now()
+	placeholders := strings.Repeat("?,", len(duplicateHashes))
+	placeholders = placeholders[:len(placeholders)-1] // Remove trailing comma
+
+	markQuery := fmt.Sprintf(`
+		UPDATE fs_files 
+		SET is_duplicate = 1 
+		WHERE hash_value IN (%s) AND hash_value IS NOT NULL AND hardlink_of IS NULL
+	`, placeholders)
+
+	args := make([]interface{}, len(duplicateHashes))
+	for i, hash := range duplicateHashes {
+		args[i] = hash
+	}
+
+	result, err := db.ExecContext(ctx, markQuery, args...)
+	if err != nil {
+		logger.logger.WithError(err).Error("Failed to mark duplicate files")
+		return stats
+	}
+
+	markedCount, _ := result.RowsAffected()
+	markDuration := time.Since(markStartTime)
+	logger.logger.WithFields(logrus.Fields{
+		"filesMarked": markedCount,
+		"duration":    markDuration.Milliseconds(),
+	}).Info("Phase 2: Marked duplicate files")
+
+	// 2. Insert/Update vào bảng duplicate_groups
+	groupStartTime := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		logger.logger.WithError(err).Error("Failed to begin transaction for duplicate_groups")
+		return stats
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO duplicate_groups (hash_value, hash_algo, file_count, total_size, first_seen, last_updated)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(hash_value, class) DO UPDATE SET
+			hash_algo = excluded.hash_algo,
+			file_count = excluded.file_count,
+			total_size = excluded.total_size,
+			last_updated = excluded.last_updated
+	`)
+	if err != nil {
+		tx.Rollback()
+		logger.logger.WithError(err).Error("Failed to prepare duplicate_groups statement")
+		return stats
+	}
+
+	now := time.Now()
+	groupsInserted := 0
+	for _, group := range duplicateGroups {
+		if _, err := stmt.ExecContext(ctx, group.hashValue, group.hashAlgo, group.fileCount, group.totalSize, group.firstSeen, now); err != nil {
+			logger.logger.WithFields(logrus.Fields{
+				"hash":  group.hashValue,
+				"error": err.Error(),
+			}).Warn("Failed to insert duplicate group")
+			continue
+		}
+		groupsInserted++
+	}
+	stmt.Close()
+
+	if err := tx.Commit(); err != nil {
+		logger.logger.WithError(err).Error("Failed to commit duplicate_groups")
+		return stats
+	}
+
+	groupDuration := time.Since(groupStartTime)
+	totalDuration := time.Since(startTime)
+
+	logger.logger.WithFields(logrus.Fields{
+		"duplicateGroups": stats.Groups,
+		"duplicateFiles":  stats.Files,
+		"duplicateSizeMB": fmt.Sprintf("%.2f", float64(stats.TotalSize)/1024/1024),
+		"duplicateSizeGB": fmt.Sprintf("%.2f", float64(stats.TotalSize)/1024/1024/1024),
+		"groupsInserted":  groupsInserted,
+		"markDuration":    markDuration.Milliseconds(),
+		"groupDuration":   groupDuration.Milliseconds(),
+		"totalDuration":   totalDuration.Milliseconds(),
+	}).Info("Phase 2: Duplicate detection and marking completed successfully")
+
+	return stats
+}
+
+// markVerifiedDuplicates xác minh từng nhóm (verify: bytes | hash) rồi chỉ đánh dấu các lớp còn là bản trùng (applyVerifiedGroup).
+// Kết quả được commit theo lô nên khi bị ngắt các nhóm đã xác minh vẫn được giữ; chạy lại sẽ bỏ qua chúng.
+func markVerifiedDuplicates(ctx context.Context, db *sql.DB, groups []duplicateGroup, verify string, wait func(context.Context, int) error, logger *ScannerLogger) DuplicateStats {
+	const verifyCommitGroups = 500
+	startTime := time.Now()
+	commitCtx := context.WithoutCancel(ctx)
+
+	var stats DuplicateStats
+	var verified, skipped, split, unreadable, bytesRead int64
+	type verifiedGroup struct {
+		group duplicateGroup
+		out   verifyOutcome
+	}
+	var batch []verifiedGroup
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		tx, err := db.BeginTx(commitCtx, nil)
+		if err != nil {
+			logger.logger.WithError(err).Error("Failed to begin transaction for verified duplicate groups")
+			return
+		}
+		defer tx.Rollback()
+		now := time.Now()
+		var groups, files, size int64
+		for _, v := range batch {
+			kept, err := applyVerifiedGroup(commitCtx, tx, v.group.hashAlgo, v.group.hashValue, v.group.firstSeen, v.out, now)
+			if err != nil {
+				logger.logger.WithError(err).WithField("hash", v.group.hashValue).Error("Failed to mark verified duplicate group")
+				return
+			}
+			for _, class := range kept {
+				groups++
+				files += int64(len(class))
+				for _, m := range class {
+					size += m.Size
+				}
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			logger.logger.WithError(err).Error("Failed to commit verified duplicate groups")
+			return
+		}
+		stats.Groups += groups
+		stats.Files += files
+		stats.TotalSize += size
+		batch = batch[:0]
+	}
+
+	for _, g := range groups {
+		if ctx.Err() != nil {
+			break
+		}
+		members, err := loadDupMembers(ctx, db, g.hashAlgo, g.hashValue)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.logger.WithError(err).WithField("hash", g.hashValue).Warn("Failed to load duplicate group members")
+			}
+			continue
+		}
+		out, err := verifyDupGroup(ctx, members, verify, g.hashAlgo.String, wait)
+		bytesRead += out.BytesRead
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.logger.WithError(err).WithField("hash", g.hashValue).Warn("Failed to verify duplicate group")
+			}
+			continue
+		}
+		for _, u := range out.Unreadable {
+			unreadable++
+			logger.logger.WithFields(logrus.Fields{
+				"hash":  g.hashValue,
+				"path":  u.Member.Path,
+				"error": u.Err.Error(),
+			}).Warn("Phase 2: File left out of duplicate group (cannot verify)")
+		}
+		if out.Split() {
+			split++
+			logger.logger.WithFields(logrus.Fields{
+				"hash":    g.hashValue,
+				"algo":    g.hashAlgo.String,
+				"verify":  verify,
+				"classes": collisionPaths(out),
+			}).Warn("Phase 2: Hash collision, duplicate group split")
+		}
+		if out.Skipped {
+			skipped++
+		} else {
+			verified++
+		}
+		batch = append(batch, verifiedGroup{g, out})
+		if len(batch) >= verifyCommitGroups {
+			flush()
+		}
+	}
+	flush()
+
+	fields := logrus.Fields{
+		"verify":          verify,
+		"groupsVerified":  verified,
+		"groupsSkipped":   skipped,
+		"groupsSplit":     split,
+		"filesUnreadable": unreadable,
+		"bytesRead":       bytesRead,
+		"duplicateGroups": stats.Groups,
+		"duplicateFiles":  stats.Files,
+		"totalDuration":   time.Since(startTime).Milliseconds(),
+	}
+	if ctx.Err() != nil {
+		logger.logger.WithFields(fields).Warn("Phase 2: Duplicate verification interrupted, verified groups committed; rerun to verify the rest")
+		return stats
+	}
+	logger.logger.WithFields(fields).Info("Phase 2: Duplicate verification completed")
+	return stats
+}
+
+// commitHashBatch commits a batch of hash updates in a single transaction
+// column: hash_value (hash toàn bộ, algo ghi vào hash_algo) hoặc partial_hash (algo rỗng)
+func commitHashBatch(ctx context.Context, db *sql.DB, column, algo string, batch []HashResult, logger *ScannerLogger) int {
+	if len(batch) == 0 {
+		return 0
+	}
+
+	startTime := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		logger.logger.WithError(err).Error("Failed to begin transaction for hash batch")
+		return 0
+	}
+
+	// Use prepared statement for better performance
+	set, args := column+` = ?`, []any(nil)
+	if algo != "" {
+		// Hash mới chưa được xác minh với nhóm mới của nó
+		set, args = set+`, hash_algo = ?, verified_at = NULL, dup_class = NULL`, []any{algo}
+	}
+	stmt, err := tx.PrepareContext(ctx, `UPDATE fs_files SET `+set+` WHERE id = ?`)
+	if err != nil {
+		tx.Rollback()
+		logger.logger.WithError(err).Error("Failed to prepare update statement")
+		return 0
+	}
+
+	updated := 0
+	failed := 0
+	for _, res := range batch {
+		if _, err := stmt.ExecContext(ctx, append(append([]any{res.Hash.String}, args...), res.ID)...); err != nil {
+			failed++
+			logger.logger.WithFields(logrus.Fields{
+				"id":    res.ID,
+				"error": err.Error(),
+			}).Debug("Failed to update hash")
+		} else {
+			updated++
+		}
+	}
+	stmt.Close()
+
+	if err := tx.Commit(); err != nil {
+		logger.logger.WithError(err).Error("Failed to commit hash batch")
+		return 0
+	}
+
+	duration := time.Since(startTime)
+	logger.LogBatchOperation(column+"_update", updated, duration, nil)
+
+	// Detailed logging for batch commit
+	if updated > 0 {
+		logger.logger.WithFields(logrus.Fields{
+			"batchSize":  len(batch),
+			"updated":    updated,
+			"failed":     failed,
+			"duration":   duration.Milliseconds(),
+			"throughput": fmt.Sprintf("%.2f updates/sec", float64(updated)/duration.Seconds()),
+		}).Debug("Hash batch committed")
+	}
+
+	return updated
+}
+
+// configureDB configures database connection settings for optimal performance
+func configureDB(db *sql.DB, phase string, workers int) {
+	switch phase {
+	case "scan":
+		// Phase 1: Write-heavy, single connection is optimal
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+	case "hash":
+		// Phase 2: Read-heavy operations
+		db.SetMaxOpenConns(workers + 2)
+		db.SetMaxIdleConns(workers)
+		db.SetConnMaxLifetime(time.Hour)
+		db.SetConnMaxIdleTime(time.Minute * 30)
+	case "delete":
+		// Deletion: Mixed read/write operations
+		db.SetMaxOpenConns(2)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(30 * time.Minute)
+	case "report":
+		// Reporting: Read-only operations, optimized for complex queries
+		db.SetMaxOpenConns(2)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(10 * time.Minute)
+	}
+
+	// Optimize SQLite settings for performance
+	db.Exec("PRAGMA journal_mode = WAL")
+	db.Exec("PRAGMA synchronous = NORMAL")
+	db.Exec("PRAGMA cache_size = -64000") // 64MB cache
+	db.Exec("PRAGMA temp_store = MEMORY")
+	db.Exec("PRAGMA mmap_size = 268435456") // 256MB memory map
+	db.Exec("PRAGMA busy_timeout = 5000")
+
+	// Additional optimizations for specific phases
+	switch phase {
+	case "delete":
+		db.Exec("PRAGMA foreign_keys = ON")
+	case "report":
+		db.Exec("PRAGMA query_only = 1")        // Read-only for reporting
+		db.Exec("PRAGMA cache_size = -128000")  // 128MB cache for reporting
+		db.Exec("PRAGMA mmap_size = 536870912") // 512MB memory map for reporting
+	}
+}
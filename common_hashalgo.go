@@ -0,0 +1,40 @@
+// common_hashalgo.go
+//go:build scanner || hasher || checkdup
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// hashAlgoName: thuật toán hash toàn bộ file (HASH_ALGO; rỗng = mặc định, cho Config dựng tay)
+func hashAlgoName(algo string) string {
+	if algo == "" {
+		return defaultHashAlgo
+	}
+	return strings.ToLower(algo)
+}
+
+// newHasher tạo hàm hash của thuật toán algo. blake2b là BLAKE2b-512 để mỗi thuật toán có độ dài digest riêng
+// (md5 32, xxh64 16, sha256 64, blake2b 128 ký tự hex): hash_value của hai thuật toán không bao giờ trùng nhau.
+// xxh64 không phải hash mật mã, chỉ dùng để tìm file trùng, không dùng làm bằng chứng toàn vẹn.
+func newHasher(algo string) (hash.Hash, error) {
+	switch hashAlgoName(algo) {
+	case "sha256":
+		return sha256.New(), nil
+	case "blake2b":
+		return blake2b.New512(nil)
+	case "xxh64":
+		return xxhash.New(), nil
+	case "md5":
+		return md5.New(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", algo)
+}
@@ -0,0 +1,163 @@
+// common_hashcache.go
+//go:build scanner || hasher
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Cache hash dùng lâu dài (HASH_CACHE, mặc định <output_dir>/hash_cache.db): mỗi lần quét tạo DB mới với hash
+// rỗng, cache giữ hash của các lần trước để file không đổi không phải đọc lại. Một file khớp cache khi cùng
+// size và st_mtime (giá trị y như cột fs_files.st_mtime, độ chính xác ns) và cùng (st_dev, st_ino) — file đổi
+// tên/chuyển thư mục trong cùng volume vẫn khớp — hoặc cùng đường dẫn (Windows/DB cũ không có inode, volume
+// được mount lại với st_dev khác). Chỉ hash cùng thuật toán (HASH_ALGO) mới được dùng; partial_hash dùng chung.
+//
+// Cache được ATTACH vào một kết nối riêng của DB quét (ATTACH chỉ có hiệu lực trên kết nối đó): trước Phase 2
+// điền hash cho file nghi trùng khớp cache, sau Phase 2 ghi lại mọi hash của DB quét vào cache. Row không được
+// ghi lại trong HASH_CACHE_MAX_AGE ngày (file đã xoá/đổi) bị xoá khỏi cache.
+
+// hashCacheSchema: tên schema của cache trên kết nối đã ATTACH
+const hashCacheSchema = "hcache"
+
+var hashCacheDDL = []string{
+	`CREATE TABLE IF NOT EXISTS hcache.hash_cache (
+	  path TEXT PRIMARY KEY,
+	  st_dev INTEGER NOT NULL,
+	  st_ino INTEGER NOT NULL, -- 0 = không có inode (Windows, DB cũ), chỉ khớp theo path
+	  size BIGINT NOT NULL,
+	  st_mtime DATETIME NOT NULL,
+	  hash_algo TEXT NULL,
+	  hash_value TEXT NULL,
+	  partial_hash TEXT NULL,
+	  seen_at DATETIME NOT NULL -- lần cuối row được ghi lại từ một DB quét
+	)`,
+	`CREATE INDEX IF NOT EXISTS hcache.idx_hash_cache_inode ON hash_cache (st_dev, st_ino, size) WHERE st_ino != 0`,
+	`CREATE INDEX IF NOT EXISTS hcache.idx_hash_cache_seen ON hash_cache (seen_at)`,
+}
+
+// hashCacheMatch: điều kiện khớp file f1 với row c của cache, theo inode hoặc theo đường dẫn
+var hashCacheMatch = []string{
+	`c.st_ino != 0 AND c.st_dev = COALESCE(f1.st_dev, 0) AND c.st_ino = COALESCE(f1.st_ino, 0) AND c.size = f1.size AND c.st_mtime = f1.st_mtime`,
+	`c.path = f1.path AND c.size = f1.size AND c.st_mtime = f1.st_mtime`,
+}
+
+// hashCache: kết nối của DB quét đã ATTACH file cache
+type hashCache struct {
+	conn *sql.Conn
+	path string
+}
+
+// hashCacheStats: kết quả dùng cache trong một lần Phase 2
+type hashCacheStats struct {
+	Hits        int64 // file nghi trùng nhận hash toàn bộ từ cache
+	PartialHits int64 // file nhận partial_hash từ cache
+	Stored      int64 // row được ghi vào cache
+	Pruned      int64 // row quá HASH_CACHE_MAX_AGE bị xoá
+}
+
+// openHashCache ATTACH file cache vào một kết nối riêng của db (tạo file, bảng nếu chưa có)
+func openHashCache(ctx context.Context, db *sql.DB, path string) (*hashCache, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS `+hashCacheSchema, path); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hc := &hashCache{conn: conn, path: path}
+	stmts := append([]string{`PRAGMA hcache.journal_mode = WAL`}, hashCacheDDL...)
+	for _, stmt := range stmts {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			hc.Close()
+			return nil, err
+		}
+	}
+	return hc, nil
+}
+
+// Close DETACH cache và trả kết nối về pool (kết nối không còn giữ schema hcache)
+func (hc *hashCache) Close() {
+	if hc == nil {
+		return
+	}
+	_, _ = hc.conn.ExecContext(context.Background(), `DETACH DATABASE `+hashCacheSchema)
+	hc.conn.Close()
+}
+
+// lookup điền hash_value (thuật toán algo) cho file của fullFrom và partial_hash cho file của partialFrom
+// (FROM ... WHERE ..., alias f1; rỗng = bỏ qua) từ cache; trả về số file nhận hash toàn bộ và số file nhận partial_hash
+func (hc *hashCache) lookup(ctx context.Context, algo, fullFrom, partialFrom, scopeSQL string, scopeArgs []any) (full, partial int64, err error) {
+	for _, match := range hashCacheMatch {
+		n, err := hc.exec(ctx, `
+			UPDATE fs_files AS f1
+			SET hash_value = c.hash_value, hash_algo = c.hash_algo, verified_at = NULL, dup_class = NULL,
+			    partial_hash = COALESCE(f1.partial_hash, c.partial_hash)
+			FROM hcache.hash_cache AS c
+			WHERE `+match+` AND c.hash_algo = ? AND c.hash_value IS NOT NULL
+			  AND f1.hash_value IS NULL
+			  AND f1.id IN (SELECT f1.id`+fullFrom+scopeSQL+`)`, append([]any{algo}, scopeArgs...)...)
+		if err != nil {
+			return full, partial, err
+		}
+		full += n
+	}
+	if partialFrom == "" {
+		return full, partial, nil
+	}
+	for _, match := range hashCacheMatch {
+		n, err := hc.exec(ctx, `
+			UPDATE fs_files AS f1
+			SET partial_hash = c.partial_hash
+			FROM hcache.hash_cache AS c
+			WHERE `+match+` AND c.partial_hash IS NOT NULL
+			  AND f1.partial_hash IS NULL
+			  AND f1.id IN (SELECT f1.id`+partialFrom+scopeSQL+`)`, scopeArgs...)
+		if err != nil {
+			return full, partial, err
+		}
+		partial += n
+	}
+	return full, partial, nil
+}
+
+// store ghi hash của các file (trong scope) vào cache. Row cũ của cùng đường dẫn được thay khi file đổi
+// (size/st_mtime khác); file không đổi giữ hash trong cache mà DB quét chưa có (ví dụ chưa cần partial hash).
+func (hc *hashCache) store(ctx context.Context, now time.Time, scopeSQL string, scopeArgs []any) (int64, error) {
+	const same = `excluded.size = hash_cache.size AND excluded.st_mtime = hash_cache.st_mtime`
+	return hc.exec(ctx, `
+		INSERT INTO hcache.hash_cache (path, st_dev, st_ino, size, st_mtime, hash_algo, hash_value, partial_hash, seen_at)
+		SELECT f1.path, COALESCE(f1.st_dev, 0), COALESCE(f1.st_ino, 0), f1.size, f1.st_mtime,
+		       f1.hash_algo, f1.hash_value, f1.partial_hash, ?
+		FROM fs_files f1
+		WHERE f1.hardlink_of IS NULL AND f1.size > 0
+		  AND (f1.hash_value IS NOT NULL OR f1.partial_hash IS NOT NULL)`+scopeSQL+`
+		ON CONFLICT(path) DO UPDATE SET
+		  hash_algo = CASE WHEN `+same+` AND excluded.hash_value IS NULL THEN hash_cache.hash_algo ELSE excluded.hash_algo END,
+		  hash_value = CASE WHEN `+same+` AND excluded.hash_value IS NULL THEN hash_cache.hash_value ELSE excluded.hash_value END,
+		  partial_hash = CASE WHEN `+same+` AND excluded.partial_hash IS NULL THEN hash_cache.partial_hash ELSE excluded.partial_hash END,
+		  st_dev = excluded.st_dev,
+		  st_ino = excluded.st_ino,
+		  size = excluded.size,
+		  st_mtime = excluded.st_mtime,
+		  seen_at = excluded.seen_at`, append([]any{now}, scopeArgs...)...)
+}
+
+// prune xoá row không được ghi lại trong maxAgeDays ngày (0 = giữ mãi)
+func (hc *hashCache) prune(ctx context.Context, now time.Time, maxAgeDays int) (int64, error) {
+	if maxAgeDays <= 0 {
+		return 0, nil
+	}
+	return hc.exec(ctx, `DELETE FROM hcache.hash_cache WHERE seen_at < ?`, now.AddDate(0, 0, -maxAgeDays))
+}
+
+func (hc *hashCache) exec(ctx context.Context, query string, args ...any) (int64, error) {
+	res, err := hc.conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
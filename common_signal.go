@@ -0,0 +1,41 @@
+// common_signal.go
+//go:build scanner || hasher || deleter || checkdup
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exitInterrupted: exit code khi dừng do SIGINT/SIGTERM (128 + SIGINT), để scheduler phân biệt với lỗi thường
+const exitInterrupted = 130
+
+// notifyShutdown trả về context bị huỷ khi nhận SIGINT/SIGTERM (ví dụ `docker stop`), để các phase
+// kịp flush/commit dữ liệu đang dở. Tín hiệu thứ hai thoát ngay không chờ.
+func notifyShutdown(parent context.Context, onSignal func(os.Signal)) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-ch:
+			if onSignal != nil {
+				onSignal(sig)
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		<-ch
+		os.Exit(exitInterrupted)
+	}()
+
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel()
+	}
+}
@@ -0,0 +1,261 @@
+// common_throttle.go
+//go:build scanner || hasher
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/sirupsen/logrus"
+)
+
+// Giới hạn I/O của Phase 2 (HASH_BWLIMIT bytes/giây, HASH_IOPS lần đọc/giây) và tạm dừng/tiếp tục hash.
+// Mọi worker hash dùng chung một ioThrottle; giới hạn đổi được khi đang chạy qua file điều khiển
+// HASH_CONTROL_FILE (đọc lại khi file đổi, hoặc ngay khi nhận SIGHUP) và tín hiệu SIGUSR1 (tạm dừng) /
+// SIGUSR2 (tiếp tục). File điều khiển có dạng ini, key thiếu = giá trị trong cấu hình:
+//
+//	PAUSE = true
+//	HASH_BWLIMIT = 20M
+//	HASH_IOPS = 200
+//
+// Khi tạm dừng, worker đứng chờ giữa hai lần đọc (file đang mở dở được đọc tiếp khi chạy lại), các hash đã
+// tính xong được commit ngay nên dừng hẳn lúc đang tạm dừng cũng không mất kết quả.
+
+// controlPollInterval: chu kỳ kiểm tra file điều khiển
+const controlPollInterval = 2 * time.Second
+
+// ioThrottle giới hạn băng thông/IOPS đọc file dùng chung cho các worker. nil = không giới hạn.
+type ioThrottle struct {
+	mu       sync.Mutex
+	bps      int64 // bytes/giây, 0 = không giới hạn
+	iops     int   // lần đọc/giây, 0 = không giới hạn
+	nextByte time.Time
+	nextOp   time.Time
+	paused   bool
+	resume   chan struct{} // đóng khi tiếp tục
+}
+
+func newIOThrottle(bps int64, iops int) *ioThrottle {
+	return &ioThrottle{bps: max(bps, 0), iops: max(iops, 0)}
+}
+
+// wait được gọi sau mỗi lần đọc n bytes: chờ nếu đang tạm dừng, rồi chờ đủ thời gian theo HASH_BWLIMIT/HASH_IOPS.
+// Trả về lỗi của ctx nếu bị huỷ trong lúc chờ.
+func (t *ioThrottle) wait(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	for {
+		t.mu.Lock()
+		if !t.paused {
+			break
+		}
+		resume := t.resume
+		t.mu.Unlock()
+		select {
+		case <-resume:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	// Đặt chỗ trên hai "đồng hồ": mỗi yêu cầu đẩy mốc kế tiếp thêm n/bps và 1/iops giây
+	now := time.Now()
+	until := now
+	if t.bps > 0 {
+		t.nextByte = later(t.nextByte, now).Add(time.Duration(float64(n) / float64(t.bps) * float64(time.Second)))
+		until = later(until, t.nextByte)
+	}
+	if t.iops > 0 {
+		t.nextOp = later(t.nextOp, now).Add(time.Second / time.Duration(t.iops))
+		until = later(until, t.nextOp)
+	}
+	t.mu.Unlock()
+
+	if d := until.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// set đổi giới hạn; false nếu không có gì thay đổi
+func (t *ioThrottle) set(bps int64, iops int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bps, iops = max(bps, 0), max(iops, 0)
+	if t.bps == bps && t.iops == iops {
+		return false
+	}
+	t.bps, t.iops = bps, iops
+	t.nextByte, t.nextOp = time.Time{}, time.Time{}
+	return true
+}
+
+// setPaused tạm dừng/tiếp tục; false nếu đã ở trạng thái đó
+func (t *ioThrottle) setPaused(p bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paused == p {
+		return false
+	}
+	t.paused = p
+	if p {
+		t.resume = make(chan struct{})
+	} else {
+		close(t.resume)
+		t.nextByte, t.nextOp = time.Time{}, time.Time{}
+	}
+	return true
+}
+
+// Paused: đang tạm dừng (nil = không)
+func (t *ioThrottle) Paused() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+func (t *ioThrottle) fields() logrus.Fields {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return logrus.Fields{"bwlimit": formatRate(t.bps), "iops": t.iops, "paused": t.paused}
+}
+
+// formatRate: bytes/giây dạng dễ đọc cho log
+func formatRate(bps int64) string {
+	if bps <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%.1f MiB/s", float64(bps)/(1<<20))
+}
+
+// throttleControl áp dụng file điều khiển và tín hiệu lên ioThrottle
+type throttleControl struct {
+	t        *ioThrottle
+	path     string
+	bps      int64 // giá trị trong cấu hình, dùng khi file không có key tương ứng
+	iops     int
+	logger   *ScannerLogger
+	lastMod  time.Time
+	lastSize int64
+	present  bool
+}
+
+// watch theo dõi file điều khiển và tín hiệu (xem throttleSignals) đến khi ctx bị huỷ
+func (c *throttleControl) watch(ctx context.Context) {
+	sigs := make(chan os.Signal, 4)
+	if len(throttleSignals) > 0 {
+		signal.Notify(sigs, throttleSignals...)
+		defer signal.Stop(sigs)
+	}
+	var poll <-chan time.Time
+	if c.path != "" {
+		c.reload(false)
+		tick := time.NewTicker(controlPollInterval)
+		defer tick.Stop()
+		poll = tick.C
+	}
+	for {
+		select {
+		case <-poll:
+			c.reload(false)
+		case sig := <-sigs:
+			switch throttleSignalAction(sig) {
+			case "pause":
+				if c.t.setPaused(true) {
+					c.logger.logger.WithField("signal", sig.String()).Warn("Phase 2: Hashing paused")
+				}
+			case "resume":
+				if c.t.setPaused(false) {
+					c.logger.logger.WithField("signal", sig.String()).Info("Phase 2: Hashing resumed")
+				}
+			case "reload":
+				c.reload(true)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload đọc lại file điều khiển khi nó đổi (force = đọc dù không đổi). File bị xoá = quay về cấu hình, không tạm dừng.
+func (c *throttleControl) reload(force bool) {
+	if c.path == "" {
+		return
+	}
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		if c.present || force {
+			c.present = false
+			c.apply(false, c.bps, c.iops, "control file removed")
+		}
+		return
+	}
+	if !force && c.present && fi.ModTime().Equal(c.lastMod) && fi.Size() == c.lastSize {
+		return
+	}
+	c.present, c.lastMod, c.lastSize = true, fi.ModTime(), fi.Size()
+
+	f, err := ini.Load(c.path)
+	if err != nil {
+		c.logger.logger.WithError(err).WithField("controlFile", c.path).Warn("Phase 2: Cannot read hash control file, keeping current limits")
+		return
+	}
+	sec := f.Section("")
+	paused := sec.Key("PAUSE").MustBool(false)
+	bps, iops := c.bps, c.iops
+	if k := sec.Key("HASH_BWLIMIT"); k.String() != "" {
+		if bps, err = parseByteRate(k.String()); err != nil {
+			c.logger.logger.WithError(err).WithField("controlFile", c.path).Warn("Phase 2: Invalid HASH_BWLIMIT in control file")
+			bps = c.bps
+		}
+	}
+	if k := sec.Key("HASH_IOPS"); k.String() != "" {
+		if iops, err = k.Int(); err != nil || iops < 0 {
+			c.logger.logger.WithField("controlFile", c.path).Warnf("Phase 2: Invalid HASH_IOPS %q in control file", k.String())
+			iops = c.iops
+		}
+	}
+	c.apply(paused, bps, iops, "control file "+c.path)
+}
+
+func (c *throttleControl) apply(paused bool, bps int64, iops int, source string) {
+	changed := c.t.set(bps, iops)
+	wasPaused := c.t.Paused()
+	if c.t.setPaused(paused) {
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	entry := c.logger.logger.WithFields(c.t.fields()).WithField("source", source)
+	switch {
+	case paused && !wasPaused:
+		entry.Warn("Phase 2: Hashing paused")
+	case !paused && wasPaused:
+		entry.Info("Phase 2: Hashing resumed")
+	default:
+		entry.Info("Phase 2: Hash I/O limits changed")
+	}
+}
@@ -1,5 +1,5 @@
 // common_types.go
-//go:build scanner || deleter || reporter || reporter_optimized || checkdup
+//go:build scanner || deleter || reporter || reporter_optimized || checkdup || aggregate || hasher
 
 package main
 
@@ -13,8 +13,126 @@ type Config struct {
 	OutputDir  string
 	BatchSize  int
 	MaxWorkers int
-	Exclude    map[string]struct{}
-	Paths      [][2]string // (root_path, loaithumuc)
+	MemLimitMB int64               // ngưỡng bộ nhớ cho DynamicConfig/worker pool
+	Exclude    map[string]struct{} // EXCLUDE_DIRS: tên thư mục bỏ qua
+	Paths      [][2]string         // (root_path, loaithumuc)
+
+	// Quét tăng dần (incremental): tái sử dụng DB của lần quét trước
+	Incremental       bool
+	PreviousDB        string // rỗng = tự chọn file scan_*.db mới nhất trong OutputDir
+	SkipUnchangedDirs bool   // bỏ qua liệt kê lại thư mục có st_mtime không đổi
+
+	// Tiếp tục lần quét bị ngắt: mở lại DB, bỏ qua các root đã xong theo scan_roots
+	Resume bool
+
+	// Song song trong một root: số worker cùng liệt kê/stat thư mục của một root
+	RootWorkers         int
+	RootWorkersOverride map[string]int // root_path -> số worker riêng (cú pháp path:Tag:N)
+
+	// Loại trừ theo mẫu glob/regex/đường dẫn (cú pháp xem exclude.go)
+	ExcludePatterns     []string            // [exclude], áp dụng cho mọi root
+	RootExcludePatterns map[string][]string // [exclude.<Tag>]: tag -> mẫu chỉ áp dụng cho root có tag đó
+
+	// Đi theo symlink trỏ tới thư mục (có phát hiện vòng lặp); mặc định chỉ ghi symlink vào fs_special
+	FollowSymlinks bool
+
+	// Không đi vào mount point (thư mục khác st_dev với root hoặc là bind/snapshot mount); chỉ ghi vào scan_mounts
+	OneFileSystem bool
+
+	// Xử lý root trùng/lồng nhau trong [paths]: error (không chạy) | merge (bỏ root con) | nested (root con giữ tag riêng)
+	OverlappingRoots string
+	NestedRoots      map[string][]string // (nested) root tuyệt đối -> các root con cần bỏ qua khi duyệt, theo đường dẫn của root cha
+
+	// Cột fs_files.thumuc: thành phần thứ N của đường dẫn tính từ root (0 = như cũ, topFolder(p, 4) trên đường dẫn tuyệt đối)
+	ThuMucDepth     int
+	RootThuMucDepth map[string]int // [thumuc]: tag -> độ sâu riêng cho root có tag đó
+
+	// Gắn tag theo regex trên đường dẫn ([tags.<kind>], cú pháp xem tagging.go), ghi vào fs_tags
+	TagRules []TagRuleSpec
+
+	// Đổi số worker đang chạy theo tải thực tế của máy (CPU, iowait, RAM trong /proc), xem common_adaptive.go
+	Adaptive           bool
+	AdaptiveMinWorkers int
+	AdaptiveMaxWorkers int // trần của pool hash (0 = 2 x MAX_WORKERS)
+	AdaptiveCPUHigh    int // % CPU bận
+	AdaptiveIOWaitHigh int // % iowait
+	AdaptiveMemHigh    int // % RAM đã dùng
+	AdaptiveInterval   int // giây giữa hai lần đo
+
+	// Giới hạn I/O và tạm dừng Phase 2, đổi được khi đang chạy (xem common_throttle.go)
+	HashBandwidth   int64  // HASH_BWLIMIT: bytes/giây đọc file khi hash (0 = không giới hạn)
+	HashIOPS        int    // HASH_IOPS: số lần đọc/giây (0 = không giới hạn)
+	HashControlFile string // HASH_CONTROL_FILE: file điều khiển (PAUSE, HASH_BWLIMIT, HASH_IOPS); rỗng = không dùng
+
+	// Phase 2 theo thiết bị: mỗi st_dev một hàng đợi đọc tuần tự (theo inode hoặc đường dẫn), số worker đọc
+	// cùng lúc trên một thiết bị bị giới hạn (xem hashDevicePlan trong common_hash.go)
+	HashDeviceWorkers     int            // HASH_DEVICE_WORKERS: mặc định cho mọi thiết bị (0 = không giới hạn riêng, chỉ MAX_WORKERS)
+	RootHashDeviceWorkers map[string]int // [hash_devices]: tag của root -> số worker trên thiết bị chứa root đó
+	HashOrder             string         // HASH_ORDER: inode | path
+
+	// Phase 2 hai bước: partial hash (mẫu đầu/giữa/cuối) trước, hash toàn bộ chỉ khi partial hash còn trùng
+	PartialHash        bool  // PARTIAL_HASH
+	PartialHashMinSize int64 // PARTIAL_HASH_MIN_SIZE: file không lớn hơn giá trị này được hash toàn bộ luôn (bytes)
+
+	// Thuật toán hash toàn bộ file, ghi kèm từng row vào fs_files.hash_algo; chỉ hash cùng thuật toán mới được so với nhau
+	HashAlgo   string // HASH_ALGO: sha256 | blake2b | xxh64 | md5
+	HashRehash string // HASH_REHASH: lazy | all — row có hash_algo khác HASH_ALGO được hash lại khi nào
+
+	// VERIFY_DUPLICATES: off | bytes | hash — xác minh nội dung nhóm cùng hash trước khi đánh dấu is_duplicate
+	// (bytes = so từng byte, hash = hash lại bằng thuật toán độc lập); nhóm không khớp bị tách, ghi vào hash_collisions
+	VerifyDuplicates string
+
+	// HASH_MODE: suspects (chỉ file trùng size với file khác) | catalog (mọi file, làm mốc toàn vẹn);
+	// catalog chỉ gồm file thuộc HASH_CATALOG_TAGS (loaithumuc) và HASH_CATALOG_EXTENSIONS (".pdf"), rỗng = không lọc
+	HashMode              string
+	HashCatalogTags       []string
+	HashCatalogExtensions []string
+
+	// Cache hash dùng lâu dài qua các lần quét (xem common_hashcache.go)
+	HashCache       bool   // HASH_CACHE
+	HashCacheFile   string // HASH_CACHE_FILE: rỗng = <output_dir>/hash_cache.db
+	HashCacheMaxAge int    // HASH_CACHE_MAX_AGE: ngày; row không được ghi lại lâu hơn bị xoá (0 = giữ mãi)
+}
+
+// TagRuleSpec (dùng chung): một luật gắn tag trong [tags.<kind>] — key là giá trị tag (có thể dùng $1, ${name}), value là regex
+type TagRuleSpec struct {
+	Kind    string // department, project, cost_center...; kind "thumuc" thay giá trị cột fs_files.thumuc
+	Value   string
+	Pattern string
+}
+
+// ScanRunInfo (dùng chung): một dòng scan_runs + các root của nó, reporter dùng để ghi nguồn báo cáo
+type ScanRunInfo struct {
+	ID          int64          `json:"id"`
+	StartedAt   time.Time      `json:"startedAt"`
+	FinishedAt  time.Time      `json:"finishedAt,omitempty"` // zero = chưa kết thúc
+	Status      string         `json:"status"`
+	Host        string         `json:"host"`
+	Mode        string         `json:"mode"` // full|incremental|resume
+	ResumedFrom int64          `json:"resumedFrom,omitempty"`
+	TotalFiles  int64          `json:"totalFiles"`
+	Roots       []ScanRootInfo `json:"roots"`
+
+	Errors            int64 `json:"errors"`            // số dòng scan_errors của lần quét
+	IncompleteFolders int64 `json:"incompleteFolders"` // thư mục có fs_folders.incomplete = 1 (toàn DB)
+}
+
+// ScanRootInfo (dùng chung): trạng thái quét của một root trong scan_roots
+type ScanRootInfo struct {
+	Path      string `json:"path"`
+	Tag       string `json:"tag"`
+	Status    string `json:"status"` // pending|running|done|skipped|failed|interrupted
+	FileCount int64  `json:"fileCount"`
+}
+
+// LinkIssue (dùng chung): symlink hỏng hoặc trỏ ra ngoài root, đọc từ fs_special cho reporter
+type LinkIssue struct {
+	Path       string `json:"path"`
+	LinkTarget string `json:"linkTarget"`           // nguyên văn readlink
+	TargetPath string `json:"targetPath,omitempty"` // đường dẫn thật, rỗng nếu link hỏng
+	Broken     bool   `json:"broken"`
+	Outside    bool   `json:"outsideRoot"`
+	LoaiThuMuc string `json:"loaithumuc,omitempty"`
 }
 
 // StatInfo (dùng chung)
@@ -23,7 +141,15 @@ type StatInfo struct {
 	Atime    time.Time
 	Mtime    time.Time
 	Ctime    time.Time
-	Username string
+	Username string // owner đã tra theo uid (uid dạng số nếu không tra được)
+
+	Uid    uint32
+	Gid    uint32
+	Mode   uint32 // st_mode POSIX: bit loại file + quyền (ví dụ 0100644)
+	Inode  uint64
+	Device uint64
+	Nlink  uint64
+	Blocks int64 // st_blocks: số block 512 byte đã cấp phát
 }
 
 // --- Structs cho Scanner (Phase 1) ---
@@ -35,7 +161,51 @@ type DirInsertReq struct {
 	EntryName  string
 	Info       StatInfo
 	LoaiThuMuc string
-	Resp       chan int64 // Channel để nhận về ID của thư mục vừa insert
+	Resp       chan DirInsertResp // Channel để nhận về ID của thư mục vừa insert
+}
+
+// DirInsertResp (dùng cho scanner)
+type DirInsertResp struct {
+	ID        int64 // -1 nếu insert lỗi
+	Unchanged bool  // incremental: st_mtime trùng với lần quét trước
+}
+
+// ListDirsReq (dùng cho scanner incremental): lấy các thư mục con đã biết trong DB
+type ListDirsReq struct {
+	ParentID int64
+	Resp     chan []string
+}
+
+// PruneDirReq (dùng cho scanner incremental): xoá các entry không còn trên đĩa
+type PruneDirReq struct {
+	FolderID    int64
+	SeenFiles   map[string]struct{} // tên file còn tồn tại
+	SeenDirs    map[string]struct{} // tên thư mục con còn tồn tại
+	SeenSpecial map[string]struct{} // tên symlink/socket/device còn tồn tại
+
+	// Thư mục reused (SKIP_UNCHANGED_DIRS) không được liệt kê lại: thay cho Seen*, xoá các entry đã biết mà
+	// Drop(đường dẫn, tên, là thư mục) trả về true — entry nay khớp luật loại trừ ([exclude], .scanignore mới)
+	Path string
+	Drop func(p, name string, isDir bool) bool
+}
+
+// RootStatusReq (dùng cho scanner): cập nhật trạng thái một dòng scan_roots.
+// dbWriter flush các file đang chờ trước khi ghi, nên "done" chỉ được ghi khi mọi file của root đã vào DB.
+type RootStatusReq struct {
+	RootRowID int64
+	Status    string
+	FileCount uint64
+	Err       string
+
+	ExcludeHits map[int64]int64  // scan_excludes.id -> số entry bị loại trừ (ghi cùng trạng thái kết thúc)
+	ScanIgnores []ScanIgnoreStat // các file .scanignore đã áp dụng, ghi thành dòng kind=scanignore
+}
+
+// ScanIgnoreStat (dùng cho scanner): một file .scanignore đã áp dụng và số entry nó loại trừ
+type ScanIgnoreStat struct {
+	Path  string
+	Rules int
+	Hits  int64
 }
 
 // FileRow (dùng cho scanner)
@@ -49,13 +219,97 @@ type FileRow struct {
 	Mtime      time.Time
 	LoaiThuMuc string
 	ThuMuc     string
+	Tags       []FileTag // theo TagRules, ghi vào fs_tags
+	Stat       StatInfo  // owner/uid/gid/mode/atime/ctime/inode/device/nlink/blocks
+}
+
+// FileTag (dùng chung): một tag của file trong fs_tags
+type FileTag struct {
+	Kind string `json:"kind"`
+	Tag  string `json:"tag"`
+}
+
+// SpecialRow (dùng cho scanner): entry không phải file thường/thư mục, ghi vào fs_special
+type SpecialRow struct {
+	FolderID   int64
+	Path       string
+	DirPath    string
+	Filename   string
+	EntryType  string // symlink|socket|fifo|blockdev|chardev|other
+	LinkTarget string // symlink: nguyên văn readlink
+	TargetPath string // symlink: đường dẫn thật sau khi resolve, rỗng nếu link hỏng
+	TargetType string // symlink: file|dir|other, rỗng nếu link hỏng
+	TargetOK   bool   // symlink: target tồn tại
+	Outside    bool   // symlink: target nằm ngoài root đang quét
+	Followed   bool   // symlink tới thư mục đã được duyệt (FOLLOW_SYMLINKS)
+	FollowNote string // lý do không duyệt: inside_root|loop|visited
+	LoaiThuMuc string
+	Mtime      time.Time
+	Stat       StatInfo // stat của chính entry (lstat)
+}
+
+// MountInfo (dùng chung): một mount trong bảng mount của hệ thống (/proc/self/mountinfo)
+type MountInfo struct {
+	MountPoint string
+	FsType     string // ext4, nfs, cifs, btrfs...
+	Source     string // thiết bị/share được mount, ví dụ /dev/mapper/cachedev1, //nas/share
+}
+
+// MountRow (dùng cho scanner): volume chứa root (Root = true, ghi vào scan_roots)
+// hoặc một mount point gặp khi duyệt (ghi vào scan_mounts)
+type MountRow struct {
+	RootRowID int64
+	ParentID  int64  // fs_folders.id của thư mục chứa mount point
+	Path      string // đường dẫn mount point (hoặc root) theo cách scanner duyệt
+	Device    uint64 // st_dev của mount point/root
+	Mount     MountInfo
+	Root      bool
+	Descended bool // false = không duyệt vào (ONE_FILESYSTEM)
+}
+
+// VolumeUsage (dùng chung): dung lượng file theo volume (st_dev), reporter dùng cho mục "Usage by Volume"
+type VolumeUsage struct {
+	Device     int64  `json:"device"`
+	MountPoint string `json:"mountPoint"` // rỗng nếu không tra được (DB cũ)
+	FsType     string `json:"fsType"`
+	Source     string `json:"source"`
+	Roots      string `json:"roots"`     // các root nằm trên volume này, ngăn cách bởi ", "
+	FileCount  int64  `json:"fileCount"` // gồm cả hardlink
+	TotalSize  int64  `json:"totalSize"` // hardlink chỉ tính một lần
+	Skipped    bool   `json:"skipped"`   // mount point không được duyệt (ONE_FILESYSTEM), không có file
+}
+
+// TagUsage (dùng chung): dung lượng file theo tag (fs_tags), reporter dùng cho mục "Usage by Tag"
+type TagUsage struct {
+	Kind      string `json:"kind"`
+	Tag       string `json:"tag"`
+	FileCount int64  `json:"fileCount"`
+	TotalSize int64  `json:"totalSize"` // hardlink chỉ tính một lần
+}
+
+// ScanErrorRow (dùng cho scanner): lỗi filesystem đã retry mà vẫn thất bại, ghi vào scan_errors
+type ScanErrorRow struct {
+	RootRowID int64  // scan_roots.id (0 = không gắn với scan_roots, ví dụ mainLegacy)
+	FolderID  int64  // thư mục bị đánh dấu incomplete (0 = lỗi ở chính root, chưa có fs_folders)
+	Path      string // entry gặp lỗi
+	Op        string // lstat|readdir|readlink
+	Errno     int    // errno của hệ thống (0 nếu không xác định)
+	Err       string
+	Attempts  int
+	At        time.Time
 }
 
 // DbMsg (dùng cho scanner)
 type DbMsg struct {
-	InsertDir   *DirInsertReq
-	InsertFiles []FileRow
-	Shutdown    bool
+	InsertDir     *DirInsertReq
+	InsertFiles   []FileRow
+	InsertSpecial []SpecialRow
+	ScanErrors    []ScanErrorRow
+	InsertMounts  []MountRow
+	ListDirs      *ListDirsReq
+	PruneDir      *PruneDirReq
+	RootStatus    *RootStatusReq
+	Shutdown      bool
 }
 
 // --- Structs cho Hashing (Phase 2) ---
@@ -64,6 +318,14 @@ type DbMsg struct {
 type FileToHash struct {
 	ID   int64
 	Path string
+	Size int64
+}
+
+// HashScope (dùng cho hasher): giới hạn tập file cần hash, rỗng = toàn bộ
+type HashScope struct {
+	Tags         []string // loaithumuc
+	PathPrefixes []string // thư mục gốc của phạm vi (so khớp dir_path)
+	MinSize      int64    // bytes
 }
 
 // HashResult (struct cho worker)
@@ -0,0 +1,414 @@
+// common_verify.go
+//go:build scanner || hasher || checkdup
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Xác minh nhóm trùng trước khi đánh dấu is_duplicate (VERIFY_DUPLICATES, checkdup -verify):
+//   - bytes: so từng byte các file trong nhóm với một file mẫu;
+//   - hash: tính thêm một hash độc lập (secondHashAlgo) của từng file.
+//
+// Các file có nội dung giống nhau tạo thành một lớp. Mỗi lớp từ 2 file là một nhóm trùng trong duplicate_groups
+// (khoá hash_value, class) và được ghi verified_at; lớp chỉ có một file không bị đánh dấu trùng. Nhóm có nhiều lớp
+// là va chạm hash (hash_collisions), lớp của từng file được ghi vào fs_files.dup_class. File không đọc được hoặc đã
+// đổi size từ lần quét bị bỏ khỏi nhóm (không coi là va chạm). Nhóm mà mọi file đã có verified_at (xác minh ở lần
+// chạy trước, chưa hash lại) không bị đọc lại: các lớp được dựng lại từ dup_class.
+
+// verifyMaxOpen: số file so cùng lúc với file mẫu (mỗi file một buffer verifyBlockSize)
+const (
+	verifyMaxOpen   = 32
+	verifyBlockSize = 128 * 1024
+)
+
+// dupMember: một file (không phải bản liên kết) của nhóm cùng (hash_algo, hash_value)
+type dupMember struct {
+	ID       int64
+	Path     string
+	Size     int64
+	Verified bool // đã có verified_at
+	Class    int  // dup_class của lần xác minh trước (0 = nhóm không bị tách)
+}
+
+// dupUnreadable: file bị bỏ khỏi nhóm khi xác minh
+type dupUnreadable struct {
+	Member dupMember
+	Err    error
+}
+
+// verifyOutcome: kết quả xác minh một nhóm
+type verifyOutcome struct {
+	Mode       string        // bytes | hash
+	Classes    [][]dupMember // các lớp nội dung giống nhau, lớp lớn nhất trước (chỉ số = dup_class)
+	Unreadable []dupUnreadable
+	Skipped    bool  // mọi file đã được xác minh trước đó, không đọc lại (Classes lấy từ dup_class)
+	BytesRead  int64 // bytes đã đọc
+}
+
+// Split: lần xác minh này tách nhóm thành hơn một lớp — các file cùng hash nhưng khác nội dung
+// (nhóm bỏ qua vì đã xác minh trước đó không tính, va chạm đã được ghi ở lần trước)
+func (o verifyOutcome) Split() bool {
+	return len(o.Classes) > 1 && !o.Skipped
+}
+
+// verifyModeName: chế độ xác minh nhóm trùng (VERIFY_DUPLICATES; rỗng = off, cho Config dựng tay)
+func verifyModeName(mode string) string {
+	if mode == "" {
+		return "off"
+	}
+	return strings.ToLower(mode)
+}
+
+// secondHashAlgo: hash độc lập dùng cho chế độ hash, khác thuật toán của nhóm
+func secondHashAlgo(algo string) string {
+	if hashAlgoName(algo) == "sha256" {
+		return "blake2b"
+	}
+	return "sha256"
+}
+
+// loadDupMembers đọc các file của nhóm (algo NULL = DB chưa có hash_algo)
+func loadDupMembers(ctx context.Context, db *sql.DB, algo sql.NullString, hashValue string) ([]dupMember, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, path, size, verified_at IS NOT NULL, COALESCE(dup_class, 0)
+		FROM fs_files
+		WHERE hash_value = ? AND hash_algo IS ? AND hardlink_of IS NULL
+		ORDER BY id`, hashValue, algo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []dupMember
+	for rows.Next() {
+		var m dupMember
+		if err := rows.Scan(&m.ID, &m.Path, &m.Size, &m.Verified, &m.Class); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// verifyDupGroup xác minh members theo mode (bytes | hash); algo là hash_algo của nhóm.
+// wait (có thể nil) được gọi sau mỗi lần đọc n bytes (giới hạn I/O, tạm dừng). Lỗi chỉ trả về khi ctx bị huỷ.
+func verifyDupGroup(ctx context.Context, members []dupMember, mode, algo string, wait func(context.Context, int) error) (verifyOutcome, error) {
+	out := verifyOutcome{Mode: mode}
+	if wait == nil {
+		wait = func(context.Context, int) error { return nil }
+	}
+	skip := len(members) > 1
+	for _, m := range members {
+		skip = skip && m.Verified
+	}
+	if skip {
+		// Giữ đúng số lớp đã ghi (dup_class, hash_collisions.class); lớp không còn file để trống
+		out.Skipped = true
+		for _, m := range members {
+			for len(out.Classes) <= m.Class {
+				out.Classes = append(out.Classes, nil)
+			}
+			out.Classes[m.Class] = append(out.Classes[m.Class], m)
+		}
+		return out, nil
+	}
+
+	var err error
+	switch mode {
+	case "bytes":
+		err = partitionByBytes(ctx, members, wait, &out)
+	case "hash":
+		err = partitionByHash(ctx, members, secondHashAlgo(algo), wait, &out)
+	default:
+		return out, fmt.Errorf("unknown verify mode %q", mode)
+	}
+	if err != nil {
+		return out, err
+	}
+	// Lớp lớn nhất trước (ổn định: cùng số file thì lớp chứa file id nhỏ hơn trước)
+	for i := 1; i < len(out.Classes); i++ {
+		for j := i; j > 0 && len(out.Classes[j]) > len(out.Classes[j-1]); j-- {
+			out.Classes[j], out.Classes[j-1] = out.Classes[j-1], out.Classes[j]
+		}
+	}
+	return out, nil
+}
+
+// openMember mở file của nhóm, lỗi nếu size đã khác lúc quét (nội dung đã đổi, hash cũ không còn đúng)
+func openMember(m dupMember) (*os.File, error) {
+	f, err := os.Open(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() != m.Size {
+		f.Close()
+		return nil, fmt.Errorf("size changed since scan (%d -> %d bytes)", m.Size, fi.Size())
+	}
+	return f, nil
+}
+
+// partitionByBytes: lấy file đầu làm mẫu, so từng byte với tối đa verifyMaxOpen file mỗi lượt; file giống mẫu
+// vào lớp của mẫu, file khác được chia tiếp với mẫu mới. File mẫu được đọc lại mỗi lượt.
+func partitionByBytes(ctx context.Context, members []dupMember, wait func(context.Context, int) error, out *verifyOutcome) error {
+	rest := members
+	for len(rest) > 0 {
+		ref := rest[0]
+		class := []dupMember{ref}
+		var cand, next []dupMember
+		for _, m := range rest[1:] {
+			if m.Size == ref.Size {
+				cand = append(cand, m)
+			} else {
+				next = append(next, m) // khác size chắc chắn khác nội dung
+			}
+		}
+		refOK := true
+		for len(cand) > 0 {
+			chunk := cand[:min(len(cand), verifyMaxOpen)]
+			cand = cand[len(chunk):]
+			same, errs, n, err := compareWithReference(ctx, ref, chunk, wait)
+			out.BytesRead += n
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				// Không đọc được file mẫu: các file còn lại được chia lại với mẫu khác
+				out.Unreadable = append(out.Unreadable, dupUnreadable{ref, err})
+				next = append(append(append(next, class[1:]...), chunk...), cand...)
+				refOK = false
+				break
+			}
+			for i, m := range chunk {
+				switch {
+				case errs[i] != nil:
+					out.Unreadable = append(out.Unreadable, dupUnreadable{m, errs[i]})
+				case same[i]:
+					class = append(class, m)
+				default:
+					next = append(next, m)
+				}
+			}
+		}
+		if refOK {
+			out.Classes = append(out.Classes, class)
+		}
+		rest = next
+	}
+	return nil
+}
+
+// compareWithReference đọc ref và các file chunk song song từng block; same[i] = nội dung giống hệt ref.
+// errs[i]: lỗi đọc file chunk[i]; err: lỗi đọc ref (hoặc ctx bị huỷ).
+func compareWithReference(ctx context.Context, ref dupMember, chunk []dupMember, wait func(context.Context, int) error) (same []bool, errs []error, read int64, err error) {
+	rf, err := openMember(ref)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer rf.Close()
+
+	same = make([]bool, len(chunk))
+	errs = make([]error, len(chunk))
+	files := make([]*os.File, len(chunk))
+	for i, m := range chunk {
+		if files[i], errs[i] = openMember(m); errs[i] == nil {
+			same[i] = true
+			defer files[i].Close()
+		}
+	}
+
+	refBuf := make([]byte, verifyBlockSize)
+	buf := make([]byte, verifyBlockSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, read, err
+		}
+		active := false
+		for i := range chunk {
+			active = active || same[i]
+		}
+		if !active {
+			return same, errs, read, nil
+		}
+
+		nr, rerr := io.ReadFull(rf, refBuf)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return nil, nil, read, rerr
+		}
+		round := nr
+		for i, f := range files {
+			if !same[i] {
+				continue
+			}
+			// Cùng size với ref (đã kiểm tra khi mở) nên hết ref cũng là hết file
+			n, ferr := io.ReadFull(f, buf[:nr])
+			round += n
+			if ferr != nil && ferr != io.EOF && ferr != io.ErrUnexpectedEOF {
+				same[i], errs[i] = false, ferr
+				continue
+			}
+			if n != nr || !bytes.Equal(buf[:n], refBuf[:nr]) {
+				same[i] = false
+			}
+		}
+		read += int64(round)
+		if err := wait(ctx, round); err != nil {
+			return nil, nil, read, err
+		}
+		if nr < len(refBuf) {
+			return same, errs, read, nil
+		}
+	}
+}
+
+// partitionByHash: chia nhóm theo hash độc lập algo của từng file
+func partitionByHash(ctx context.Context, members []dupMember, algo string, wait func(context.Context, int) error, out *verifyOutcome) error {
+	index := map[string]int{}
+	buf := make([]byte, verifyBlockSize)
+	for _, m := range members {
+		digest, n, err := hashMember(ctx, m, algo, buf, wait)
+		out.BytesRead += n
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			out.Unreadable = append(out.Unreadable, dupUnreadable{m, err})
+			continue
+		}
+		if i, ok := index[digest]; ok {
+			out.Classes[i] = append(out.Classes[i], m)
+			continue
+		}
+		index[digest] = len(out.Classes)
+		out.Classes = append(out.Classes, []dupMember{m})
+	}
+	return nil
+}
+
+func hashMember(ctx context.Context, m dupMember, algo string, buf []byte, wait func(context.Context, int) error) (string, int64, error) {
+	f, err := openMember(m)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h, err := newHasher(algo)
+	if err != nil {
+		return "", 0, err
+	}
+	var read int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", read, err
+		}
+		n, err := f.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			read += int64(n)
+			if werr := wait(ctx, n); werr != nil {
+				return "", read, werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", read, err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), read, nil
+}
+
+// applyVerifiedGroup ghi kết quả xác minh của một nhóm trong tx: ghi dup_class của từng file, đánh dấu is_duplicate
+// và verified_at cho mọi lớp từ 2 file, ghi duplicate_groups (mỗi lớp một dòng, verified_at) và hash_collisions
+// nếu nhóm bị tách. Trả về các lớp đã đánh dấu.
+func applyVerifiedGroup(ctx context.Context, tx *sql.Tx, algo sql.NullString, hashValue string, firstSeen time.Time, out verifyOutcome, now time.Time) ([][]dupMember, error) {
+	if out.Split() {
+		stmt, err := tx.PrepareContext(ctx, `
+			INSERT INTO hash_collisions (detected_at, hash_algo, hash_value, verify_mode, class, file_id, path)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`)
+		if err != nil {
+			return nil, err
+		}
+		defer stmt.Close()
+		for class, members := range out.Classes {
+			for _, m := range members {
+				if _, err := stmt.ExecContext(ctx, now, algo, hashValue, out.Mode, class, m.ID, m.Path); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var kept [][]dupMember
+	for class, members := range out.Classes {
+		if len(members) == 0 {
+			continue
+		}
+		var dupClass any // NULL khi nhóm chỉ có một lớp
+		if len(out.Classes) > 1 {
+			dupClass = class
+		}
+		set, args := `dup_class = ?`, []any{dupClass}
+		if len(members) >= 2 {
+			// Nhóm đã xác minh trước đó giữ verified_at cũ
+			if out.Skipped {
+				set += `, is_duplicate = 1, verified_at = COALESCE(verified_at, ?)`
+			} else {
+				set += `, is_duplicate = 1, verified_at = ?`
+			}
+			args = append(args, now)
+		}
+		var total int64
+		for _, m := range members {
+			args = append(args, m.ID)
+			total += m.Size
+		}
+		q := fmt.Sprintf(`UPDATE fs_files SET %s WHERE id IN (%s)`, set, strings.TrimRight(strings.Repeat("?,", len(members)), ","))
+		if _, err := tx.ExecContext(ctx, q, args...); err != nil {
+			return nil, err
+		}
+		if len(members) < 2 {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO duplicate_groups (hash_value, class, hash_algo, file_count, total_size, first_seen, last_updated, verified_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(hash_value, class) DO UPDATE SET
+			  hash_algo = excluded.hash_algo,
+			  file_count = excluded.file_count,
+			  total_size = excluded.total_size,
+			  first_seen = excluded.first_seen,
+			  last_updated = excluded.last_updated,
+			  verified_at = excluded.verified_at
+		`, hashValue, class, algo, len(members), total, firstSeen, now, now); err != nil {
+			return nil, err
+		}
+		kept = append(kept, members)
+	}
+	return kept, nil
+}
+
+// collisionPaths: đường dẫn theo lớp, để log nhóm bị tách
+func collisionPaths(out verifyOutcome) [][]string {
+	paths := make([][]string, len(out.Classes))
+	for i, c := range out.Classes {
+		for _, m := range c {
+			paths[i] = append(paths[i], m.Path)
+		}
+	}
+	return paths
+}
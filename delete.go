@@ -87,8 +87,9 @@ func configureDB(db *sql.DB, phase string, workers int) {
 	}
 }
 
-// deleteWithOptimizedQueries performs deletion with optimized database queries
-func deleteWithOptimizedQueries(ctx context.Context, db *sql.DB, cleanPath string) (foldersDeleted, filesDeleted int64, err error) {
+// deleteWithOptimizedQueries performs deletion with optimized database queries.
+// affected: các thư mục còn lại chứa phần bị xoá, cần cập nhật lại tổng hợp size/number_files.
+func deleteWithOptimizedQueries(ctx context.Context, db *sql.DB, cleanPath string) (foldersDeleted, filesDeleted int64, affected []int64, err error) {
 	// Prepare LIKE pattern for subdirectory matching
 	likePath := cleanPath
 	if !strings.HasSuffix(likePath, "/") {
@@ -99,7 +100,7 @@ func deleteWithOptimizedQueries(ctx context.Context, db *sql.DB, cleanPath strin
 	// Use transaction for atomic operations
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to start transaction: %w", err)
+		return 0, 0, nil, fmt.Errorf("failed to start transaction: %w", err)
 	}
 	defer func() {
 		if err != nil {
@@ -107,6 +108,12 @@ func deleteWithOptimizedQueries(ctx context.Context, db *sql.DB, cleanPath strin
 		}
 	}()
 
+	// Collect parent folders of everything in scope before deleting
+	affected, err = collectAffectedFolders(ctx, tx, cleanPath, likePath)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to collect affected folders: %w", err)
+	}
+
 	// Delete files using optimized query with proper indexes
 	fileResult, err := tx.ExecContext(ctx, `
 		DELETE FROM fs_files
@@ -116,26 +123,72 @@ func deleteWithOptimizedQueries(ctx context.Context, db *sql.DB, cleanPath strin
 		   OR path LIKE ?`,
 		cleanPath, cleanPath, likePath, likePath)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to delete from fs_files: %w", err)
+		return 0, 0, nil, fmt.Errorf("failed to delete from fs_files: %w", err)
 	}
 	filesDeleted, _ = fileResult.RowsAffected()
 
+	// Symlink/socket/device entries in scope
+	if _, err = tx.ExecContext(ctx, `
+		DELETE FROM fs_special
+		WHERE path = ? OR dir_path = ? OR dir_path LIKE ?`,
+		cleanPath, cleanPath, likePath); err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to delete from fs_special: %w", err)
+	}
+
 	// Delete folders using optimized query
 	folderResult, err := tx.ExecContext(ctx, `
 		DELETE FROM fs_folders
 		WHERE path = ? OR path LIKE ?`,
 		cleanPath, likePath)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to delete from fs_folders: %w", err)
+		return 0, 0, nil, fmt.Errorf("failed to delete from fs_folders: %w", err)
 	}
 	foldersDeleted, _ = folderResult.RowsAffected()
 
 	// Commit the transaction
-	if err := tx.Commit(); err != nil {
-		return 0, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	if err = tx.Commit(); err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return foldersDeleted, filesDeleted, nil
+	return foldersDeleted, filesDeleted, affected, nil
+}
+
+// collectAffectedFolders returns folder IDs whose direct or subtree totals change when the scope is deleted
+func collectAffectedFolders(ctx context.Context, tx *sql.Tx, cleanPath, likePath string) ([]int64, error) {
+	queries := []struct {
+		q    string
+		args []any
+	}{
+		{`SELECT DISTINCT folder_id FROM fs_files WHERE path = ? OR dir_path = ? OR dir_path LIKE ? OR path LIKE ?`,
+			[]any{cleanPath, cleanPath, likePath, likePath}},
+		{`SELECT DISTINCT parent_id FROM fs_folders WHERE (path = ? OR path LIKE ?) AND parent_id IS NOT NULL`,
+			[]any{cleanPath, likePath}},
+	}
+
+	seen := map[int64]struct{}{}
+	var ids []int64
+	for _, q := range queries {
+		rows, err := tx.QueryContext(ctx, q.q, q.args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
 }
 
 // validateDeletePath performs safety checks before deletion
@@ -214,7 +267,7 @@ func deleteByConditions(ctx context.Context, db *sql.DB, logger *logrus.Logger,
 	}
 
 	query := fmt.Sprintf(`
-		SELECT id, path
+		SELECT id, path, folder_id
 		FROM fs_files
 		WHERE %s
 		ORDER BY id
@@ -231,11 +284,16 @@ func deleteByConditions(ctx context.Context, db *sql.DB, logger *logrus.Logger,
 	defer rows.Close()
 
 	type idPath struct {
-		id   int64
-		path string
+		id       int64
+		path     string
+		folderID int64
 	}
 	const commitBatch = 1000
 	batch := make([]idPath, 0, commitBatch)
+	affected := map[int64]struct{}{} // folders needing aggregate refresh
+
+	// Batch đang xoá dở vẫn được commit khi nhận SIGINT/SIGTERM để file trên đĩa và DB khớp nhau
+	writeCtx := context.WithoutCancel(ctx)
 
 	flush := func() error {
 		if len(batch) == 0 {
@@ -248,13 +306,13 @@ func deleteByConditions(ctx context.Context, db *sql.DB, logger *logrus.Logger,
 			return nil
 		}
 
-		tx, err := db.BeginTx(ctx, nil)
+		tx, err := db.BeginTx(writeCtx, nil)
 		if err != nil {
 			return err
 		}
 		defer tx.Rollback()
 
-		delStmt, err := tx.PrepareContext(ctx, `DELETE FROM fs_files WHERE id = ?`)
+		delStmt, err := tx.PrepareContext(writeCtx, `DELETE FROM fs_files WHERE id = ?`)
 		if err != nil {
 			return err
 		}
@@ -279,7 +337,7 @@ func deleteByConditions(ctx context.Context, db *sql.DB, logger *logrus.Logger,
 				}
 			}
 
-			if _, err := delStmt.ExecContext(ctx, it.id); err != nil {
+			if _, err := delStmt.ExecContext(writeCtx, it.id); err != nil {
 				errCount++
 				logger.WithFields(logrus.Fields{
 					"id":    it.id,
@@ -289,6 +347,7 @@ func deleteByConditions(ctx context.Context, db *sql.DB, logger *logrus.Logger,
 				continue
 			}
 			dbDeleted++
+			affected[it.folderID] = struct{}{}
 		}
 
 		if err := tx.Commit(); err != nil {
@@ -299,29 +358,47 @@ func deleteByConditions(ctx context.Context, db *sql.DB, logger *logrus.Logger,
 	}
 
 	for rows.Next() {
-		var id int64
+		var id, folderID int64
 		var p string
-		if err := rows.Scan(&id, &p); err != nil {
+		if err := rows.Scan(&id, &p, &folderID); err != nil {
 			errCount++
 			logger.WithError(err).Warn("Failed to scan fs_files row")
 			continue
 		}
 		out.WriteRecord("file", strconv.FormatInt(id, 10), p)
-		batch = append(batch, idPath{id: id, path: p})
+		batch = append(batch, idPath{id: id, path: p, folderID: folderID})
 		if len(batch) >= commitBatch {
 			if err := flush(); err != nil {
 				return dbDeleted, diskDeleted, errCount, err
 			}
 		}
 	}
-	if err := rows.Err(); err != nil {
-		return dbDeleted, diskDeleted, errCount, err
+	// Bị huỷ giữa chừng: bỏ batch chưa xử lý, nhưng vẫn cập nhật tổng hợp cho phần đã xoá
+	iterErr := rows.Err()
+	if iterErr != nil && ctx.Err() == nil {
+		return dbDeleted, diskDeleted, errCount, iterErr
 	}
-	if err := flush(); err != nil {
-		return dbDeleted, diskDeleted, errCount, err
+	if iterErr == nil {
+		if err := flush(); err != nil {
+			return dbDeleted, diskDeleted, errCount, err
+		}
 	}
+	rows.Close()
 
-	return dbDeleted, diskDeleted, errCount, nil
+	// Keep fs_folders size/number_files/subtree_* consistent with the remaining rows
+	if len(affected) > 0 {
+		ids := make([]int64, 0, len(affected))
+		for id := range affected {
+			ids = append(ids, id)
+		}
+		if n, err := refreshFolderAggregates(writeCtx, db, ids); err != nil {
+			logger.WithError(err).Warn("Failed to refresh folder aggregates")
+		} else {
+			logger.WithField("folders", n).Debug("Folder aggregates refreshed")
+		}
+	}
+
+	return dbDeleted, diskDeleted, errCount, iterErr
 }
 
 func exportPathModeList(ctx context.Context, db *sql.DB, scopePath string, out *listWriter) (int64, int64, error) {
@@ -473,13 +550,27 @@ func main() {
 	// Configure database for optimal deletion performance
 	configureDB(db, "delete", 1)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	sigCtx, stop := notifyShutdown(context.Background(), func(sig os.Signal) {
+		logger.WithField("signal", sig.String()).Warn("Shutdown requested, finishing current batch")
+	})
+	defer stop()
+	ctx, cancel := context.WithTimeout(sigCtx, 10*time.Minute)
 	defer cancel()
 
 	// FILTER MODE: delete by conditions within scopePath
 	if useFilter {
 		startTime := time.Now()
 		dbDeleted, diskDeleted, errCount, err := deleteByConditions(ctx, db, logger, cleanPath, filter, *deleteDisk, *dryRun, *limit, out)
+		if err != nil && sigCtx.Err() != nil {
+			logger.WithFields(logrus.Fields{
+				"dbDeleted":   dbDeleted,
+				"diskDeleted": diskDeleted,
+				"errors":      errCount,
+			}).Warn("Filter deletion interrupted; committed batches are kept")
+			out.Close()
+			db.Close()
+			os.Exit(exitInterrupted)
+		}
 		if err != nil {
 			logger.WithError(err).Fatal("Filter deletion failed")
 		}
@@ -534,11 +625,24 @@ func main() {
 
 	// Perform deletion with optimized queries
 	startTime := time.Now()
-	foldersDeleted, filesDeleted, err := deleteWithOptimizedQueries(ctx, db, cleanPath)
+	foldersDeleted, filesDeleted, affected, err := deleteWithOptimizedQueries(ctx, db, cleanPath)
+	if err != nil && sigCtx.Err() != nil {
+		logger.Warn("Deletion interrupted; transaction rolled back, nothing was deleted")
+		out.Close()
+		db.Close()
+		os.Exit(exitInterrupted)
+	}
 	if err != nil {
 		logger.WithError(err).Fatal("Deletion failed")
 	}
 
+	// Keep fs_folders size/number_files/subtree_* consistent after removing rows
+	if n, err := refreshFolderAggregates(ctx, db, affected); err != nil {
+		logger.WithError(err).Warn("Failed to refresh folder aggregates")
+	} else {
+		logger.WithField("folders", n).Debug("Folder aggregates refreshed")
+	}
+
 	duration := time.Since(startTime)
 
 	// Log success with detailed metrics
@@ -614,6 +718,14 @@ func mainLegacy() {
 	}
 	totalFiles, _ = resFile.RowsAffected()
 
+	// Xóa symlink/socket/device nằm trong phạm vi
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM fs_special
+		WHERE path = ? OR dir_path = ? OR dir_path LIKE ?`,
+		cleanPath, cleanPath, likePath); err != nil {
+		log.Fatalf("Failed to delete from fs_special: %v", err)
+	}
+
 	// Xóa (hard-delete) các thư mục
 	resFolder, err := tx.ExecContext(ctx, `
 		DELETE FROM fs_folders
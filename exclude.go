@@ -0,0 +1,355 @@
+// exclude.go
+//go:build scanner
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Luật loại trừ của scanner ([exclude], [exclude.<Tag>], SCANDIR_EXCLUDE_PATTERNS). Cú pháp một mẫu:
+//
+//	*.tmp, Thumbs.db   glob trên tên file/thư mục ở mọi cấp
+//	/share/X/Backup/*  glob trên đường dẫn tuyệt đối
+//	./Backup/old       glob trên đường dẫn tương đối so với root (mẫu có '/' ở giữa cũng hiểu là tương đối)
+//	re:\.bak$          regex trên đường dẫn tuyệt đối
+//	mẫu kết thúc '/'   chỉ áp dụng cho thư mục
+//
+// EXCLUDE_DIRS (tên thư mục chính xác) giữ nguyên ý nghĩa cũ, được ghi thành luật kind=dirname.
+type excludeRule struct {
+	RowID   int64  // id trong scan_excludes (0 = chưa ghi DB)
+	Scope   string // global hoặc tag của root
+	Kind    string // dirname|name|path|rel|regex
+	Pattern string // nguyên văn trong cấu hình
+
+	dirOnly bool
+	glob    string
+	re      *regexp.Regexp
+	hits    atomic.Int64
+}
+
+// parseExcludeRule dịch một mẫu trong cấu hình thành luật, báo lỗi nếu glob/regex sai cú pháp
+func parseExcludeRule(scope, pattern string) (*excludeRule, error) {
+	r := &excludeRule{Scope: scope, Pattern: pattern}
+	p := strings.TrimSpace(pattern)
+
+	if expr, ok := strings.CutPrefix(p, "re:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("exclude pattern %q: %w", pattern, err)
+		}
+		r.Kind, r.re = "regex", re
+		return r, nil
+	}
+
+	abs := filepath.IsAbs(p)
+	p = filepath.ToSlash(p)
+	if len(p) > 1 && strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	switch {
+	case abs || strings.HasPrefix(p, "/"):
+		r.Kind = "path"
+		p = path.Clean(p)
+	case strings.Contains(p, "/"):
+		r.Kind = "rel"
+		p = path.Clean(p) // bỏ "./" ở đầu
+	default:
+		r.Kind = "name"
+	}
+	if _, err := path.Match(p, ""); err != nil {
+		return nil, fmt.Errorf("exclude pattern %q: %w", pattern, err)
+	}
+	r.glob = p
+	return r, nil
+}
+
+// excludeMatcher: tập luật có hiệu lực cho một root (EXCLUDE_DIRS + [exclude] + [exclude.<Tag>])
+type excludeMatcher struct {
+	root     string // đường dẫn tuyệt đối của root, dạng '/'
+	dirNames map[string]*excludeRule
+	rules    []*excludeRule // luật dirname đứng đầu
+
+	mu          sync.Mutex
+	scanIgnores []*scanIgnore // các file .scanignore đã đọc trong root
+}
+
+// newExcludeMatcher dựng tập luật cho root absRoot có tag tag
+func newExcludeMatcher(cfg *Config, absRoot, tag string) (*excludeMatcher, error) {
+	m := &excludeMatcher{
+		root:     strings.TrimRight(filepath.ToSlash(absRoot), "/"),
+		dirNames: make(map[string]*excludeRule, len(cfg.Exclude)),
+	}
+
+	names := make([]string, 0, len(cfg.Exclude))
+	for n := range cfg.Exclude {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		r := &excludeRule{Scope: "global", Kind: "dirname", Pattern: n, dirOnly: true}
+		m.dirNames[n] = r
+		m.rules = append(m.rules, r)
+	}
+
+	add := func(scope string, patterns []string) error {
+		for _, p := range patterns {
+			r, err := parseExcludeRule(scope, p)
+			if err != nil {
+				return err
+			}
+			m.rules = append(m.rules, r)
+		}
+		return nil
+	}
+	if err := add("global", cfg.ExcludePatterns); err != nil {
+		return nil, err
+	}
+	if err := add(tag, cfg.RootExcludePatterns[tag]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// match trả về luật đầu tiên loại trừ entry p (đường dẫn tuyệt đối, tên name), nil nếu giữ lại.
+// An toàn khi gọi đồng thời từ nhiều worker.
+func (m *excludeMatcher) match(p, name string, isDir bool) *excludeRule {
+	if isDir {
+		if r, ok := m.dirNames[name]; ok {
+			r.hits.Add(1)
+			return r
+		}
+	}
+	if len(m.rules) == len(m.dirNames) {
+		return nil
+	}
+
+	sp := filepath.ToSlash(p)
+	for _, r := range m.rules[len(m.dirNames):] {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		var ok bool
+		switch r.Kind {
+		case "name":
+			ok, _ = path.Match(r.glob, name)
+		case "path":
+			ok, _ = path.Match(r.glob, sp)
+		case "rel":
+			ok, _ = path.Match(r.glob, strings.TrimPrefix(strings.TrimPrefix(sp, m.root), "/"))
+		case "regex":
+			ok = r.re.MatchString(sp)
+		}
+		if ok {
+			r.hits.Add(1)
+			return r
+		}
+	}
+	return nil
+}
+
+// hits: số entry bị loại trừ theo từng luật đã ghi DB (scan_excludes.id -> hits)
+func (m *excludeMatcher) hits() map[int64]int64 {
+	out := make(map[int64]int64, len(m.rules))
+	for _, r := range m.rules {
+		if r.RowID > 0 {
+			out[r.RowID] = r.hits.Load()
+		}
+	}
+	return out
+}
+
+// scanIgnoreName: file mẫu loại trừ kiểu .gitignore, áp dụng cho thư mục chứa nó và toàn bộ cây con
+const scanIgnoreName = ".scanignore"
+
+// ignorePattern: một dòng của .scanignore
+type ignorePattern struct {
+	re      *regexp.Regexp // khớp đường dẫn tương đối so với thư mục chứa .scanignore
+	negate  bool           // "!pattern": giữ lại entry đã bị mẫu trước loại trừ
+	dirOnly bool           // "pattern/": chỉ áp dụng cho thư mục
+}
+
+// scanIgnore: một file .scanignore đã đọc, nối với file của thư mục cha gần nhất
+type scanIgnore struct {
+	parent   *scanIgnore
+	dir      string // thư mục chứa file, dạng '/' không có '/' cuối
+	file     string
+	patterns []ignorePattern
+	hits     atomic.Int64
+}
+
+// loadScanIgnore đọc dir/.scanignore (nếu có) và trả về chuỗi .scanignore áp dụng cho dir.
+// Không có file hoặc file rỗng thì trả về parent.
+func (m *excludeMatcher) loadScanIgnore(dir string, parent *scanIgnore) *scanIgnore {
+	file := filepath.Join(dir, scanIgnoreName)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("WARN: cannot read %s: %v", file, err)
+		}
+		return parent
+	}
+	patterns := parseScanIgnore(file, data)
+	if len(patterns) == 0 {
+		return parent
+	}
+
+	si := &scanIgnore{
+		parent:   parent,
+		dir:      strings.TrimRight(filepath.ToSlash(dir), "/"),
+		file:     file,
+		patterns: patterns,
+	}
+	m.mu.Lock()
+	m.scanIgnores = append(m.scanIgnores, si)
+	m.mu.Unlock()
+	return si
+}
+
+// match áp dụng chuỗi .scanignore cho entry p theo quy tắc gitignore: file ở thư mục sâu hơn
+// và dòng viết sau được ưu tiên; dòng "!" khớp trước thì entry được giữ lại.
+func (si *scanIgnore) match(p string, isDir bool) bool {
+	sp := filepath.ToSlash(p)
+	for n := si; n != nil; n = n.parent {
+		rel := strings.TrimPrefix(sp, n.dir+"/")
+		for i := len(n.patterns) - 1; i >= 0; i-- {
+			pt := n.patterns[i]
+			if pt.dirOnly && !isDir {
+				continue
+			}
+			if !pt.re.MatchString(rel) {
+				continue
+			}
+			if pt.negate {
+				return false
+			}
+			n.hits.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+// scanIgnoreStats: các file .scanignore đã áp dụng trong root và số entry mỗi file loại trừ
+func (m *excludeMatcher) scanIgnoreStats() []ScanIgnoreStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]ScanIgnoreStat, 0, len(m.scanIgnores))
+	for _, si := range m.scanIgnores {
+		out = append(out, ScanIgnoreStat{Path: si.file, Rules: len(si.patterns), Hits: si.hits.Load()})
+	}
+	return out
+}
+
+// parseScanIgnore đọc nội dung .scanignore: bỏ dòng trống/comment '#', hỗ trợ '!', '/' cuối, '/' đầu, '**'.
+// Dòng sai cú pháp bị bỏ qua kèm cảnh báo.
+func parseScanIgnore(file string, data []byte) []ignorePattern {
+	var out []ignorePattern
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if !strings.HasSuffix(line, "\\ ") {
+			line = strings.TrimRight(line, " \t")
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var pt ignorePattern
+		switch {
+		case line[0] == '!':
+			pt.negate = true
+			line = line[1:]
+		case strings.HasPrefix(line, "\\!"), strings.HasPrefix(line, "\\#"):
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pt.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		re, err := gitignoreRegexp(line)
+		if err != nil {
+			log.Printf("WARN: %s:%d: invalid pattern %q: %v", file, lineNo, line, err)
+			continue
+		}
+		pt.re = re
+		out = append(out, pt)
+	}
+	return out
+}
+
+// gitignoreRegexp dịch một mẫu gitignore thành regex trên đường dẫn tương đối.
+// Mẫu không có '/' khớp tên ở mọi cấp; có '/' thì neo vào thư mục chứa .scanignore.
+func gitignoreRegexp(pat string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(pat, "/")
+	pat = strings.TrimPrefix(pat, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pat); i++ {
+		c := pat[i]
+		switch c {
+		case '*':
+			if i+1 < len(pat) && pat[i+1] == '*' && (i == 0 || pat[i-1] == '/') {
+				switch {
+				case i+2 == len(pat): // "foo/**": mọi thứ bên trong
+					b.WriteString(".*")
+					i++
+					continue
+				case pat[i+2] == '/': // "**/": không hoặc nhiều cấp thư mục
+					b.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				}
+			}
+			b.WriteString("[^/]*")
+			for i+1 < len(pat) && pat[i+1] == '*' {
+				i++
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pat[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pat[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pat) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,156 @@
+// exclude_test.go
+//go:build scanner
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGitignoreRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{"*.tmp", []string{"a.tmp", "x/y/a.tmp", ".tmp"}, []string{"a.tmpx", "a.tmp/b"}},
+		{"Thumbs.db", []string{"Thumbs.db", "x/Thumbs.db"}, []string{"xThumbs.db", "Thumbs.dbx"}},
+		{"/build", []string{"build"}, []string{"x/build", "builds"}},
+		{"a/b", []string{"a/b"}, []string{"x/a/b", "a/b/c"}},
+		{"**/foo", []string{"foo", "x/foo", "x/y/foo"}, []string{"xfoo", "foo/x"}},
+		{"foo/**", []string{"foo/a", "foo/a/b"}, []string{"foo", "x/foo/a"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"a/xb", "x/a/b"}},
+		{"a*b", []string{"ab", "axxb", "x/ab"}, []string{"a/b"}},
+		{"?.md", []string{"a.md", "x/b.md"}, []string{"ab.md", ".md"}},
+		{"[abc].txt", []string{"a.txt", "x/c.txt"}, []string{"d.txt", "ab.txt"}},
+		{"[!a]x", []string{"bx"}, []string{"ax", "x"}},
+		{"[0-9]*.log", []string{"1.log", "9abc.log"}, []string{"a1.log"}},
+		{"[a", []string{"[a", "x/[a"}, []string{"a"}},
+		{`\*x`, []string{"*x"}, []string{"ax"}},
+		{`\#notes`, []string{"#notes"}, []string{"notes"}},
+		{"a.b", []string{"a.b"}, []string{"axb"}},
+	}
+	for _, tt := range tests {
+		re, err := gitignoreRegexp(tt.pattern)
+		if err != nil {
+			t.Errorf("gitignoreRegexp(%q): %v", tt.pattern, err)
+			continue
+		}
+		for _, p := range tt.match {
+			if !re.MatchString(p) {
+				t.Errorf("gitignoreRegexp(%q) = %s: want match %q", tt.pattern, re, p)
+			}
+		}
+		for _, p := range tt.noMatch {
+			if re.MatchString(p) {
+				t.Errorf("gitignoreRegexp(%q) = %s: want no match %q", tt.pattern, re, p)
+			}
+		}
+	}
+}
+
+func TestParseScanIgnore(t *testing.T) {
+	type want struct {
+		sample  string // đường dẫn tương đối mẫu phải khớp
+		negate  bool
+		dirOnly bool
+	}
+	tests := []struct {
+		name string
+		data string
+		want []want
+	}{
+		{"comment and blank", "# comment\n\n   \n*.tmp\n", []want{{"a.tmp", false, false}}},
+		{"negation", "*.tmp\n!keep.tmp\n", []want{{"a.tmp", false, false}, {"keep.tmp", true, false}}},
+		{"escaped hash and bang", "\\#notes\n\\!important\n", []want{{"#notes", false, false}, {"!important", false, false}}},
+		{"dir only", "render_cache/\n!cache/\n", []want{{"x/render_cache", false, true}, {"cache", true, true}}},
+		{"crlf and trailing spaces", "*.bak  \r\n/build\t\r\n", []want{{"a.bak", false, false}, {"build", false, false}}},
+		{"escaped trailing space", "name\\ \n", []want{{"name ", false, false}}},
+		{"double star", "**/node_modules/\nlogs/**\n", []want{{"a/b/node_modules", false, true}, {"logs/x/y", false, false}}},
+		{"empty after markers", "!\n/\n!/\n", nil},
+		{"invalid pattern skipped", "[z-a]\n*.ok\n", []want{{"a.ok", false, false}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseScanIgnore("test/.scanignore", []byte(tt.data))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d patterns, want %d", len(got), len(tt.want))
+			}
+			for i, w := range tt.want {
+				if got[i].negate != w.negate || got[i].dirOnly != w.dirOnly {
+					t.Errorf("pattern %d: negate=%v dirOnly=%v, want %v %v", i, got[i].negate, got[i].dirOnly, w.negate, w.dirOnly)
+				}
+				if !got[i].re.MatchString(w.sample) {
+					t.Errorf("pattern %d (%s): want match %q", i, got[i].re, w.sample)
+				}
+			}
+		})
+	}
+}
+
+func TestScanIgnoreMatch(t *testing.T) {
+	root := &scanIgnore{dir: "/r", patterns: parseScanIgnore("/r/.scanignore", []byte("*.tmp\nbuild/\n"))}
+	sub := &scanIgnore{parent: root, dir: "/r/a", patterns: parseScanIgnore("/r/a/.scanignore", []byte("!keep.tmp\n"))}
+	tests := []struct {
+		si    *scanIgnore
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{root, "/r/x.tmp", false, true},
+		{root, "/r/b/x.tmp", false, true},
+		{root, "/r/build", true, true},
+		{root, "/r/build", false, false}, // "build/" chỉ khớp thư mục
+		{root, "/r/x.txt", false, false},
+		{sub, "/r/a/keep.tmp", false, false}, // file sâu hơn được ưu tiên
+		{sub, "/r/a/other.tmp", false, true},
+	}
+	for _, tt := range tests {
+		if got := tt.si.match(filepath.FromSlash(tt.path), tt.isDir); got != tt.want {
+			t.Errorf("match(%q, dir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestParseExcludeRule(t *testing.T) {
+	tests := []struct {
+		pattern string
+		kind    string
+		glob    string
+		dirOnly bool
+		wantErr bool
+	}{
+		{"*.tmp", "name", "*.tmp", false, false},
+		{"  Thumbs.db  ", "name", "Thumbs.db", false, false},
+		{"cache/", "name", "cache", true, false},
+		{"/share/X/Backup/*", "path", "/share/X/Backup/*", false, false},
+		{"/share/X//old/", "path", "/share/X/old", true, false},
+		{"./Backup/old", "rel", "Backup/old", false, false},
+		{"Backup/old/", "rel", "Backup/old", true, false},
+		{"re:\\.bak$", "regex", "", false, false},
+		{"re:(", "", "", false, true},
+		{"[z-", "", "", false, true},
+		{"/", "path", "/", false, false},
+	}
+	for _, tt := range tests {
+		r, err := parseExcludeRule("global", tt.pattern)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseExcludeRule(%q): want error, got %+v", tt.pattern, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseExcludeRule(%q): %v", tt.pattern, err)
+			continue
+		}
+		if r.Kind != tt.kind || r.glob != tt.glob || r.dirOnly != tt.dirOnly {
+			t.Errorf("parseExcludeRule(%q) = kind %q glob %q dirOnly %v, want %q %q %v",
+				tt.pattern, r.Kind, r.glob, r.dirOnly, tt.kind, tt.glob, tt.dirOnly)
+		}
+		if r.Pattern != tt.pattern || r.Scope != "global" {
+			t.Errorf("parseExcludeRule(%q): Pattern %q Scope %q not kept", tt.pattern, r.Pattern, r.Scope)
+		}
+	}
+}
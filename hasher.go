@@ -0,0 +1,222 @@
+// hasher.go
+//go:build hasher
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Chạy riêng Phase 2 (hash các file nghi trùng) trên DB đã quét. Chỉ file có
+// hash_value IS NULL được hash, nên chạy lại sau khi bị ngắt sẽ tiếp tục từ chỗ dừng.
+// Hash của thuật toán khác -algo (DB cũ: MD5) được hash lại theo -rehash.
+// -mode catalog hash mọi file (hoặc tập con theo -catalog-tags/-catalog-ext) để có hash đầy đủ làm mốc toàn vẹn.
+// Cấu hình hash lấy theo hasherConfig, cờ dòng lệnh chỉ ghi đè khi được truyền.
+func main() {
+	dbFile := flag.String("dbfile", "", "Path to the scan.db file (e.g., ./output_scans/scan_....db)")
+	configPath := flag.String("config", "", "config.ini to take hash settings from (default: the configuration snapshot of the latest scan in -dbfile)")
+	workers := flag.Int("workers", 4, "Number of parallel hash workers")
+	tags := flag.String("tags", "", "Only hash files with these loaithumuc tags, comma-separated (e.g. SharePhong,ShareCaNhan)")
+	prefixes := flag.String("prefix", "", "Only hash files under these folders, comma-separated absolute paths")
+	minSize := flag.Int64("min-size", 0, "Only hash files with size >= this many bytes")
+	adaptive := flag.Bool("adaptive", true, "Resize the running worker pool from system CPU/iowait/memory load (up to -max-workers)")
+	maxWorkers := flag.Int("max-workers", 0, "Upper bound for adaptive hash workers (0 = 2 x -workers)")
+	bwlimit := flag.String("bwlimit", "0", "Read bandwidth limit, e.g. 20M or 500K (bytes/s; 0 = unlimited)")
+	iops := flag.Int("iops", 0, "Read operations per second (0 = unlimited)")
+	controlFile := flag.String("control-file", "", "Control file polled while hashing: PAUSE = true/false, HASH_BWLIMIT, HASH_IOPS")
+	deviceWorkers := flag.Int("device-workers", 0, "Max readers per device (st_dev) at once, e.g. 1 for spindle-backed volumes (0 = no per-device limit)")
+	tagDeviceWorkers := flag.String("device-workers-by-tag", "", "Per-root device readers as Tag=N,Tag2=M (overrides -device-workers for the volume of that root)")
+	order := flag.String("order", "inode", "Read order within a device: inode or path")
+	algo := flag.String("algo", defaultHashAlgo, "Hash algorithm: "+strings.Join(hashAlgos, ", ")+" (xxh64 is fast but not cryptographic)")
+	rehash := flag.String("rehash", "lazy", "Rehash rows hashed with another algorithm: lazy (only when compared with new files) or all")
+	mode := flag.String("mode", "suspects", "suspects: hash only files sharing a size with another file; catalog: hash every file (integrity baseline)")
+	catalogTags := flag.String("catalog-tags", "", "Catalog mode: only hash all files of these loaithumuc tags, comma-separated (other files: suspects only)")
+	catalogExts := flag.String("catalog-ext", "", "Catalog mode: only hash all files with these extensions, comma-separated (e.g. pdf,docx)")
+	cache := flag.Bool("cache", true, "Reuse hashes of unchanged files from the persistent hash cache and store new ones in it")
+	cacheFile := flag.String("cache-file", "", "Persistent hash cache database (default hash_cache.db next to -dbfile, as used by scanner)")
+	cacheMaxAge := flag.Int("cache-max-age", 90, "Drop cache rows not refreshed for this many days (0 = keep forever)")
+	verify := flag.String("verify", "off", "Verify duplicate groups before marking: off, bytes (byte-by-byte) or hash (second independent hash)")
+	partial := flag.Bool("partial", true, "Hash head/middle/tail samples first, fully hash only files whose samples still collide")
+	partialMin := flag.Int64("partial-min-size", 1<<20, "Files up to this many bytes skip the partial stage and are fully hashed")
+	verbose := flag.Bool("verbose", false, "Enable verbose logging")
+	flag.Parse()
+
+	if *dbFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := NewScannerLogger()
+	if *verbose {
+		logger.logger.SetLevel(logrus.DebugLevel)
+	}
+	if _, err := os.Stat(*dbFile); err != nil {
+		logger.logger.Fatalf("Scan database not found: %v", err)
+	}
+
+	db, err := openDBSQLite(*dbFile)
+	if err != nil {
+		logger.logger.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg, err := hasherConfig(context.Background(), db, *configPath, *dbFile)
+	if err != nil {
+		logger.logger.Fatalf("Failed to load configuration: %v", err)
+	}
+	// Cờ dòng lệnh chỉ ghi đè khi được truyền (giá trị mặc định của cờ không che cấu hình/snapshot)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "workers":
+			cfg.MaxWorkers = *workers
+		case "adaptive":
+			cfg.Adaptive = *adaptive
+		case "max-workers":
+			cfg.AdaptiveMaxWorkers = *maxWorkers
+		case "bwlimit":
+			bps, err := parseByteRate(*bwlimit)
+			if err != nil {
+				logger.logger.Fatalf("Invalid -bwlimit: %v", err)
+			}
+			cfg.HashBandwidth = bps
+		case "iops":
+			cfg.HashIOPS = *iops
+		case "control-file":
+			cfg.HashControlFile = *controlFile
+		case "device-workers":
+			cfg.HashDeviceWorkers = *deviceWorkers
+		case "device-workers-by-tag":
+			byTag := map[string]int{}
+			for _, kv := range splitNonEmpty(*tagDeviceWorkers, ",") {
+				tag, v, _ := strings.Cut(kv, "=")
+				n, err := strconv.Atoi(strings.TrimSpace(v))
+				if err != nil || n < 0 {
+					logger.logger.Fatalf("Invalid -device-workers-by-tag entry %q (want Tag=N)", kv)
+				}
+				byTag[strings.TrimSpace(tag)] = n
+			}
+			cfg.RootHashDeviceWorkers = byTag
+		case "order":
+			cfg.HashOrder = *order
+		case "algo":
+			cfg.HashAlgo = *algo
+		case "rehash":
+			cfg.HashRehash = *rehash
+		case "mode":
+			cfg.HashMode = *mode
+		case "catalog-tags":
+			cfg.HashCatalogTags = splitNonEmpty(*catalogTags, ",")
+		case "catalog-ext":
+			cfg.HashCatalogExtensions = splitNonEmpty(*catalogExts, ",")
+		case "cache":
+			cfg.HashCache = *cache
+		case "cache-file":
+			cfg.HashCacheFile = *cacheFile
+		case "cache-max-age":
+			cfg.HashCacheMaxAge = *cacheMaxAge
+		case "verify":
+			cfg.VerifyDuplicates = *verify
+		case "partial":
+			cfg.PartialHash = *partial
+		case "partial-min-size":
+			cfg.PartialHashMinSize = *partialMin
+		}
+	})
+	cfg.HashAlgo = strings.ToLower(cfg.HashAlgo)
+	cfg.HashMode = strings.ToLower(cfg.HashMode)
+	cfg.VerifyDuplicates = strings.ToLower(cfg.VerifyDuplicates)
+	cfg.HashCatalogExtensions = normalizeExtensions(cfg.HashCatalogExtensions)
+
+	if cfg.MaxWorkers <= 0 {
+		logger.logger.Fatal("workers must be > 0")
+	}
+	if cfg.HashOrder != "inode" && cfg.HashOrder != "path" {
+		logger.logger.Fatalf("Invalid -order %q (want inode or path)", cfg.HashOrder)
+	}
+	if !slices.Contains(hashAlgos, cfg.HashAlgo) {
+		logger.logger.Fatalf("Invalid -algo %q (want %s)", cfg.HashAlgo, strings.Join(hashAlgos, ", "))
+	}
+	if cfg.HashRehash != "lazy" && cfg.HashRehash != "all" {
+		logger.logger.Fatalf("Invalid -rehash %q (want lazy or all)", cfg.HashRehash)
+	}
+	if !slices.Contains(hashModes, cfg.HashMode) {
+		logger.logger.Fatalf("Invalid -mode %q (want %s)", cfg.HashMode, strings.Join(hashModes, ", "))
+	}
+	if !slices.Contains(verifyModes, cfg.VerifyDuplicates) {
+		logger.logger.Fatalf("Invalid -verify %q (want %s)", cfg.VerifyDuplicates, strings.Join(verifyModes, ", "))
+	}
+
+	scope := HashScope{
+		Tags:         splitNonEmpty(*tags, ","),
+		PathPrefixes: splitNonEmpty(*prefixes, ","),
+		MinSize:      *minSize,
+	}
+
+	ctx, cancel := notifyShutdown(context.Background(), func(sig os.Signal) {
+		logger.logger.WithField("signal", sig.String()).Warn("Shutdown requested, committing hashed files")
+	})
+	defer cancel()
+
+	start := time.Now()
+	logger.logger.WithFields(logrus.Fields{
+		"dbPath":  *dbFile,
+		"workers": cfg.MaxWorkers,
+		"algo":    cfg.HashAlgo,
+		"partial": cfg.PartialHash,
+		"cache":   cfg.HashCache,
+		"mode":    cfg.HashMode,
+	}).Info("Go Hasher (Phase 2 on existing scan DB) starting...")
+
+	dyn := NewDynamicConfig(cfg, 0, logger)
+	go dyn.Run(ctx)
+
+	runHashingPhaseOptimized(ctx, db, cfg, dyn, scope)
+	if ctx.Err() != nil {
+		logger.logger.WithField("dbPath", *dbFile).Warn("Hashing interrupted; run hasher again to continue")
+		db.Close()
+		os.Exit(exitInterrupted)
+	}
+
+	logger.logger.WithFields(logrus.Fields{
+		"dbPath":   *dbFile,
+		"duration": time.Since(start).Seconds(),
+	}).Info("Hashing completed")
+}
+
+// hasherConfig: cấu hình nền của hasher trước khi áp dụng cờ dòng lệnh. Có -config thì đọc config.ini như
+// scanner; không có thì dùng snapshot scan_runs.config của lần quét mới nhất trong DB, để Phase 2 chạy tiếp
+// với đúng HASH_ALGO, PARTIAL_HASH, HASH_CACHE... scanner đã dùng (cache mặc định cạnh dbFile). Biến môi
+// trường SCANDIR_* luôn được áp dụng sau cùng.
+func hasherConfig(ctx context.Context, db *sql.DB, configPath, dbFile string) (*Config, error) {
+	cfg, err := loadConfig(configPath)
+	if err != nil || configPath != "" {
+		return cfg, err
+	}
+	var snapshot sql.NullString
+	err = db.QueryRowContext(ctx, `SELECT config FROM scan_runs ORDER BY id DESC LIMIT 1`).Scan(&snapshot)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("query scan_runs: %w", err)
+	}
+	if snapshot.Valid {
+		if err := json.Unmarshal([]byte(snapshot.String), cfg); err != nil {
+			return nil, fmt.Errorf("parse scan_runs.config: %w", err)
+		}
+	}
+	cfg.HashCacheFile = filepath.Join(filepath.Dir(dbFile), hashCacheFileName)
+	if err := applyEnvOverrides(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
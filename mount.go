@@ -0,0 +1,97 @@
+// mount.go
+//go:build scanner
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mountOf: mount chứa đường dẫn p (mount point dài nhất là cha của p). Không có bảng mount
+// (Windows) thì dùng ký tự ổ/UNC share của p làm mount point.
+func mountOf(table map[string]MountInfo, p string) MountInfo {
+	for d := p; ; {
+		if m, ok := table[d]; ok {
+			return m
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+	return MountInfo{MountPoint: filepath.VolumeName(p)}
+}
+
+// realPath: đường dẫn p (nằm trong root) theo root đã resolve symlink, để tra bảng mount
+func (w *rootWalker) realPath(p string) string {
+	if w.root == w.realRoot {
+		return p
+	}
+	if rel, ok := strings.CutPrefix(p, w.root); ok {
+		return w.realRoot + rel
+	}
+	return p
+}
+
+// crossesMount: thư mục con p (stat inf) của j là mount point — có trong bảng mount (kể cả bind mount)
+// hoặc khác st_dev với thư mục cha
+func (w *rootWalker) crossesMount(j dirJob, p string, inf StatInfo) (MountInfo, bool) {
+	if m, ok := w.mounts[w.realPath(p)]; ok {
+		return m, true
+	}
+	if j.dev != 0 && inf.Device != j.dev {
+		return MountInfo{MountPoint: p}, true
+	}
+	return MountInfo{}, false
+}
+
+// recordMount ghi mount point p vào scan_mounts; descended = false khi ONE_FILESYSTEM bỏ qua nó
+func (w *rootWalker) recordMount(j dirJob, p string, inf StatInfo, m MountInfo, descended bool) {
+	w.mountPoints.Add(1)
+	if !descended {
+		w.skippedMounts.Add(1)
+		log.Printf("INFO: %s is a mount point (%s), not descending (one-filesystem)", p, m.FsType)
+	}
+	w.tx <- DbMsg{InsertMounts: []MountRow{{
+		RootRowID: w.rootRowID,
+		ParentID:  j.folderID,
+		Path:      p,
+		Device:    inf.Device,
+		Mount:     m,
+		Descended: descended,
+	}}}
+}
+
+// insertMounts (dbWriter): volume của root ghi vào scan_roots, mount point gặp khi duyệt ghi vào scan_mounts
+func insertMounts(ctx context.Context, db *sql.DB, rows []MountRow) error {
+	nullable := func(s string) sql.NullString {
+		return sql.NullString{String: s, Valid: s != ""}
+	}
+	for _, r := range rows {
+		if r.Root {
+			if r.RootRowID == 0 {
+				continue
+			}
+			if _, err := db.ExecContext(ctx, `
+				UPDATE scan_roots SET st_dev = ?, mount_point = ?, fs_type = ?, mount_source = ? WHERE id = ?
+			`, int64(r.Device), nullable(r.Mount.MountPoint), nullable(r.Mount.FsType), nullable(r.Mount.Source), r.RootRowID); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO scan_mounts (run_id, root_id, parent_id, path, st_dev, fs_type, mount_source, descended, seen_at)
+			VALUES ((SELECT run_id FROM scan_roots WHERE id = ?), NULLIF(?, 0), ?, ?, ?, ?, ?, ?, ?)
+		`, r.RootRowID, r.RootRowID, r.ParentID, r.Path, int64(r.Device),
+			nullable(r.Mount.FsType), nullable(r.Mount.Source), r.Descended, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -147,7 +148,7 @@ func generateExcelReport(db *sql.DB, cfg *ReportConfig) error {
 	row := 2 // Start from second row
 	for _, group := range duplicateGroups {
 		for _, file := range group.Files {
-			f.SetCellValue(sheetNameDup, fmt.Sprintf("A%d", row), group.HashValue)
+			f.SetCellValue(sheetNameDup, fmt.Sprintf("A%d", row), group.Label())
 			f.SetCellValue(sheetNameDup, fmt.Sprintf("B%d", row), group.Count)
 			f.SetCellValue(sheetNameDup, fmt.Sprintf("C%d", row), file.Path)
 			f.SetCellValue(sheetNameDup, fmt.Sprintf("D%d", row), file.Filename)
@@ -158,6 +159,95 @@ func generateExcelReport(db *sql.DB, cfg *ReportConfig) error {
 		}
 	}
 
+	// --- Link Issues Sheet ---
+	sheetNameLinks := "Link Issues"
+	if _, err := f.NewSheet(sheetNameLinks); err != nil {
+		return fmt.Errorf("failed to create sheet %s: %w", sheetNameLinks, err)
+	}
+	for i, h := range []string{"Path", "Link Target", "Resolved Path", "Problem", "Type"} {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		f.SetCellValue(sheetNameLinks, cell, h)
+	}
+	linkIssues, err := loadLinkIssues(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("failed to get link issues for Excel: %w", err)
+	}
+	for i, li := range linkIssues {
+		row := i + 2
+		f.SetCellValue(sheetNameLinks, fmt.Sprintf("A%d", row), li.Path)
+		f.SetCellValue(sheetNameLinks, fmt.Sprintf("B%d", row), li.LinkTarget)
+		f.SetCellValue(sheetNameLinks, fmt.Sprintf("C%d", row), li.TargetPath)
+		f.SetCellValue(sheetNameLinks, fmt.Sprintf("D%d", row), li.Problem())
+		f.SetCellValue(sheetNameLinks, fmt.Sprintf("E%d", row), li.LoaiThuMuc)
+	}
+
+	// --- Volumes Sheet ---
+	sheetNameVol := "Volumes"
+	if _, err := f.NewSheet(sheetNameVol); err != nil {
+		return fmt.Errorf("failed to create sheet %s: %w", sheetNameVol, err)
+	}
+	for i, h := range []string{"Volume", "Source", "Roots", "Files", "Total Size"} {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		f.SetCellValue(sheetNameVol, cell, h)
+	}
+	volumes, err := loadVolumeUsage(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("failed to get volume usage for Excel: %w", err)
+	}
+	for i, v := range volumes {
+		row := i + 2
+		f.SetCellValue(sheetNameVol, fmt.Sprintf("A%d", row), v.Label())
+		f.SetCellValue(sheetNameVol, fmt.Sprintf("B%d", row), v.Source)
+		f.SetCellValue(sheetNameVol, fmt.Sprintf("C%d", row), v.Roots)
+		f.SetCellValue(sheetNameVol, fmt.Sprintf("D%d", row), v.FileCount)
+		f.SetCellValue(sheetNameVol, fmt.Sprintf("E%d", row), v.TotalSize)
+	}
+
+	// --- Tags Sheet ---
+	sheetNameTags := "Tags"
+	if _, err := f.NewSheet(sheetNameTags); err != nil {
+		return fmt.Errorf("failed to create sheet %s: %w", sheetNameTags, err)
+	}
+	for i, h := range []string{"Kind", "Tag", "Files", "Total Size"} {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		f.SetCellValue(sheetNameTags, cell, h)
+	}
+	tags, err := loadTagUsage(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("failed to get tag usage for Excel: %w", err)
+	}
+	for i, t := range tags {
+		row := i + 2
+		f.SetCellValue(sheetNameTags, fmt.Sprintf("A%d", row), t.Kind)
+		f.SetCellValue(sheetNameTags, fmt.Sprintf("B%d", row), t.Tag)
+		f.SetCellValue(sheetNameTags, fmt.Sprintf("C%d", row), t.FileCount)
+		f.SetCellValue(sheetNameTags, fmt.Sprintf("D%d", row), t.TotalSize)
+	}
+
+	// --- Scan Info Sheet ---
+	sheetNameScan := "Scan Info"
+	if _, err := f.NewSheet(sheetNameScan); err != nil {
+		return fmt.Errorf("failed to create sheet %s: %w", sheetNameScan, err)
+	}
+	scanRun := loadScanRunForReport(db)
+	f.SetCellValue(sheetNameScan, "A1", "Scan")
+	f.SetCellValue(sheetNameScan, "B1", scanRun.Summary())
+	f.SetCellValue(sheetNameScan, "A2", "Generated At")
+	f.SetCellValue(sheetNameScan, "B2", time.Now().Format(time.RFC3339))
+	if scanRun != nil {
+		for i, h := range []string{"Root", "Type", "Status", "Files"} {
+			cell, _ := excelize.CoordinatesToCellName(i+1, 4)
+			f.SetCellValue(sheetNameScan, cell, h)
+		}
+		for i, r := range scanRun.Roots {
+			row := i + 5
+			f.SetCellValue(sheetNameScan, fmt.Sprintf("A%d", row), r.Path)
+			f.SetCellValue(sheetNameScan, fmt.Sprintf("B%d", row), r.Tag)
+			f.SetCellValue(sheetNameScan, fmt.Sprintf("C%d", row), r.Status)
+			f.SetCellValue(sheetNameScan, fmt.Sprintf("D%d", row), r.FileCount)
+		}
+	}
+
 	// Remove default "Sheet1" if it exists and is visible
 	if f.GetSheetName(0) == "Sheet1" {
 		visible, err := f.GetSheetVisible("Sheet1")
@@ -212,6 +302,7 @@ func generateHtmlReport(db *sql.DB, cfg *ReportConfig) error {
 <body>
     <h1>File Scan Report</h1>
     <p>Generated on: %s</p>
+    <p>Scan: %s</p>
 
     <div class="section">
         <h2>Top %d Largest Files</h2>
@@ -228,7 +319,7 @@ func generateHtmlReport(db *sql.DB, cfg *ReportConfig) error {
                 </tr>
             </thead>
             <tbody>
-`, time.Now().Format("2006-01-02 15:04:05"), cfg.TopN)
+`, time.Now().Format("2006-01-02 15:04:05"), htmlEscape(loadScanRunForReport(db).Summary()), cfg.TopN)
 
 	// --- Top Largest Files Table ---
 	topFiles, err := getTopLargestFiles(db, cfg.TopN)
@@ -277,7 +368,7 @@ func generateHtmlReport(db *sql.DB, cfg *ReportConfig) error {
 		fmt.Fprintf(writer, `                <tr class="hash-group">
                     <td colspan="7">Hash: %s (Count: %d)</td>
                 </tr>
-`, htmlEscape(group.HashValue), group.Count)
+`, htmlEscape(group.Label()), group.Count)
 		for _, file := range group.Files {
 			fmt.Fprintf(writer, `                <tr>
                     <td></td>
@@ -295,6 +386,106 @@ func generateHtmlReport(db *sql.DB, cfg *ReportConfig) error {
         </table>
     </div>
 
+    <div class="section">
+        <h2>Broken / Outside-Root Symlinks</h2>
+        <table>
+            <thead>
+                <tr>
+                    <th>Path</th>
+                    <th>Link Target</th>
+                    <th>Resolved Path</th>
+                    <th>Problem</th>
+                    <th>Type</th>
+                </tr>
+            </thead>
+            <tbody>
+`)
+
+	// --- Link Issues Table ---
+	linkIssues, err := loadLinkIssues(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("failed to get link issues for HTML: %w", err)
+	}
+	for _, li := range linkIssues {
+		fmt.Fprintf(writer, `                <tr>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                </tr>
+`, htmlEscape(li.Path), htmlEscape(li.LinkTarget), htmlEscape(li.TargetPath), li.Problem(), htmlEscape(li.LoaiThuMuc))
+	}
+	fmt.Fprintf(writer, `            </tbody>
+        </table>
+    </div>
+
+    <div class="section">
+        <h2>Usage by Volume</h2>
+        <table>
+            <thead>
+                <tr>
+                    <th>Volume</th>
+                    <th>Source</th>
+                    <th>Roots</th>
+                    <th>Files</th>
+                    <th>Total Size</th>
+                </tr>
+            </thead>
+            <tbody>
+`)
+
+	// --- Volumes Table ---
+	volumes, err := loadVolumeUsage(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("failed to get volume usage for HTML: %w", err)
+	}
+	for _, v := range volumes {
+		fmt.Fprintf(writer, `                <tr>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%d</td>
+                    <td>%d</td>
+                </tr>
+`, htmlEscape(v.Label()), htmlEscape(v.Source), htmlEscape(v.Roots), v.FileCount, v.TotalSize)
+	}
+	fmt.Fprintf(writer, `            </tbody>
+        </table>
+    </div>
+
+    <div class="section">
+        <h2>Usage by Tag</h2>
+        <table>
+            <thead>
+                <tr>
+                    <th>Kind</th>
+                    <th>Tag</th>
+                    <th>Files</th>
+                    <th>Total Size</th>
+                </tr>
+            </thead>
+            <tbody>
+`)
+
+	// --- Tags Table ---
+	tags, err := loadTagUsage(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("failed to get tag usage for HTML: %w", err)
+	}
+	for _, t := range tags {
+		fmt.Fprintf(writer, `                <tr>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%d</td>
+                    <td>%d</td>
+                </tr>
+`, htmlEscape(t.Kind), htmlEscape(t.Tag), t.FileCount, t.TotalSize)
+	}
+	fmt.Fprintf(writer, `            </tbody>
+        </table>
+    </div>
+
 </body>
 </html>
 `)
@@ -303,6 +494,15 @@ func generateHtmlReport(db *sql.DB, cfg *ReportConfig) error {
 	return nil
 }
 
+// loadScanRunForReport đọc lần quét mới nhất trong scan_runs; lỗi chỉ được log (report vẫn tạo được)
+func loadScanRunForReport(db *sql.DB) *ScanRunInfo {
+	ri, err := loadLatestScanRun(context.Background(), db)
+	if err != nil {
+		log.Printf("Warning: failed to read scan run metadata: %v", err)
+	}
+	return ri
+}
+
 // htmlEscape escapes strings for HTML output
 func htmlEscape(s string) string {
 	s = strings.ReplaceAll(s, "&", "&amp;")
@@ -315,6 +515,8 @@ func htmlEscape(s string) string {
 
 // generateConsoleReport generates a report to the console
 func generateConsoleReport(db *sql.DB, cfg *ReportConfig) error {
+	fmt.Println("Scan: " + loadScanRunForReport(db).Summary())
+	fmt.Println()
 	fmt.Println("--- Top Largest Files ---")
 	topFiles, err := getTopLargestFiles(db, cfg.TopN)
 	if err != nil {
@@ -330,12 +532,40 @@ func generateConsoleReport(db *sql.DB, cfg *ReportConfig) error {
 		return fmt.Errorf("failed to get duplicate files: %w", err)
 	}
 	for _, group := range duplicateGroups {
-		fmt.Printf("Hash: %s (Count: %d)", group.HashValue, group.Count)
+		fmt.Printf("Hash: %s (Count: %d)", group.Label(), group.Count)
 		for _, file := range group.Files {
 			fmt.Printf("  - Size: %-10d Path: %s", file.Size, file.Path)
 		}
 		fmt.Println()
 	}
+	fmt.Println("--- Broken / Outside-Root Symlinks ---")
+	linkIssues, err := loadLinkIssues(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("failed to get link issues: %w", err)
+	}
+	for _, li := range linkIssues {
+		fmt.Printf("[%s] %s -> %s\n", li.Problem(), li.Path, li.LinkTarget)
+	}
+	fmt.Println("--- Usage by Volume ---")
+	volumes, err := loadVolumeUsage(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("failed to get volume usage: %w", err)
+	}
+	for _, v := range volumes {
+		fmt.Printf("%s: %d files, %d bytes", v.Label(), v.FileCount, v.TotalSize)
+		if v.Roots != "" {
+			fmt.Printf(" (roots: %s)", v.Roots)
+		}
+		fmt.Println()
+	}
+	fmt.Println("--- Usage by Tag ---")
+	tags, err := loadTagUsage(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("failed to get tag usage: %w", err)
+	}
+	for _, t := range tags {
+		fmt.Printf("%s: %s: %d files, %d bytes\n", t.Kind, t.Tag, t.FileCount, t.TotalSize)
+	}
 	return nil
 }
 
@@ -368,17 +598,21 @@ func getTopLargestFiles(db *sql.DB, topN int) ([]FileInfo, error) {
 }
 
 // getDuplicateFiles fetches groups of duplicate files from the database
+// Nhóm theo (hash_algo, hash_value, dup_class): hash của hai thuật toán khác nhau không được so với nhau,
+// các lớp nội dung khác nhau của cùng hash (va chạm đã xác minh) là các nhóm riêng
 func getDuplicateFiles(db *sql.DB) ([]DuplicateGroup, error) {
 	rows, err := db.Query(`
-		SELECT f.id, f.path, f.filename, f.size, f.st_mtime, f.hash_value, f.loaithumuc
+		SELECT f.id, f.path, f.filename, f.size, f.st_mtime, f.hash_value, f.hash_algo, COALESCE(f.dup_class, 0), f.loaithumuc
 		FROM fs_files f
 		JOIN (
-			SELECT hash_value
+			SELECT hash_algo, hash_value, COALESCE(dup_class, 0) AS dup_class
 			FROM fs_files
-			WHERE hash_value IS NOT NULL AND hash_value != ''
-			GROUP BY hash_value
+			WHERE hash_value IS NOT NULL AND hash_value != '' AND hardlink_of IS NULL
+			GROUP BY hash_algo, hash_value, COALESCE(dup_class, 0)
 			HAVING COUNT(*) > 1
-		) AS duplicates ON f.hash_value = duplicates.hash_value
+		) AS duplicates ON f.hash_value = duplicates.hash_value AND f.hash_algo IS duplicates.hash_algo
+		  AND COALESCE(f.dup_class, 0) = duplicates.dup_class
+		WHERE f.hardlink_of IS NULL
 		ORDER BY f.hash_value, f.size DESC
 	`)
 	if err != nil {
@@ -389,8 +623,9 @@ func getDuplicateFiles(db *sql.DB) ([]DuplicateGroup, error) {
 	duplicateMap := make(map[string]*DuplicateGroup)
 	for rows.Next() {
 		var file FileInfo
-		var hash sql.NullString
-		if err := rows.Scan(&file.ID, &file.Path, &file.Filename, &file.Size, &file.Mtime, &hash, &file.LoaiThuMuc); err != nil {
+		var hash, algo sql.NullString
+		var class int
+		if err := rows.Scan(&file.ID, &file.Path, &file.Filename, &file.Size, &file.Mtime, &hash, &algo, &class, &file.LoaiThuMuc); err != nil {
 			return nil, fmt.Errorf("scan duplicate file row failed: %w", err)
 		}
 		if hash.Valid {
@@ -399,14 +634,17 @@ func getDuplicateFiles(db *sql.DB) ([]DuplicateGroup, error) {
 			continue // Skip files without hash_value
 		}
 
-		group, ok := duplicateMap[file.HashValue]
+		key := fmt.Sprintf("%s#%d", file.HashValue, class)
+		group, ok := duplicateMap[key]
 		if !ok {
 			group = &DuplicateGroup{
+				HashAlgo:  algo.String,
 				HashValue: file.HashValue,
+				Class:     class,
 				Count:     0, // Will be updated later
 				Files:     []FileInfo{},
 			}
-			duplicateMap[file.HashValue] = group
+			duplicateMap[key] = group
 		}
 		group.Files = append(group.Files, file)
 	}
@@ -419,7 +657,10 @@ func getDuplicateFiles(db *sql.DB) ([]DuplicateGroup, error) {
 
 	// Sort groups by hash value for consistent output
 	sort.Slice(duplicateGroups, func(i, j int) bool {
-		return duplicateGroups[i].HashValue < duplicateGroups[j].HashValue
+		if duplicateGroups[i].HashValue != duplicateGroups[j].HashValue {
+			return duplicateGroups[i].HashValue < duplicateGroups[j].HashValue
+		}
+		return duplicateGroups[i].Class < duplicateGroups[j].Class
 	})
 
 	return duplicateGroups, nil
@@ -438,7 +679,21 @@ type FileInfo struct {
 
 // DuplicateGroup struct to hold info about duplicate files
 type DuplicateGroup struct {
+	HashAlgo  string
 	HashValue string
+	Class     int // fs_files.dup_class (0 = nhóm không bị tách)
 	Count     int
 	Files     []FileInfo
 }
+
+// Label: hash kèm thuật toán ("sha256:..."), hash chưa rõ thuật toán để nguyên; lớp khác 0 thêm " #N"
+func (g DuplicateGroup) Label() string {
+	label := g.HashValue
+	if g.HashAlgo != "" {
+		label = g.HashAlgo + ":" + label
+	}
+	if g.Class > 0 {
+		label += fmt.Sprintf(" #%d", g.Class) // lớp nội dung khác của cùng hash (va chạm)
+	}
+	return label
+}
@@ -63,8 +63,12 @@ type ReportMetrics struct {
 type ReportData struct {
 	TopFiles    []FileInfoOptimized       `json:"topFiles"`
 	Duplicates  []DuplicateGroupOptimized `json:"duplicates"`
+	LinkIssues  []LinkIssue               `json:"linkIssues"` // symlink hỏng / trỏ ra ngoài root
+	Volumes     []VolumeUsage             `json:"volumes"`    // dung lượng theo volume (st_dev)
+	Tags        []TagUsage                `json:"tags"`       // dung lượng theo tag (fs_tags)
 	Summary     ReportSummary             `json:"summary"`
 	Metrics     ReportMetrics             `json:"metrics"`
+	ScanRun     *ScanRunInfo              `json:"scanRun,omitempty"`
 	GeneratedAt time.Time                 `json:"generatedAt"`
 }
 
@@ -81,6 +85,7 @@ type FileInfoOptimized struct {
 
 // DuplicateGroupOptimized represents a group of duplicate files
 type DuplicateGroupOptimized struct {
+	Algo      string              `json:"algo,omitempty"` // hash_algo (DB cũ: md5)
 	Hash      string              `json:"hash"`
 	Size      int64               `json:"size"`
 	Count     int                 `json:"count"`
@@ -88,6 +93,14 @@ type DuplicateGroupOptimized struct {
 	TotalSize int64               `json:"totalSize"`
 }
 
+// Label: hash kèm thuật toán ("sha256:..."), hash chưa rõ thuật toán để nguyên
+func (g DuplicateGroupOptimized) Label() string {
+	if g.Algo == "" {
+		return g.Hash
+	}
+	return g.Algo + ":" + g.Hash
+}
+
 // ReportSummary provides summary statistics
 type ReportSummary struct {
 	TotalFiles      int64 `json:"totalFiles"`
@@ -96,6 +109,11 @@ type ReportSummary struct {
 	DuplicateFiles  int64 `json:"duplicateFiles"`
 	WastedSpace     int64 `json:"wastedSpace"`
 	AverageFileSize int64 `json:"averageFileSize"`
+	LinkedCopies    int64 `json:"linkedCopies"` // hardlink tới file đã đếm, không chiếm thêm dung lượng
+	LinkedSize      int64 `json:"linkedSize"`
+	SpecialEntries  int64 `json:"specialEntries"` // symlink, socket, fifo, device trong fs_special
+	BrokenLinks     int64 `json:"brokenLinks"`
+	OutsideLinks    int64 `json:"outsideLinks"` // symlink trỏ ra ngoài root đang quét
 }
 
 // QueryCache provides simple caching for query results
@@ -220,6 +238,13 @@ func (r *OptimizedReporter) collectReportData() (*ReportData, error) {
 		GeneratedAt: time.Now(),
 	}
 
+	// Scan run metadata (DB cũ không có scan_runs: bỏ qua)
+	scanRun, err := loadLatestScanRun(r.ctx, r.db)
+	if err != nil {
+		r.logger.WithError(err).Warn("Failed to read scan run metadata")
+	}
+	data.ScanRun = scanRun
+
 	// Collect top largest files
 	topFiles, err := r.getTopLargestFiles()
 	if err != nil {
@@ -234,6 +259,30 @@ func (r *OptimizedReporter) collectReportData() (*ReportData, error) {
 	}
 	data.Duplicates = duplicates
 
+	// Symlink hỏng / trỏ ra ngoài root
+	linkIssues, err := loadLinkIssues(r.ctx, r.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link issues: %w", err)
+	}
+	r.metrics.QueriesExecuted++
+	data.LinkIssues = linkIssues
+
+	// Dung lượng theo volume
+	volumes, err := loadVolumeUsage(r.ctx, r.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volume usage: %w", err)
+	}
+	r.metrics.QueriesExecuted++
+	data.Volumes = volumes
+
+	// Dung lượng theo tag
+	tags, err := loadTagUsage(r.ctx, r.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tag usage: %w", err)
+	}
+	r.metrics.QueriesExecuted++
+	data.Tags = tags
+
 	// Generate summary
 	summary, err := r.generateSummary()
 	if err != nil {
@@ -305,12 +354,13 @@ func (r *OptimizedReporter) getDuplicateFiles() ([]DuplicateGroupOptimized, erro
 	}
 
 	query := `
-		SELECT hash_value, size, COUNT(*) as count, GROUP_CONCAT(id)
+		SELECT COALESCE(hash_algo, ''), hash_value, size, COUNT(*) as count, GROUP_CONCAT(id)
 		FROM fs_files
 		WHERE hash_value IS NOT NULL
 		  AND hash_value != ''
+		  AND hardlink_of IS NULL
 		  AND size >= ?
-		GROUP BY hash_value, size
+		GROUP BY hash_algo, hash_value, COALESCE(dup_class, 0), size
 		HAVING count > 1
 		ORDER BY size DESC
 	`
@@ -329,7 +379,7 @@ func (r *OptimizedReporter) getDuplicateFiles() ([]DuplicateGroupOptimized, erro
 		var ids string
 		var count int
 
-		err := rows.Scan(&group.Hash, &group.Size, &count, &ids)
+		err := rows.Scan(&group.Algo, &group.Hash, &group.Size, &count, &ids)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan duplicate group: %w", err)
 		}
@@ -407,21 +457,38 @@ func (r *OptimizedReporter) generateSummary() (ReportSummary, error) {
 
 	summary := ReportSummary{}
 
-	// Get total files and size
+	// Get total files and size (hardlink chỉ tính dung lượng một lần)
 	err := r.db.QueryRowContext(r.ctx, `
-		SELECT COUNT(*), COALESCE(SUM(size), 0)
+		SELECT COUNT(*),
+		       COALESCE(SUM(CASE WHEN hardlink_of IS NULL THEN size ELSE 0 END), 0),
+		       COUNT(hardlink_of),
+		       COALESCE(SUM(CASE WHEN hardlink_of IS NOT NULL THEN size ELSE 0 END), 0)
 		FROM fs_files
-	`).Scan(&summary.TotalFiles, &summary.TotalSize)
+	`).Scan(&summary.TotalFiles, &summary.TotalSize, &summary.LinkedCopies, &summary.LinkedSize)
 	if err != nil {
 		return summary, fmt.Errorf("failed to get total statistics: %w", err)
 	}
 	r.metrics.QueriesExecuted++
 
+	// Symlink/socket/device (fs_special)
+	err = r.db.QueryRowContext(r.ctx, `
+		SELECT COUNT(*),
+		       COALESCE(SUM(CASE WHEN entry_type = 'symlink' AND target_ok = 0 THEN 1 ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN entry_type = 'symlink' AND outside_root = 1 THEN 1 ELSE 0 END), 0)
+		FROM fs_special
+	`).Scan(&summary.SpecialEntries, &summary.BrokenLinks, &summary.OutsideLinks)
+	if err != nil {
+		return summary, fmt.Errorf("failed to get special entry statistics: %w", err)
+	}
+	r.metrics.QueriesExecuted++
+
 	// Get unique files count
 	err = r.db.QueryRowContext(r.ctx, `
-		SELECT COUNT(DISTINCT hash_value)
-		FROM fs_files
-		WHERE hash_value IS NOT NULL AND hash_value != ''
+		SELECT COUNT(*) FROM (
+			SELECT 1 FROM fs_files
+			WHERE hash_value IS NOT NULL AND hash_value != '' AND hardlink_of IS NULL
+			GROUP BY hash_value, COALESCE(dup_class, 0)
+		)
 	`).Scan(&summary.UniqueFiles)
 	if err != nil {
 		return summary, fmt.Errorf("failed to get unique files count: %w", err)
@@ -429,7 +496,7 @@ func (r *OptimizedReporter) generateSummary() (ReportSummary, error) {
 	r.metrics.QueriesExecuted++
 
 	// Calculate derived metrics
-	summary.DuplicateFiles = summary.TotalFiles - summary.UniqueFiles
+	summary.DuplicateFiles = summary.TotalFiles - summary.LinkedCopies - summary.UniqueFiles
 	summary.WastedSpace = 0 // Will be calculated from duplicates
 	summary.AverageFileSize = 0
 	if summary.TotalFiles > 0 {
@@ -438,11 +505,14 @@ func (r *OptimizedReporter) generateSummary() (ReportSummary, error) {
 
 	// Calculate wasted space from duplicates
 	err = r.db.QueryRowContext(r.ctx, `
-		SELECT COALESCE(SUM((COUNT(*) - 1) * size), 0)
-		FROM fs_files
-		WHERE hash_value IS NOT NULL AND hash_value != ''
-		GROUP BY hash_value, size
-		HAVING COUNT(*) > 1
+		SELECT COALESCE(SUM(wasted), 0)
+		FROM (
+			SELECT (COUNT(*) - 1) * size AS wasted
+			FROM fs_files
+			WHERE hash_value IS NOT NULL AND hash_value != '' AND hardlink_of IS NULL
+			GROUP BY hash_algo, hash_value, COALESCE(dup_class, 0), size
+			HAVING COUNT(*) > 1
+		)
 	`).Scan(&summary.WastedSpace)
 	if err != nil && err != sql.ErrNoRows {
 		return summary, fmt.Errorf("failed to calculate wasted space: %w", err)
@@ -472,6 +542,9 @@ func (r *OptimizedReporter) generateExcelReport(data *ReportData) error {
 		"Summary":    "Summary",
 		"Top Files":  "Top_Largest_Files",
 		"Duplicates": "Duplicate_Files",
+		"Links":      "Link_Issues",
+		"Volumes":    "Volumes",
+		"Tags":       "Tags",
 	}
 
 	for sheetName, sheetTitle := range sheets {
@@ -485,7 +558,7 @@ func (r *OptimizedReporter) generateExcelReport(data *ReportData) error {
 	}
 
 	// Add summary data
-	if err := r.addSummaryToExcel(f, sheets["Summary"], data.Summary, data.Metrics); err != nil {
+	if err := r.addSummaryToExcel(f, sheets["Summary"], data.Summary, data.Metrics, data.ScanRun); err != nil {
 		return fmt.Errorf("failed to add summary to Excel: %w", err)
 	}
 
@@ -499,6 +572,21 @@ func (r *OptimizedReporter) generateExcelReport(data *ReportData) error {
 		return fmt.Errorf("failed to add duplicates to Excel: %w", err)
 	}
 
+	// Add broken / outside-root symlinks
+	if err := r.addLinkIssuesToExcel(f, sheets["Links"], data.LinkIssues); err != nil {
+		return fmt.Errorf("failed to add link issues to Excel: %w", err)
+	}
+
+	// Add usage by volume
+	if err := r.addVolumesToExcel(f, sheets["Volumes"], data.Volumes); err != nil {
+		return fmt.Errorf("failed to add volumes to Excel: %w", err)
+	}
+
+	// Add usage by tag
+	if err := r.addTagsToExcel(f, sheets["Tags"], data.Tags); err != nil {
+		return fmt.Errorf("failed to add tags to Excel: %w", err)
+	}
+
 	// Set default sheet to Summary
 	if summaryIndex, err := f.GetSheetIndex(sheets["Summary"]); err == nil && summaryIndex >= 0 {
 		f.SetActiveSheet(summaryIndex)
@@ -514,15 +602,20 @@ func (r *OptimizedReporter) generateExcelReport(data *ReportData) error {
 }
 
 // addSummaryToExcel adds summary statistics to Excel sheet
-func (r *OptimizedReporter) addSummaryToExcel(f *excelize.File, sheetName string, summary ReportSummary, metrics ReportMetrics) error {
+func (r *OptimizedReporter) addSummaryToExcel(f *excelize.File, sheetName string, summary ReportSummary, metrics ReportMetrics, scanRun *ScanRunInfo) error {
 	headers := []string{"Metric", "Value"}
 	data := [][]interface{}{
 		{"Generated At", time.Now().Format("2006-01-02 15:04:05")},
+		{"Scan", scanRun.Summary()},
 		{"Total Files", summary.TotalFiles},
 		{"Total Size", formatBytes(summary.TotalSize)},
 		{"Unique Files", summary.UniqueFiles},
 		{"Duplicate Files", summary.DuplicateFiles},
 		{"Wasted Space", formatBytes(summary.WastedSpace)},
+		{"Linked Copies (hardlinks)", fmt.Sprintf("%d (%s)", summary.LinkedCopies, formatBytes(summary.LinkedSize))},
+		{"Special Entries (symlinks, sockets, devices)", summary.SpecialEntries},
+		{"Broken Symlinks", summary.BrokenLinks},
+		{"Symlinks Outside Root", summary.OutsideLinks},
 		{"Average File Size", formatBytes(summary.AverageFileSize)},
 		{"Generation Time (ms)", metrics.GenerationTime.Milliseconds()},
 		{"Queries Executed", metrics.QueriesExecuted},
@@ -591,7 +684,7 @@ func (r *OptimizedReporter) addDuplicatesToExcel(f *excelize.File, sheetName str
 	// Write data
 	rowNum := 2
 	for _, group := range duplicates {
-		f.SetCellValue(sheetName, fmt.Sprintf("A%d", rowNum), group.Hash)
+		f.SetCellValue(sheetName, fmt.Sprintf("A%d", rowNum), group.Label())
 		f.SetCellValue(sheetName, fmt.Sprintf("B%d", rowNum), group.Size)
 		f.SetCellValue(sheetName, fmt.Sprintf("C%d", rowNum), group.Count)
 		f.SetCellValue(sheetName, fmt.Sprintf("D%d", rowNum), group.TotalSize)
@@ -609,6 +702,75 @@ func (r *OptimizedReporter) addDuplicatesToExcel(f *excelize.File, sheetName str
 	return nil
 }
 
+// addLinkIssuesToExcel adds broken / outside-root symlinks to Excel sheet
+func (r *OptimizedReporter) addLinkIssuesToExcel(f *excelize.File, sheetName string, issues []LinkIssue) error {
+	headers := []string{"Path", "Link Target", "Resolved Path", "Problem", "Type"}
+
+	// Write headers
+	for i, header := range headers {
+		cell := fmt.Sprintf("%s1", string(rune('A'+i)))
+		f.SetCellValue(sheetName, cell, header)
+	}
+
+	// Write data
+	for i, li := range issues {
+		rowNum := i + 2
+		data := []interface{}{li.Path, li.LinkTarget, li.TargetPath, li.Problem(), li.LoaiThuMuc}
+		for j, value := range data {
+			cell := fmt.Sprintf("%s%d", string(rune('A'+j)), rowNum)
+			f.SetCellValue(sheetName, cell, value)
+		}
+	}
+
+	return nil
+}
+
+// addVolumesToExcel adds usage by volume (st_dev / mount point) to Excel sheet
+func (r *OptimizedReporter) addVolumesToExcel(f *excelize.File, sheetName string, volumes []VolumeUsage) error {
+	headers := []string{"Volume", "Source", "Roots", "Files", "Total Size", "Total Size (Human)"}
+
+	// Write headers
+	for i, header := range headers {
+		cell := fmt.Sprintf("%s1", string(rune('A'+i)))
+		f.SetCellValue(sheetName, cell, header)
+	}
+
+	// Write data
+	for i, v := range volumes {
+		rowNum := i + 2
+		data := []interface{}{v.Label(), v.Source, v.Roots, v.FileCount, v.TotalSize, formatBytes(v.TotalSize)}
+		for j, value := range data {
+			cell := fmt.Sprintf("%s%d", string(rune('A'+j)), rowNum)
+			f.SetCellValue(sheetName, cell, value)
+		}
+	}
+
+	return nil
+}
+
+// addTagsToExcel adds usage by tag (fs_tags) to Excel sheet
+func (r *OptimizedReporter) addTagsToExcel(f *excelize.File, sheetName string, tags []TagUsage) error {
+	headers := []string{"Kind", "Tag", "Files", "Total Size", "Total Size (Human)"}
+
+	// Write headers
+	for i, header := range headers {
+		cell := fmt.Sprintf("%s1", string(rune('A'+i)))
+		f.SetCellValue(sheetName, cell, header)
+	}
+
+	// Write data
+	for i, t := range tags {
+		rowNum := i + 2
+		data := []interface{}{t.Kind, t.Tag, t.FileCount, t.TotalSize, formatBytes(t.TotalSize)}
+		for j, value := range data {
+			cell := fmt.Sprintf("%s%d", string(rune('A'+j)), rowNum)
+			f.SetCellValue(sheetName, cell, value)
+		}
+	}
+
+	return nil
+}
+
 // generateHTMLReport creates an optimized HTML report
 func (r *OptimizedReporter) generateHTMLReport(data *ReportData) error {
 	r.logger.Info("Generating optimized HTML report")
@@ -631,6 +793,7 @@ func (r *OptimizedReporter) generateHTMLReport(data *ReportData) error {
     <div class="header">
         <h1>Filesystem Analysis Report</h1>
         <p>Generated: {{.GeneratedAt.Format "2006-01-02 15:04:05"}}</p>
+        <p>Scan: {{.ScanRun.Summary}}</p>
     </div>
 
     <div class="section">
@@ -640,6 +803,10 @@ func (r *OptimizedReporter) generateHTMLReport(data *ReportData) error {
         <div class="metric">Unique Files: {{.Summary.UniqueFiles}}</div>
         <div class="metric">Duplicate Files: {{.Summary.DuplicateFiles}}</div>
         <div class="metric">Wasted Space: {{formatBytes .Summary.WastedSpace}}</div>
+        <div class="metric">Linked Copies (hardlinks): {{.Summary.LinkedCopies}} ({{formatBytes .Summary.LinkedSize}})</div>
+        <div class="metric">Special Entries: {{.Summary.SpecialEntries}}</div>
+        <div class="metric">Broken Symlinks: {{.Summary.BrokenLinks}}</div>
+        <div class="metric">Symlinks Outside Root: {{.Summary.OutsideLinks}}</div>
         <div class="metric">Generation Time: {{.Metrics.GenerationTime}}</div>
     </div>
 
@@ -660,7 +827,7 @@ func (r *OptimizedReporter) generateHTMLReport(data *ReportData) error {
     <div class="section">
         <h2>Duplicate Files</h2>
         {{range .Duplicates}}
-        <h3>Hash: {{.Hash}} ({{.Count}} files, {{formatBytes .TotalSize}} total)</h3>
+        <h3>Hash: {{.Label}} ({{.Count}} files, {{formatBytes .TotalSize}} total)</h3>
         <table>
             <tr><th>Path</th><th>Size</th><th>Modified</th></tr>
             {{range .Files}}
@@ -673,6 +840,52 @@ func (r *OptimizedReporter) generateHTMLReport(data *ReportData) error {
         </table>
         {{end}}
     </div>
+
+    <div class="section">
+        <h2>Broken / Outside-Root Symlinks</h2>
+        <table>
+            <tr><th>Path</th><th>Link Target</th><th>Resolved Path</th><th>Problem</th></tr>
+            {{range .LinkIssues}}
+            <tr>
+                <td>{{.Path}}</td>
+                <td>{{.LinkTarget}}</td>
+                <td>{{.TargetPath}}</td>
+                <td>{{.Problem}}</td>
+            </tr>
+            {{end}}
+        </table>
+    </div>
+
+    <div class="section">
+        <h2>Usage by Volume</h2>
+        <table>
+            <tr><th>Volume</th><th>Source</th><th>Roots</th><th>Files</th><th>Total Size</th></tr>
+            {{range .Volumes}}
+            <tr>
+                <td>{{.Label}}</td>
+                <td>{{.Source}}</td>
+                <td>{{.Roots}}</td>
+                <td>{{.FileCount}}</td>
+                <td>{{formatBytes .TotalSize}}</td>
+            </tr>
+            {{end}}
+        </table>
+    </div>
+
+    <div class="section">
+        <h2>Usage by Tag</h2>
+        <table>
+            <tr><th>Kind</th><th>Tag</th><th>Files</th><th>Total Size</th></tr>
+            {{range .Tags}}
+            <tr>
+                <td>{{.Kind}}</td>
+                <td>{{.Tag}}</td>
+                <td>{{.FileCount}}</td>
+                <td>{{formatBytes .TotalSize}}</td>
+            </tr>
+            {{end}}
+        </table>
+    </div>
 </body>
 </html>`
 
@@ -721,7 +934,8 @@ func (r *OptimizedReporter) generateJSONReport(data *ReportData) error {
 // generateConsoleReport creates a console report
 func (r *OptimizedReporter) generateConsoleReport(data *ReportData) error {
 	fmt.Printf("=== FILESYSTEM ANALYSIS REPORT ===\n")
-	fmt.Printf("Generated: %s\n\n", data.GeneratedAt.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Generated: %s\n", data.GeneratedAt.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Scan:      %s\n\n", data.ScanRun.Summary())
 
 	// Summary
 	fmt.Printf("SUMMARY:\n")
@@ -730,6 +944,9 @@ func (r *OptimizedReporter) generateConsoleReport(data *ReportData) error {
 	fmt.Printf("  Unique Files:    %d\n", data.Summary.UniqueFiles)
 	fmt.Printf("  Duplicate Files: %d\n", data.Summary.DuplicateFiles)
 	fmt.Printf("  Wasted Space:    %s\n", formatBytes(data.Summary.WastedSpace))
+	fmt.Printf("  Linked Copies:   %d (%s, hardlinks)\n", data.Summary.LinkedCopies, formatBytes(data.Summary.LinkedSize))
+	fmt.Printf("  Special Entries: %d (%d broken symlinks, %d outside root)\n",
+		data.Summary.SpecialEntries, data.Summary.BrokenLinks, data.Summary.OutsideLinks)
 	fmt.Printf("  Generation Time: %v\n\n", data.Metrics.GenerationTime)
 
 	// Top files
@@ -742,7 +959,11 @@ func (r *OptimizedReporter) generateConsoleReport(data *ReportData) error {
 	// Duplicates
 	fmt.Printf("DUPLICATE FILES (%d groups):\n", len(data.Duplicates))
 	for i, group := range data.Duplicates {
-		fmt.Printf("%2d. Hash: %s\n", i+1, group.Hash[:12]+"...")
+		label := group.Hash[:12] + "..."
+		if group.Algo != "" {
+			label = group.Algo + ":" + label
+		}
+		fmt.Printf("%2d. Hash: %s\n", i+1, label)
 		fmt.Printf("    Size: %s, Count: %d, Total: %s\n",
 			formatBytes(group.Size), group.Count, formatBytes(group.TotalSize))
 		fmt.Printf("    Files:\n")
@@ -752,6 +973,30 @@ func (r *OptimizedReporter) generateConsoleReport(data *ReportData) error {
 		fmt.Println()
 	}
 
+	// Symlinks
+	fmt.Printf("BROKEN / OUTSIDE-ROOT SYMLINKS (%d):\n", len(data.LinkIssues))
+	for _, li := range data.LinkIssues {
+		fmt.Printf("  [%s] %s -> %s\n", li.Problem(), li.Path, li.LinkTarget)
+	}
+	fmt.Println()
+
+	// Volumes
+	fmt.Printf("USAGE BY VOLUME (%d):\n", len(data.Volumes))
+	for _, v := range data.Volumes {
+		fmt.Printf("  %-40s %8d files %12s", truncateString(v.Label(), 40), v.FileCount, formatBytes(v.TotalSize))
+		if v.Roots != "" {
+			fmt.Printf("  roots: %s", v.Roots)
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+
+	// Tags
+	fmt.Printf("USAGE BY TAG (%d):\n", len(data.Tags))
+	for _, t := range data.Tags {
+		fmt.Printf("  %-40s %8d files %12s\n", truncateString(t.Kind+": "+t.Tag, 40), t.FileCount, formatBytes(t.TotalSize))
+	}
+
 	return nil
 }
 
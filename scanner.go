@@ -5,11 +5,14 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"math"
 	"os"
@@ -17,6 +20,8 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -27,50 +32,12 @@ import (
 // OPTIMIZED COMPONENTS
 // =================================================================
 
-// ScannerLogger provides structured logging capabilities
-type ScannerLogger struct {
-	logger *logrus.Logger
-}
-
-// NewScannerLogger creates a new structured logger
-func NewScannerLogger() *ScannerLogger {
-	logger := logrus.New()
-	logger.SetFormatter(&logrus.JSONFormatter{})
-	logger.SetLevel(logrus.InfoLevel)
-	return &ScannerLogger{logger: logger}
-}
-
-// LogFileProcessed logs file processing metrics
-func (sl *ScannerLogger) LogFileProcessed(path string, size int64, duration time.Duration) {
-	sl.logger.WithFields(logrus.Fields{
-		"path":       path,
-		"size":       size,
-		"duration":   duration.Milliseconds(),
-		"throughput": float64(size) / duration.Seconds() / 1024 / 1024, // MB/s
-	}).Info("File processed")
-}
-
-// LogBatchOperation logs batch operation metrics
-func (sl *ScannerLogger) LogBatchOperation(operation string, count int, duration time.Duration, err error) {
-	fields := logrus.Fields{
-		"operation": operation,
-		"count":     count,
-		"duration":  duration.Milliseconds(),
-	}
-
-	if err != nil {
-		fields["error"] = err.Error()
-		sl.logger.WithFields(fields).Error("Batch operation failed")
-	} else {
-		sl.logger.WithFields(fields).Info("Batch operation completed")
-	}
-}
-
 // RetryableOperation implements exponential backoff retry mechanism
 type RetryableOperation struct {
 	maxRetries int
 	baseDelay  time.Duration
 	maxDelay   time.Duration
+	retryIf    func(error) bool // nil = retry mọi lỗi; lỗi không thoả thì trả về ngay, không bọc
 }
 
 // NewRetryableOperation creates a new retryable operation with default settings
@@ -82,15 +49,35 @@ func NewRetryableOperation() *RetryableOperation {
 	}
 }
 
+// NewFSRetryableOperation: retry cho lệnh filesystem (Lstat/ReadDir/Readlink), chỉ retry lỗi tạm thời
+// của share mạng (isTransientFSError) để SMB/NFS chập chờn không bị ghi thành lỗi quét
+func NewFSRetryableOperation() *RetryableOperation {
+	return &RetryableOperation{
+		maxRetries: 3,
+		baseDelay:  200 * time.Millisecond,
+		maxDelay:   2 * time.Second,
+		retryIf:    isTransientFSError,
+	}
+}
+
 // Execute runs the operation with retry logic
 func (ro *RetryableOperation) Execute(fn func() error) error {
+	_, err := ro.Attempts(fn)
+	return err
+}
+
+// Attempts giống Execute nhưng trả thêm số lần đã chạy fn (để ghi vào scan_errors)
+func (ro *RetryableOperation) Attempts(fn func() error) (int, error) {
 	var lastErr error
 
 	for attempt := 0; attempt <= ro.maxRetries; attempt++ {
 		if err := fn(); err == nil {
-			return nil
+			return attempt + 1, nil
 		} else {
 			lastErr = err
+			if ro.retryIf != nil && !ro.retryIf(err) {
+				return attempt + 1, err
+			}
 
 			if attempt < ro.maxRetries {
 				delay := time.Duration(float64(ro.baseDelay) * math.Pow(2, float64(attempt)))
@@ -103,7 +90,7 @@ func (ro *RetryableOperation) Execute(fn func() error) error {
 		}
 	}
 
-	return fmt.Errorf("operation failed after %d attempts: %w", ro.maxRetries+1, lastErr)
+	return ro.maxRetries + 1, fmt.Errorf("operation failed after %d attempts: %w", ro.maxRetries+1, lastErr)
 }
 
 // BatchSizer implements dynamic batch sizing based on file sizes
@@ -204,7 +191,7 @@ func (wp *MemoryAwareWorkerPool) processJobWithTimeout(job FileToHash, timeout t
 
 	var result HashResult
 	err := retryOp.Execute(func() error {
-		hash, hashErr := calculateHashWithContext(ctx, job.Path)
+		hash, hashErr := calculateHashWithContext(ctx, job.Path, "", nil)
 		result = HashResult{ID: job.ID, Hash: hash, Err: hashErr}
 		return hashErr
 	})
@@ -231,44 +218,6 @@ func (wp *MemoryAwareWorkerPool) Stop() {
 	close(wp.jobChan)
 }
 
-// RateLimitedHasher implements I/O rate limiting for hashing operations
-type RateLimitedHasher struct {
-	semaphore   chan struct{}
-	ioTimeout   time.Duration
-	maxFileSize int64
-	logger      *ScannerLogger
-}
-
-// NewRateLimitedHasher creates a new rate-limited hasher
-func NewRateLimitedHasher(maxConcurrent int, ioTimeout time.Duration, maxFileSizeMB int64, logger *ScannerLogger) *RateLimitedHasher {
-	return &RateLimitedHasher{
-		semaphore:   make(chan struct{}, maxConcurrent),
-		ioTimeout:   ioTimeout,
-		maxFileSize: maxFileSizeMB * 1024 * 1024, // Convert MB to bytes
-		logger:      logger,
-	}
-}
-
-// HashWorker processes hashing jobs with rate limiting
-func (rlh *RateLimitedHasher) HashWorker(jobs <-chan FileToHash, results chan<- HashResult) {
-	for job := range jobs {
-		rlh.semaphore <- struct{}{}
-		go func(j FileToHash) {
-			defer func() { <-rlh.semaphore }()
-
-			ctx, cancel := context.WithTimeout(context.Background(), rlh.ioTimeout)
-			defer cancel()
-
-			hash, err := calculateHashWithContext(ctx, j.Path)
-			if err != nil {
-				rlh.logger.logger.WithField("path", j.Path).Warnf("Hash calculation failed: %v", err)
-			}
-
-			results <- HashResult{ID: j.ID, Hash: hash, Err: err}
-		}(job)
-	}
-}
-
 // getFilesByIDChunked safely retrieves files by ID chunks
 func getFilesByIDChunked(ctx context.Context, db *sql.DB, ids []int64) ([]FileToHash, error) {
 	const chunkSize = 1000
@@ -308,82 +257,6 @@ func getFilesByIDChunked(ctx context.Context, db *sql.DB, ids []int64) ([]FileTo
 	return allFiles, nil
 }
 
-// calculateHashWithContext calculates hash with context support (Optimized Version)
-func calculateHashWithContext(ctx context.Context, filePath string) (sql.NullString, error) {
-	// Check if file exists and get size
-	f, err := os.Open(filePath)
-	if err != nil {
-		return sql.NullString{}, err
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
-	if err != nil {
-		return sql.NullString{}, err
-	}
-
-	fileSize := fi.Size()
-
-	// Skip empty files
-	if fileSize == 0 {
-		return sql.NullString{Valid: false}, nil
-	}
-
-	h := md5.New()
-
-	// Dynamic buffer size based on file size for better performance
-	// Small files: smaller buffer, large files: larger buffer
-	var bufSize int
-	switch {
-	case fileSize < 1024*1024: // < 1MB
-		bufSize = 32 * 1024 // 32KB
-	case fileSize < 100*1024*1024: // < 100MB
-		bufSize = 128 * 1024 // 128KB
-	default: // >= 100MB
-		bufSize = 256 * 1024 // 256KB
-	}
-
-	buf := make([]byte, bufSize)
-	var totalRead int64 = 0
-	checkInterval := int64(1024 * 1024) // Check context every 1MB
-
-	// Read file in chunks with optimized context checking
-	for {
-		// Check context periodically (every 1MB) to avoid overhead
-		if totalRead > 0 && totalRead%checkInterval == 0 {
-			select {
-			case <-ctx.Done():
-				return sql.NullString{}, ctx.Err()
-			default:
-			}
-		}
-
-		n, err := f.Read(buf)
-		if n > 0 {
-			if _, writeErr := h.Write(buf[:n]); writeErr != nil {
-				return sql.NullString{}, writeErr
-			}
-			totalRead += int64(n)
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return sql.NullString{}, err
-		}
-
-		// Check context before next read (non-blocking)
-		select {
-		case <-ctx.Done():
-			return sql.NullString{}, ctx.Err()
-		default:
-		}
-	}
-
-	hashStr := hex.EncodeToString(h.Sum(nil))
-	return sql.NullString{String: hashStr, Valid: true}, nil
-}
-
 // =================================================================
 // PHASE 1: SCANNING (METADATA)
 // =================================================================
@@ -392,13 +265,26 @@ func calculateHashWithContext(ctx context.Context, filePath string) (sql.NullStr
 func dbWriterOptimized(ctx context.Context, db *sql.DB, cfg *Config, rx <-chan DbMsg, ready chan<- bool) {
 	logger := NewScannerLogger()
 
+	// Khi bị huỷ (SIGINT/SIGTERM) writer vẫn nhận tiếp tới Shutdown để các scanner không bị
+	// chặn khi gửi, và mọi lệnh ghi dùng context không bị huỷ để batch cuối được commit.
+	cancelled := ctx.Done()
+	ctx = context.WithoutCancel(ctx)
+
 	// Configure database for scan phase
 	configureDB(db, "scan", cfg.MaxWorkers)
 
-	if err := initDDL(ctx, db); err != nil {
-		logger.logger.Fatalf("init DDL failed: %v", err)
+	if cfg.Resume {
+		// DB của lần quét bị ngắt, schema đã có sẵn
+		logger.logger.Info("Phase 1: Resume mode, reusing schema of interrupted scan.")
+	} else if cfg.Incremental {
+		// DB đã được clone từ lần quét trước, schema đã có sẵn
+		logger.logger.Info("Phase 1: Incremental mode, reusing schema of previous scan.")
+	} else {
+		if err := initDDL(ctx, db); err != nil {
+			logger.logger.Fatalf("init DDL failed: %v", err)
+		}
+		logger.logger.Info("Phase 1: Database schema initialized with optimized indexes.")
 	}
-	logger.logger.Info("Phase 1: Database schema initialized with optimized indexes.")
 	ready <- true
 	close(ready)
 
@@ -409,17 +295,22 @@ func dbWriterOptimized(ctx context.Context, db *sql.DB, cfg *Config, rx <-chan D
 	// Initialize retry mechanism for database operations
 	retryOp := NewRetryableOperation()
 
+	// RETURNING id: LastInsertId() không trả về id đúng khi ON CONFLICT rơi vào nhánh UPDATE
 	insertFolderStmt, err := db.PrepareContext(ctx, `
-		INSERT INTO fs_folders (parent_id, path, name, st_mtime, loaithumuc)
-		VALUES (?, ?, ?, ?, ?)
+		INSERT INTO fs_folders (parent_id, path, name, st_mtime, loaithumuc, `+statColumns+`)
+		VALUES (?, ?, ?, ?, ?, `+statPlaceholders+`)
 		ON CONFLICT(path) DO UPDATE SET
-		  parent_id=excluded.parent_id, st_mtime=excluded.st_mtime
+		  parent_id=excluded.parent_id, st_mtime=excluded.st_mtime, loaithumuc=excluded.loaithumuc, incomplete=0, `+statUpdates+`
+		RETURNING id
 	`)
 	if err != nil {
 		logger.logger.Fatalf("Failed to prepare folder statement: %v", err)
 	}
 	defer insertFolderStmt.Close()
 
+	// Thống kê incremental
+	var filesChanged, filesPruned, foldersPruned int64
+
 	flushFiles := func(rows []FileRow) error {
 		if len(rows) == 0 {
 			return nil
@@ -433,32 +324,80 @@ func dbWriterOptimized(ctx context.Context, db *sql.DB, cfg *Config, rx <-chan D
 			}
 			defer tx.Rollback()
 
+			// Chỉ ghi lại row khi size/mtime/folder/ctime/inode/phân loại thay đổi; hash_value/hash_algo/verified_at/partial_hash được giữ nguyên
+			// cho file không đổi để Phase 2 không phải hash lại. chmod/chown làm đổi ctime nên metadata
+			// vẫn được cập nhật; st_atime chỉ được làm mới khi row được ghi lại.
+			// RETURNING id chỉ có dòng khi row được ghi, khi đó fs_tags của file được ghi lại.
 			stmt, err := tx.PrepareContext(ctx, `
-				INSERT INTO fs_files (folder_id, path, dir_path, filename, fileExt, size, st_mtime, loaithumuc, thumuc)
-				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+				INSERT INTO fs_files (folder_id, path, dir_path, filename, fileExt, size, st_mtime, loaithumuc, thumuc, tag_set, `+statColumns+`)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, `+statPlaceholders+`)
 				ON CONFLICT(path) DO UPDATE SET
-				  folder_id=excluded.folder_id, size=excluded.size, st_mtime=excluded.st_mtime
+				  folder_id=excluded.folder_id, size=excluded.size, st_mtime=excluded.st_mtime, loaithumuc=excluded.loaithumuc,
+				  thumuc=excluded.thumuc, tag_set=excluded.tag_set, `+statUpdates+`,
+				  hash_value = CASE WHEN fs_files.size = excluded.size AND fs_files.st_mtime = excluded.st_mtime
+				                    THEN fs_files.hash_value ELSE NULL END,
+				  hash_algo = CASE WHEN fs_files.size = excluded.size AND fs_files.st_mtime = excluded.st_mtime
+				                   THEN fs_files.hash_algo ELSE NULL END,
+				  verified_at = CASE WHEN fs_files.size = excluded.size AND fs_files.st_mtime = excluded.st_mtime
+				                     THEN fs_files.verified_at ELSE NULL END,
+				  dup_class = CASE WHEN fs_files.size = excluded.size AND fs_files.st_mtime = excluded.st_mtime
+				                   THEN fs_files.dup_class ELSE NULL END,
+				  partial_hash = CASE WHEN fs_files.size = excluded.size AND fs_files.st_mtime = excluded.st_mtime
+				                      THEN fs_files.partial_hash ELSE NULL END,
+				  is_duplicate = CASE WHEN fs_files.size = excluded.size AND fs_files.st_mtime = excluded.st_mtime
+				                      THEN fs_files.is_duplicate ELSE 0 END
+				WHERE fs_files.size != excluded.size
+				   OR fs_files.st_mtime != excluded.st_mtime
+				   OR fs_files.folder_id != excluded.folder_id
+				   OR fs_files.st_ctime IS NOT excluded.st_ctime
+				   OR fs_files.st_ino IS NOT excluded.st_ino
+				   OR fs_files.loaithumuc IS NOT excluded.loaithumuc
+				   OR fs_files.thumuc IS NOT excluded.thumuc
+				   OR fs_files.tag_set IS NOT excluded.tag_set
+				RETURNING id
 			`)
 			if err != nil {
 				return err
 			}
 			defer stmt.Close()
+			delTags, err := tx.PrepareContext(ctx, `DELETE FROM fs_tags WHERE file_id = ?`)
+			if err != nil {
+				return err
+			}
+			defer delTags.Close()
+			insTag, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO fs_tags (file_id, kind, tag) VALUES (?, ?, ?)`)
+			if err != nil {
+				return err
+			}
+			defer insTag.Close()
 
+			var changed int64
 			for _, r := range rows {
-				_, err := stmt.ExecContext(ctx,
+				args := append([]any{
 					r.FolderID, r.Path, r.DirPath, r.Filename, r.FileExt, r.Size,
-					r.Mtime, r.LoaiThuMuc, r.ThuMuc,
-				)
+					r.Mtime, r.LoaiThuMuc, r.ThuMuc, tagSet(r.Tags),
+				}, statArgs(r.Stat)...)
+				var id int64
+				err := stmt.QueryRowContext(ctx, args...).Scan(&id)
+				if err == sql.ErrNoRows {
+					continue // file không đổi
+				}
+				if err == nil {
+					err = insertFileTags(ctx, delTags, insTag, id, r.Tags)
+				}
 				if err != nil {
 					logger.logger.WithFields(logrus.Fields{
 						"path":  r.Path,
 						"error": err.Error(),
 					}).Warn("Failed to insert file")
+					continue
 				}
+				changed++
 			}
 			if err := tx.Commit(); err != nil {
 				return fmt.Errorf("batch commit failed: %w", err)
 			}
+			filesChanged += changed
 
 			duration := time.Since(startTime)
 			logger.LogBatchOperation("file_insert", len(rows), duration, nil)
@@ -472,9 +411,14 @@ func dbWriterOptimized(ctx context.Context, db *sql.DB, cfg *Config, rx <-chan D
 loop:
 	for {
 		select {
-		case <-ctx.Done():
-			_ = flushFiles(fileBatch)
-			break loop
+		case <-cancelled:
+			logger.logger.Warn("Phase 1: Shutdown requested, flushing pending rows and draining writer queue")
+			if err := flushFiles(fileBatch); err != nil {
+				logger.logger.WithError(err).Error("Failed to flush file batch")
+			}
+			fileBatch = fileBatch[:0]
+			batchSizer.Reset()
+			cancelled = nil
 		case m, ok := <-rx:
 			if !ok {
 				_ = flushFiles(fileBatch)
@@ -489,15 +433,24 @@ loop:
 					parent.Valid = true
 				}
 
-				// Use retry for folder insertion
-				var res sql.Result
-				var err error
+				// Incremental: so sánh st_mtime với lần quét trước trước khi ghi đè.
+				// Thư mục lần trước liệt kê lỗi (incomplete) hoặc đổi tag (root đổi cấu hình) luôn được liệt kê lại.
+				unchanged := false
+				if cfg.Incremental {
+					var prevMtime time.Time
+					var prevIncomplete bool
+					var prevTag sql.NullString
+					err := db.QueryRowContext(ctx, "SELECT st_mtime, incomplete, loaithumuc FROM fs_folders WHERE path = ?", req.EntryPath).Scan(&prevMtime, &prevIncomplete, &prevTag)
+					unchanged = err == nil && prevMtime.Equal(req.Info.Mtime) && !prevIncomplete && prevTag.String == req.LoaiThuMuc
+				}
 
+				// Use retry for folder insertion
+				var id int64
 				retryErr := retryOp.Execute(func() error {
-					res, err = insertFolderStmt.ExecContext(ctx,
+					args := append([]any{
 						parent, req.EntryPath, req.EntryName, req.Info.Mtime, req.LoaiThuMuc,
-					)
-					return err
+					}, statArgs(req.Info)...)
+					return insertFolderStmt.QueryRowContext(ctx, args...).Scan(&id)
 				})
 
 				if retryErr != nil {
@@ -505,15 +458,67 @@ loop:
 						"path":  req.EntryPath,
 						"error": retryErr.Error(),
 					}).Warn("Failed to insert folder")
-					req.Resp <- -1
+					req.Resp <- DirInsertResp{ID: -1}
 					continue
 				}
+				req.Resp <- DirInsertResp{ID: id, Unchanged: unchanged}
+			}
+
+			if len(m.ScanErrors) > 0 {
+				if err := recordScanErrors(ctx, db, m.ScanErrors); err != nil {
+					logger.logger.WithError(err).Warn("Failed to record scan errors")
+				}
+			}
+
+			if len(m.InsertMounts) > 0 {
+				if err := insertMounts(ctx, db, m.InsertMounts); err != nil {
+					logger.logger.WithError(err).Warn("Failed to record mount points")
+				}
+			}
+
+			if len(m.InsertSpecial) > 0 {
+				if err := retryOp.Execute(func() error { return insertSpecials(ctx, db, m.InsertSpecial) }); err != nil {
+					logger.logger.WithError(err).Warn("Failed to insert special entries")
+				}
+			}
+
+			if m.ListDirs != nil {
+				req := m.ListDirs
+				paths, err := listChildFolders(ctx, db, req.ParentID)
+				if err != nil {
+					logger.logger.WithFields(logrus.Fields{
+						"folderID": req.ParentID,
+						"error":    err.Error(),
+					}).Warn("Failed to list known child folders")
+				}
+				req.Resp <- paths
+			}
+
+			if m.PruneDir != nil {
+				nf, nd, err := pruneDir(ctx, db, m.PruneDir)
+				if err != nil {
+					logger.logger.WithFields(logrus.Fields{
+						"folderID": m.PruneDir.FolderID,
+						"error":    err.Error(),
+					}).Warn("Failed to prune vanished entries")
+				}
+				filesPruned += nf
+				foldersPruned += nd
+			}
 
-				id, _ := res.LastInsertId()
-				if id == 0 {
-					_ = db.QueryRowContext(ctx, "SELECT id FROM fs_folders WHERE path = ?", req.EntryPath).Scan(&id)
+			if m.RootStatus != nil {
+				// File của root có thể còn nằm trong fileBatch: ghi xuống trước khi đánh dấu trạng thái
+				if err := flushFiles(fileBatch); err != nil {
+					logger.logger.WithError(err).Error("Failed to flush file batch")
+				}
+				fileBatch = fileBatch[:0]
+				batchSizer.Reset()
+				if err := updateScanRoot(ctx, db, m.RootStatus); err != nil {
+					logger.logger.WithFields(logrus.Fields{
+						"rootRowID": m.RootStatus.RootRowID,
+						"error":     err.Error(),
+					}).Warn("Failed to update scan_roots")
 				}
-				req.Resp <- id
 			}
 
 			if len(m.InsertFiles) > 0 {
@@ -547,778 +552,971 @@ loop:
 			}
 		}
 	}
+	if cfg.Incremental {
+		logger.logger.WithFields(logrus.Fields{
+			"filesChanged":  filesChanged,
+			"filesPruned":   filesPruned,
+			"foldersPruned": foldersPruned,
+		}).Info("Phase 1: Incremental changes applied")
+	}
 	logger.logger.Info("Phase 1: dbWriter shutting down.")
 }
 
-// dbWriter (legacy function - kept for compatibility)
-func dbWriter(ctx context.Context, db *sql.DB, cfg *Config, rx <-chan DbMsg, ready chan<- bool) {
-	dbWriterOptimized(ctx, db, cfg, rx, ready)
-}
-
-// frame (struct cho scanner)
-type frame struct {
-	path     string
-	folderID int64 // ID của thư mục (từ fs_folders)
-	ents     []os.DirEntry
-	idx      int
-}
-
-// scanRoot (cho scanner Phase 1)
-func scanRoot(root, tag string, tx chan<- DbMsg, exclude map[string]struct{}, batchSize int) (uint64, error) {
-	abs := root
-	if p, err := filepath.Abs(root); err == nil {
-		abs = p
+// startScanRun ghi một dòng scan_runs (status running) kèm snapshot cấu hình và host
+func startScanRun(ctx context.Context, db *sql.DB, cfg *Config, mode string, resumedFrom int64) (int64, error) {
+	snapshot, err := json.Marshal(cfg)
+	if err != nil {
+		return 0, err
 	}
-	fi, err := os.Lstat(abs)
-	if err != nil || !fi.IsDir() {
-		return 0, nil
+	host, _ := os.Hostname()
+	var from sql.NullInt64
+	if resumedFrom > 0 {
+		from = sql.NullInt64{Int64: resumedFrom, Valid: true}
 	}
-	info := statInfo(fi)
-
-	respRoot := make(chan int64, 1)
-	tx <- DbMsg{InsertDir: &DirInsertReq{
-		ParentID:   0,
-		EntryPath:  abs,
-		EntryName:  filepath.Base(strings.TrimRight(abs, string(os.PathSeparator))),
-		Info:       info,
-		LoaiThuMuc: tag,
-		Resp:       respRoot,
-	}}
-	rootID := <-respRoot
-	if rootID <= 0 {
-		return 0, fmt.Errorf("failed to insert root folder: %s", abs)
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO scan_runs (started_at, status, host, mode, resumed_from, config)
+		VALUES (?, 'running', ?, ?, ?, ?)
+	`, time.Now(), host, mode, from, string(snapshot))
+	if err != nil {
+		return 0, err
 	}
+	return res.LastInsertId()
+}
 
-	var totalFiles uint64 = 0
-	filesBatch := make([]FileRow, 0, batchSize)
-	stack := []frame{}
+// finishScanRun chốt trạng thái và tổng số file của lần chạy
+func finishScanRun(ctx context.Context, db *sql.DB, runID int64, status string, totalFiles uint64) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE scan_runs SET finished_at = ?, status = ?, total_files = ? WHERE id = ?
+	`, time.Now(), status, totalFiles, runID)
+	return err
+}
 
-	ents, err := os.ReadDir(abs)
+// addScanRoot ghi một root của lần chạy runID, trả về id của dòng scan_roots
+func addScanRoot(ctx context.Context, db *sql.DB, runID int64, root, tag, status string, fileCount int64) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO scan_roots (run_id, root_path, loaithumuc, status, file_count)
+		VALUES (?, ?, ?, ?, ?)
+	`, runID, root, tag, status, fileCount)
 	if err != nil {
-		log.Printf("ERROR: cannot read root dir %s: %v", abs, err)
 		return 0, err
 	}
-	stack = append(stack, frame{path: abs, folderID: rootID, ents: ents, idx: 0})
-
-	for len(stack) > 0 {
-		top := &stack[len(stack)-1]
+	return res.LastInsertId()
+}
 
-		if top.idx >= len(top.ents) {
-			stack = stack[:len(stack)-1]
-			continue
+// updateScanRoot (dbWriter) cập nhật trạng thái một root: running ghi started_at, done/failed ghi finished_at
+func updateScanRoot(ctx context.Context, db *sql.DB, req *RootStatusReq) error {
+	var errMsg sql.NullString
+	if req.Err != "" {
+		errMsg = sql.NullString{String: req.Err, Valid: true}
+	}
+	if req.Status == "running" {
+		_, err := db.ExecContext(ctx, `UPDATE scan_roots SET status = ?, started_at = ? WHERE id = ?`,
+			req.Status, time.Now(), req.RootRowID)
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `
+		UPDATE scan_roots SET status = ?, finished_at = ?, file_count = ?, error = ? WHERE id = ?
+	`, req.Status, time.Now(), req.FileCount, errMsg, req.RootRowID); err != nil {
+		return err
+	}
+	for id, n := range req.ExcludeHits {
+		if _, err := db.ExecContext(ctx, `UPDATE scan_excludes SET hits = ? WHERE id = ?`, n, id); err != nil {
+			return err
 		}
+	}
+	for _, si := range req.ScanIgnores {
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO scan_excludes (run_id, root_id, scope, kind, pattern, hits)
+			SELECT run_id, id, loaithumuc, 'scanignore', ?, ? FROM scan_roots WHERE id = ?
+		`, si.Path, si.Hits, req.RootRowID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		de := top.ents[top.idx]
-		top.idx++
+// recordScanErrors (dbWriter) ghi lỗi filesystem vào scan_errors và đánh dấu thư mục chứa entry lỗi là incomplete
+func recordScanErrors(ctx context.Context, db *sql.DB, errs []ScanErrorRow) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		name := de.Name()
-		if de.IsDir() {
-			if _, skip := exclude[name]; skip {
-				continue
-			}
+	for _, e := range errs {
+		var folderID, errno sql.NullInt64
+		if e.FolderID > 0 {
+			folderID = sql.NullInt64{Int64: e.FolderID, Valid: true}
 		}
-
-		p := filepath.Join(top.path, name)
-		fi, err := os.Lstat(p)
-		if err != nil {
-			log.Printf("WARN: Lstat failed for %s: %v", p, err)
-			continue
+		if e.Errno != 0 {
+			errno = sql.NullInt64{Int64: int64(e.Errno), Valid: true}
 		}
-		inf := statInfo(fi)
-
-		if fi.IsDir() {
-			respChild := make(chan int64, 1)
-			tx <- DbMsg{InsertDir: &DirInsertReq{
-				ParentID:   top.folderID,
-				EntryPath:  p,
-				EntryName:  name,
-				Info:       inf,
-				LoaiThuMuc: tag,
-				Resp:       respChild,
-			}}
-			childID := <-respChild
-
-			if childID > 0 {
-				chEnts, err := os.ReadDir(p)
-				if err != nil {
-					log.Printf("WARN: cannot read dir %s: %v", p, err)
-				} else {
-					stack = append(stack, frame{path: p, folderID: childID, ents: chEnts, idx: 0})
-				}
-			}
-		} else if fi.Mode().IsRegular() {
-			totalFiles++
-			dirpath := filepath.Dir(p)
-			ext := filepath.Ext(name)
-
-			filesBatch = append(filesBatch, FileRow{
-				FolderID:   top.folderID,
-				Path:       p,
-				DirPath:    dirpath,
-				Filename:   name,
-				FileExt:    ext,
-				Size:       fi.Size(),
-				Mtime:      fi.ModTime(),
-				LoaiThuMuc: tag,
-				ThuMuc:     topFolder(p, 4),
-			})
-
-			if len(filesBatch) >= batchSize {
-				tx <- DbMsg{InsertFiles: filesBatch}
-				filesBatch = filesBatch[:0]
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO scan_errors (run_id, root_id, folder_id, path, op, errno, error, attempts, occurred_at)
+			VALUES ((SELECT run_id FROM scan_roots WHERE id = ?), NULLIF(?, 0), ?, ?, ?, ?, ?, ?, ?)
+		`, e.RootRowID, e.RootRowID, folderID, e.Path, e.Op, errno, e.Err, e.Attempts, e.At); err != nil {
+			return err
+		}
+		if folderID.Valid {
+			if _, err := tx.ExecContext(ctx, `UPDATE fs_folders SET incomplete = 1 WHERE id = ?`, e.FolderID); err != nil {
+				return err
 			}
 		}
 	}
+	return tx.Commit()
+}
 
-	if len(filesBatch) > 0 {
-		tx <- DbMsg{InsertFiles: filesBatch}
+// fsErrno: errno của lỗi filesystem, 0 nếu không phải lỗi hệ thống
+func fsErrno(err error) int {
+	var en syscall.Errno
+	if errors.As(err, &en) {
+		return int(en)
 	}
-	return totalFiles, nil
+	return 0
 }
 
-// =================================================================
-// PHASE 2: HASHING (DUPLICATES)
-// =================================================================
-
-// calculateHash (dùng cho Phase 2)
-func calculateHash(filePath string) (sql.NullString, error) {
-	f, err := os.Open(filePath)
-	if err != nil {
-		return sql.NullString{}, err
+// recordExcludeRules ghi các luật loại trừ có hiệu lực cho một root vào scan_excludes (để biết vì sao một path vắng mặt)
+func recordExcludeRules(ctx context.Context, db *sql.DB, runID, rootRowID int64, m *excludeMatcher) error {
+	for _, r := range m.rules {
+		res, err := db.ExecContext(ctx, `
+			INSERT INTO scan_excludes (run_id, root_id, scope, kind, pattern) VALUES (?, ?, ?, ?, ?)
+		`, runID, rootRowID, r.Scope, r.Kind, r.Pattern)
+		if err != nil {
+			return err
+		}
+		if r.RowID, err = res.LastInsertId(); err != nil {
+			return err
+		}
 	}
-	defer f.Close()
+	return nil
+}
 
-	fi, err := f.Stat()
-	if err != nil {
-		return sql.NullString{}, err
+// completedScanRoots (resume) trả về lần chạy mới nhất và các root đã quét xong của nó (path -> số file)
+func completedScanRoots(ctx context.Context, db *sql.DB) (int64, map[string]int64, error) {
+	var runID int64
+	err := db.QueryRowContext(ctx, `SELECT id FROM scan_runs ORDER BY id DESC LIMIT 1`).Scan(&runID)
+	if err == sql.ErrNoRows {
+		return 0, nil, fmt.Errorf("database has no scan_runs record to resume")
 	}
-	if fi.Size() == 0 {
-		return sql.NullString{Valid: false}, nil
+	if err != nil {
+		return 0, nil, err
 	}
 
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return sql.NullString{}, err
+	rows, err := db.QueryContext(ctx, `
+		SELECT root_path, file_count FROM scan_roots
+		WHERE run_id = ? AND status IN ('done', 'skipped')
+	`, runID)
+	if err != nil {
+		return 0, nil, err
 	}
+	defer rows.Close()
 
-	hashStr := hex.EncodeToString(h.Sum(nil))
-	return sql.NullString{String: hashStr, Valid: true}, nil
-}
-
-// hashWorker (dùng cho Phase 2)
-func hashWorker(jobs <-chan FileToHash, results chan<- HashResult) {
-	for job := range jobs {
-		hash, err := calculateHash(job.Path)
-		if err != nil {
-			log.Printf("WARN: Failed to hash %s (ID: %d): %v", job.Path, job.ID, err)
+	done := map[string]int64{}
+	for rows.Next() {
+		var p string
+		var n int64
+		if err := rows.Scan(&p, &n); err != nil {
+			return 0, nil, err
 		}
-		results <- HashResult{ID: job.ID, Hash: hash, Err: err}
+		done[p] = n
 	}
+	return runID, done, rows.Err()
 }
 
-// runHashingPhaseOptimized (Phase 2 - Optimized Version)
-func runHashingPhaseOptimized(ctx context.Context, db *sql.DB, cfg *Config) {
-	logger := NewScannerLogger()
-	logger.logger.Info("-------------------------------------------------------")
-	logger.logger.Info("Phase 2: Hashing potential duplicates starting...")
-
-	// Configure optimized database connections
-	configureDB(db, "hash", cfg.MaxWorkers)
-
-	// 1) Đếm tổng số file cần hash (để progress) nhưng KHÔNG load toàn bộ rows vào RAM.
-	logger.logger.Info("Phase 2: Counting files needing hash (no in-memory buffering)...")
-	var totalSuspects int64
-	err := db.QueryRowContext(ctx, `
-		SELECT COUNT(*)
-		FROM fs_files f1
-		INNER JOIN (
-			SELECT size
-			FROM fs_files
-			WHERE size > 0 AND hash_value IS NULL
-			GROUP BY size
-			HAVING COUNT(*) > 1
-		) f2 ON f1.size = f2.size
-		WHERE f1.size > 0 AND f1.hash_value IS NULL
-	`).Scan(&totalSuspects)
+// listChildFolders trả về path của các thư mục con đã lưu trong DB của folder parentID
+func listChildFolders(ctx context.Context, db *sql.DB, parentID int64) ([]string, error) {
+	// Mount point bị bỏ qua (ONE_FILESYSTEM) không có trong fs_folders nhưng vẫn cần được ghi lại mỗi lần quét
+	rows, err := db.QueryContext(ctx, `
+		SELECT path FROM fs_folders WHERE parent_id = ?
+		UNION SELECT path FROM scan_mounts WHERE parent_id = ? AND descended = 0
+		ORDER BY path
+	`, parentID, parentID)
 	if err != nil {
-		logger.logger.Fatalf("Phase 2: Failed to count files needing hash: %v", err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	if totalSuspects == 0 {
-		logger.logger.Info("Phase 2: No potential duplicates found. Hashing complete.")
-		logger.logger.Info("-------------------------------------------------------")
-		return
+	var paths []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return paths, err
+		}
+		paths = append(paths, p)
 	}
+	return paths, rows.Err()
+}
 
-	logger.logger.WithFields(logrus.Fields{
-		"totalFiles": totalSuspects,
-	}).Info("Phase 2: Found files needing hashing")
-
-	// 2. Setup worker pool and channels
-	jobs := make(chan FileToHash, cfg.MaxWorkers*2)
-	results := make(chan HashResult, cfg.MaxWorkers*2)
-
-	// 3. Start hash workers (simplified, efficient version) with detailed logging
-	var wgWorkers sync.WaitGroup
-	var hashStats struct {
-		mu           sync.Mutex
-		totalHashed  int64
-		successCount int64
-		errorCount   int64
-		totalSize    int64
-		startTime    time.Time
-	}
-	hashStats.startTime = time.Now()
-
-	for w := 0; w < cfg.MaxWorkers; w++ {
-		wgWorkers.Add(1)
-		go func(workerID int) {
-			defer wgWorkers.Done()
-			for job := range jobs {
-				hashStartTime := time.Now()
-				hash, err := calculateHashWithContext(ctx, job.Path)
-				hashDuration := time.Since(hashStartTime)
-
-				hashStats.mu.Lock()
-				hashStats.totalHashed++
-				if err == nil && hash.Valid {
-					hashStats.successCount++
-				} else {
-					hashStats.errorCount++
-					if err != nil {
-						logger.logger.WithFields(logrus.Fields{
-							"workerID": workerID,
-							"fileID":   job.ID,
-							"path":     job.Path,
-							"error":    err.Error(),
-							"duration": hashDuration.Milliseconds(),
-						}).Debug("Hash calculation failed")
-					}
-				}
-				hashStats.mu.Unlock()
-
-				results <- HashResult{ID: job.ID, Hash: hash, Err: err}
-			}
-		}(w)
+// pruneDir xoá file, entry đặc biệt và cây thư mục con không còn xuất hiện trong lần liệt kê mới của folder
+// (hoặc, với thư mục reused, các entry mà req.Drop loại trừ)
+func pruneDir(ctx context.Context, db *sql.DB, req *PruneDirReq) (filesPruned, foldersPruned int64, err error) {
+	keep := func(seen map[string]struct{}, name string, isDir bool) bool {
+		if req.Drop != nil {
+			return !req.Drop(filepath.Join(req.Path, name), name, isDir)
+		}
+		_, ok := seen[name]
+		return ok
 	}
-
-	// 4. Submit jobs in background
-	go func() {
-		defer close(jobs)
-
-		// Stream rows -> jobs (backpressure qua channel), tránh giữ 4-5 triệu rows trong RAM.
-		logger.logger.Info("Phase 2: Streaming files needing hash to workers...")
-		rows, err := db.QueryContext(ctx, `
-			SELECT f1.id, f1.path
-			FROM fs_files f1
-			INNER JOIN (
-				SELECT size
-				FROM fs_files
-				WHERE size > 0 AND hash_value IS NULL
-				GROUP BY size
-				HAVING COUNT(*) > 1
-			) f2 ON f1.size = f2.size
-			WHERE f1.size > 0 AND f1.hash_value IS NULL
-			ORDER BY f1.size
-		`)
+	type idName struct {
+		id   int64
+		name string
+	}
+	collect := func(query string) ([]idName, error) {
+		rows, err := db.QueryContext(ctx, query, req.FolderID)
 		if err != nil {
-			logger.logger.WithError(err).Error("Phase 2: Failed to query files needing hash")
-			return
+			return nil, err
 		}
 		defer rows.Close()
-
+		var out []idName
 		for rows.Next() {
-			var job FileToHash
-			if err := rows.Scan(&job.ID, &job.Path); err != nil {
-				logger.logger.WithError(err).Warn("Phase 2: Failed to scan file row")
-				continue
-			}
-
-			select {
-			case jobs <- job:
-			case <-ctx.Done():
-				return
+			var it idName
+			if err := rows.Scan(&it.id, &it.name); err != nil {
+				return nil, err
 			}
+			out = append(out, it)
 		}
+		return out, rows.Err()
+	}
 
-		if err := rows.Err(); err != nil {
-			logger.logger.WithError(err).Warn("Phase 2: Row iteration error while streaming hash jobs")
-		}
-	}()
-
-	// 5. Collect results and update database with MULTIPLE smaller transactions
-	logger.logger.Info("Phase 2: Processing hash results and updating database...")
+	files, err := collect("SELECT id, filename FROM fs_files WHERE folder_id = ?")
+	if err != nil {
+		return 0, 0, fmt.Errorf("list files: %w", err)
+	}
+	dirs, err := collect("SELECT id, path FROM fs_folders WHERE parent_id = ?")
+	if err != nil {
+		return 0, 0, fmt.Errorf("list folders: %w", err)
+	}
+	specials, err := collect("SELECT id, filename FROM fs_special WHERE folder_id = ?")
+	if err != nil {
+		return 0, 0, fmt.Errorf("list special entries: %w", err)
+	}
 
-	const batchSize = 500        // Increased batch size for better performance
-	const commitBatchSize = 1000 // Commit every 1000 updates
-	var batch []HashResult
-	var updatedCount int64 = 0
-	var processedCount int64 = 0
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
 
-	// Start a goroutine to close results channel when all workers are done
-	go func() {
-		wgWorkers.Wait()
-		close(results)
-	}()
+	for _, f := range files {
+		if keep(req.SeenFiles, f.name, false) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM fs_files WHERE id = ?", f.id); err != nil {
+			return 0, 0, fmt.Errorf("delete file %d: %w", f.id, err)
+		}
+		filesPruned++
+	}
 
-	// Process results with periodic commits
-	for res := range results {
-		processedCount++
+	for _, sp := range specials {
+		if keep(req.SeenSpecial, sp.name, false) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM fs_special WHERE id = ?", sp.id); err != nil {
+			return 0, 0, fmt.Errorf("delete special entry %d: %w", sp.id, err)
+		}
+	}
 
-		if res.Err == nil && res.Hash.Valid {
-			batch = append(batch, res)
-		} else if res.Err != nil {
-			logger.logger.WithFields(logrus.Fields{
-				"id":    res.ID,
-				"error": res.Err.Error(),
-			}).Debug("Hash calculation failed")
+	for _, d := range dirs {
+		if keep(req.SeenDirs, filepath.Base(d.name), true) {
+			continue
 		}
+		under := subtreeArgs(d.name)
+		res, err := tx.ExecContext(ctx, "DELETE FROM fs_files WHERE "+subtreeCond("dir_path"), under...)
+		if err != nil {
+			return 0, 0, fmt.Errorf("delete files under %s: %w", d.name, err)
+		}
+		n, _ := res.RowsAffected()
+		filesPruned += n
+		if _, err := tx.ExecContext(ctx, "DELETE FROM fs_special WHERE "+subtreeCond("dir_path"), under...); err != nil {
+			return 0, 0, fmt.Errorf("delete special entries under %s: %w", d.name, err)
+		}
+		res, err = tx.ExecContext(ctx, "DELETE FROM fs_folders WHERE "+subtreeCond("path"), under...)
+		if err != nil {
+			return 0, 0, fmt.Errorf("delete folders under %s: %w", d.name, err)
+		}
+		n, _ = res.RowsAffected()
+		foldersPruned += n
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return filesPruned, foldersPruned, nil
+}
 
-		// Commit batch when it reaches commit size
-		if len(batch) >= commitBatchSize {
-			updated := commitHashBatch(ctx, db, batch, logger)
-			updatedCount += int64(updated)
-			batch = batch[:0]
+// pruneRemovedRoots (incremental) xoá dữ liệu của các root không còn trong [paths] (trừ cây con của root còn giữ)
+func pruneRemovedRoots(ctx context.Context, db *sql.DB, roots []string) (int64, error) {
+	keep := make(map[string]struct{}, len(roots))
+	for _, r := range roots {
+		if abs, err := filepath.Abs(r); err == nil {
+			r = abs
 		}
+		keep[r] = struct{}{}
+	}
 
-		// Progress logging every 1000 files with detailed stats
-		if processedCount%1000 == 0 || processedCount == totalSuspects {
-			hashStats.mu.Lock()
-			elapsed := time.Since(hashStats.startTime)
-			avgSpeed := float64(hashStats.totalHashed) / elapsed.Seconds()
-			successRate := float64(hashStats.successCount) / float64(hashStats.totalHashed) * 100
-			currentSuccess := hashStats.successCount
-			currentErrors := hashStats.errorCount
-			hashStats.mu.Unlock()
+	rows, err := db.QueryContext(ctx, "SELECT id, path FROM fs_folders WHERE parent_id IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	var stale []string
+	for rows.Next() {
+		var id int64
+		var p string
+		if err := rows.Scan(&id, &p); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if _, ok := keep[p]; !ok {
+			stale = append(stale, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
 
-			logger.logger.WithFields(logrus.Fields{
-				"processed":    processedCount,
-				"total":        totalSuspects,
-				"updated":      updatedCount,
-				"progress":     fmt.Sprintf("%.1f%%", float64(processedCount)*100/float64(totalSuspects)),
-				"hashed":       currentSuccess,
-				"errors":       currentErrors,
-				"successRate":  fmt.Sprintf("%.2f%%", successRate),
-				"avgSpeed":     fmt.Sprintf("%.2f files/sec", avgSpeed),
-				"elapsed":      elapsed.Seconds(),
-				"remainingEst": fmt.Sprintf("%.0f sec", float64(totalSuspects-processedCount)/avgSpeed),
-			}).Info("Phase 2: Hashing progress")
+	var filesPruned int64
+	for _, p := range stale {
+		// Root cũ nay nằm trong một root khác (OVERLAPPING_ROOTS = merge): gắn lại vào thư mục cha thay vì xoá
+		if parentOf(p, keep) {
+			res, err := db.ExecContext(ctx, `
+				UPDATE fs_folders SET parent_id = (SELECT id FROM fs_folders WHERE path = ?)
+				WHERE path = ? AND EXISTS (SELECT 1 FROM fs_folders WHERE path = ?)
+			`, filepath.Dir(p), p, filepath.Dir(p))
+			if err != nil {
+				return filesPruned, fmt.Errorf("reparent %s: %w", p, err)
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				// Cây con nhận tag của root chứa nó (SKIP_UNCHANGED_DIRS có thể không ghi lại các entry này)
+				args := append([]any{filepath.Dir(p)}, subtreeArgs(p)...)
+				for _, q := range []string{
+					`UPDATE fs_folders SET loaithumuc = (SELECT loaithumuc FROM fs_folders WHERE path = ?) WHERE ` + subtreeCond("path"),
+					`UPDATE fs_files SET loaithumuc = (SELECT loaithumuc FROM fs_folders WHERE path = ?) WHERE ` + subtreeCond("dir_path"),
+					`UPDATE fs_special SET loaithumuc = (SELECT loaithumuc FROM fs_folders WHERE path = ?) WHERE ` + subtreeCond("dir_path"),
+				} {
+					if _, err := db.ExecContext(ctx, q, args...); err != nil {
+						return filesPruned, fmt.Errorf("retag %s: %w", p, err)
+					}
+				}
+				continue
+			}
+		}
+		// Root cũ chứa root mới (ví dụ /share/A thay bằng /share/A/Sub): dữ liệu vừa quét của root mới nằm
+		// dưới p, chỉ xoá phần còn lại của cây p
+		dirCond, pathCond := subtreeCond("dir_path"), subtreeCond("path")
+		under := subtreeArgs(p)
+		for r := range keep {
+			if r != p && withinDir(r, p) {
+				dirCond += " AND NOT " + subtreeCond("dir_path")
+				pathCond += " AND NOT " + subtreeCond("path")
+				under = append(under, subtreeArgs(r)...)
+			}
+		}
+		res, err := db.ExecContext(ctx, "DELETE FROM fs_files WHERE "+dirCond, under...)
+		if err != nil {
+			return filesPruned, fmt.Errorf("delete files under %s: %w", p, err)
+		}
+		n, _ := res.RowsAffected()
+		filesPruned += n
+		if _, err := db.ExecContext(ctx, "DELETE FROM fs_special WHERE "+dirCond, under...); err != nil {
+			return filesPruned, fmt.Errorf("delete special entries under %s: %w", p, err)
+		}
+		if _, err := db.ExecContext(ctx, "DELETE FROM fs_folders WHERE "+pathCond, under...); err != nil {
+			return filesPruned, fmt.Errorf("delete folders under %s: %w", p, err)
 		}
 	}
+	return filesPruned, nil
+}
 
-	// Commit remaining batch
-	if len(batch) > 0 {
-		updated := commitHashBatch(ctx, db, batch, logger)
-		updatedCount += int64(updated)
+// subtreeCond: điều kiện SQL "col là thư mục dir hoặc nằm bên dưới nó" (tham số: subtreeArgs(dir)).
+// So tiền tố theo byte thay vì LIKE 'dir/%': LIKE không phân biệt hoa thường với ASCII và coi '_', '%'
+// trong tên thư mục là ký tự đại diện, nên xoá thư mục "a_b" sẽ xoá nhầm cả thư mục anh em "aXb", "A_B".
+func subtreeCond(col string) string {
+	return fmt.Sprintf("(%s = ? OR (%s >= ? AND %s < ?))", col, col, col)
+}
+
+// subtreeArgs: tham số của subtreeCond — ký tự ngay sau dấu phân cách là cận trên, nên [dir/, dir0)
+// gồm đúng các đường dẫn bên dưới dir
+func subtreeArgs(dir string) []any {
+	prefix := strings.TrimRight(dir, string(os.PathSeparator))
+	return []any{dir, prefix + string(os.PathSeparator), prefix + string(rune(os.PathSeparator+1))}
+}
+
+// parentOf: p nằm bên trong một trong các root (không tính chính root đó)
+func parentOf(p string, roots map[string]struct{}) bool {
+	for r := range roots {
+		if p != r && withinDir(p, r) {
+			return true
+		}
 	}
+	return false
+}
 
-	// Final hash statistics
-	hashStats.mu.Lock()
-	totalElapsed := time.Since(hashStats.startTime)
-	finalSuccessRate := float64(hashStats.successCount) / float64(hashStats.totalHashed) * 100
-	finalAvgSpeed := float64(hashStats.totalHashed) / totalElapsed.Seconds()
-	hashStats.mu.Unlock()
+// Cột metadata stat của fs_files/fs_folders, theo đúng thứ tự của statArgs
+const (
+	statColumns      = `st_uid, st_gid, owner, st_mode, st_atime, st_ctime, st_ino, st_dev, st_nlink, st_blocks`
+	statPlaceholders = `?, ?, ?, ?, ?, ?, ?, ?, ?, ?`
+	statUpdates      = `st_uid=excluded.st_uid, st_gid=excluded.st_gid, owner=excluded.owner,
+		  st_mode=excluded.st_mode, st_atime=excluded.st_atime, st_ctime=excluded.st_ctime,
+		  st_ino=excluded.st_ino, st_dev=excluded.st_dev, st_nlink=excluded.st_nlink, st_blocks=excluded.st_blocks`
+)
 
-	logger.logger.WithFields(logrus.Fields{
-		"totalProcessed": processedCount,
-		"totalUpdated":   updatedCount,
-		"totalHashed":    hashStats.totalHashed,
-		"successCount":   hashStats.successCount,
-		"errorCount":     hashStats.errorCount,
-		"successRate":    fmt.Sprintf("%.2f%%", finalSuccessRate),
-		"avgSpeed":       fmt.Sprintf("%.2f files/sec", finalAvgSpeed),
-		"totalDuration":  totalElapsed.Seconds(),
-	}).Info("Phase 2: Hashing complete")
-
-	// 6. Đánh dấu duplicate files ngay sau khi hash xong
-	logger.logger.Info("Phase 2: Marking duplicate files...")
-	duplicateStats := markDuplicateFiles(ctx, db, logger)
-	logger.logger.WithFields(logrus.Fields{
-		"duplicateGroups": duplicateStats.Groups,
-		"duplicateFiles":  duplicateStats.Files,
-		"duplicateSize":   duplicateStats.TotalSize,
-	}).Info("Phase 2: Duplicate marking complete")
+// statArgs: giá trị cho statColumns (inode/device đổi sang int64 vì driver SQLite không nhận uint64 lớn)
+func statArgs(st StatInfo) []any {
+	return []any{
+		st.Uid, st.Gid, st.Username, st.Mode, st.Atime, st.Ctime,
+		int64(st.Inode), int64(st.Device), int64(st.Nlink), st.Blocks,
+	}
+}
 
-	logger.logger.Info("-------------------------------------------------------")
+// dbWriter (legacy function - kept for compatibility)
+func dbWriter(ctx context.Context, db *sql.DB, cfg *Config, rx <-chan DbMsg, ready chan<- bool) {
+	dbWriterOptimized(ctx, db, cfg, rx, ready)
 }
 
-// DuplicateStats holds statistics about duplicate files
-type DuplicateStats struct {
-	Groups    int64
-	Files     int64
-	TotalSize int64
+// dirJob: một thư mục chờ liệt kê trong hàng đợi của scanRoot
+type dirJob struct {
+	path     string
+	folderID int64       // ID của thư mục (từ fs_folders)
+	reused   bool        // (incremental) thư mục không đổi: lấy thư mục con từ DB, không prune
+	ignore   *scanIgnore // chuỗi .scanignore của các thư mục cha
+	followed bool        // nằm trong cây thư mục đến qua symlink (FOLLOW_SYMLINKS)
+	dev      uint64      // st_dev của thư mục, để phát hiện mount point ở thư mục con
 }
 
-// markDuplicateFiles marks files as duplicates based on hash_value
-func markDuplicateFiles(ctx context.Context, db *sql.DB, logger *ScannerLogger) DuplicateStats {
-	startTime := time.Now()
-	logger.logger.Info("Phase 2: Starting duplicate detection and marking...")
+// dirQueue: hàng đợi LIFO dùng chung giữa các worker của một root. Worker rảnh lấy bất kỳ
+// thư mục nào đang chờ, nên một nhánh lớn được chia cho nhiều worker thay vì chỉ một goroutine.
+type dirQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    []dirJob
+	pending int // thư mục đã push nhưng chưa done
+	closed  bool
+}
 
-	// Query để tìm các hash có >= 2 files (duplicate groups)
-	rows, err := db.QueryContext(ctx, `
-		SELECT hash_value, COUNT(*) as file_count, SUM(size) as total_size, MIN(st_mtime) as first_seen
-		FROM fs_files
-		WHERE hash_value IS NOT NULL AND hash_value != ''
-		GROUP BY hash_value
-		HAVING COUNT(*) > 1
-	`)
-	if err != nil {
-		logger.logger.WithError(err).Error("Failed to query duplicate groups")
-		return DuplicateStats{}
+func newDirQueue() *dirQueue {
+	q := &dirQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *dirQueue) push(j dirJob) {
+	q.mu.Lock()
+	q.jobs = append(q.jobs, j)
+	q.pending++
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// pop chờ đến khi có việc; trả về false khi mọi thư mục đã xong hoặc queue bị đóng
+func (q *dirQueue) pop() (dirJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 && q.pending > 0 && !q.closed {
+		q.cond.Wait()
 	}
-	defer rows.Close()
+	if q.closed || len(q.jobs) == 0 {
+		return dirJob{}, false
+	}
+	j := q.jobs[len(q.jobs)-1]
+	q.jobs = q.jobs[:len(q.jobs)-1]
+	return j, true
+}
 
-	var stats DuplicateStats
-	var duplicateHashes []string
-	var duplicateGroups []struct {
-		hashValue string
-		fileCount int
-		totalSize int64
-		firstSeen time.Time
+// done đánh dấu một thư mục đã xử lý xong (thư mục con của nó đã được push trước đó)
+func (q *dirQueue) done() {
+	q.mu.Lock()
+	q.pending--
+	if q.pending == 0 {
+		q.cond.Broadcast()
 	}
+	q.mu.Unlock()
+}
 
-	for rows.Next() {
-		var hashValue string
-		var fileCount int
-		var totalSize int64
-		var firstSeen time.Time
-		if err := rows.Scan(&hashValue, &fileCount, &totalSize, &firstSeen); err != nil {
-			logger.logger.WithError(err).Warn("Failed to scan duplicate group")
+// close đánh thức mọi worker đang chờ để thoát (khi ctx bị huỷ)
+func (q *dirQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// knownDirEntries (incremental) dựng lại danh sách thư mục con từ DB cho thư mục có st_mtime không đổi.
+// Thư mục con nào không Lstat được thì bỏ qua; file trong thư mục giữ nguyên như lần quét trước.
+// follow: giữ cả symlink đã được duyệt như thư mục ở lần trước (FOLLOW_SYMLINKS).
+func knownDirEntries(folderID int64, tx chan<- DbMsg, follow bool) []os.DirEntry {
+	resp := make(chan []string, 1)
+	tx <- DbMsg{ListDirs: &ListDirsReq{ParentID: folderID, Resp: resp}}
+	paths := <-resp
+
+	ents := make([]os.DirEntry, 0, len(paths))
+	for _, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil || !(fi.IsDir() || follow && fi.Mode()&fs.ModeSymlink != 0) {
 			continue
 		}
-		duplicateHashes = append(duplicateHashes, hashValue)
-		duplicateGroups = append(duplicateGroups, struct {
-			hashValue string
-			fileCount int
-			totalSize int64
-			firstSeen time.Time
-		}{hashValue, fileCount, totalSize, firstSeen})
-		stats.Groups++
-		stats.Files += int64(fileCount)
-		stats.TotalSize += totalSize
-	}
-
-	if len(duplicateHashes) == 0 {
-		logger.logger.Info("Phase 2: No duplicate groups found")
-		return stats
+		ents = append(ents, fs.FileInfoToDirEntry(fi))
 	}
+	return ents
+}
 
-	logger.logger.WithFields(logrus.Fields{
-		"groupsFound": stats.Groups,
-		"filesFound":  stats.Files,
-		"totalSizeMB": float64(stats.TotalSize) / 1024 / 1024,
-	}).Info("Phase 2: Found duplicate groups, starting marking process...")
-
-	// 1. Đánh dấu is_duplicate = 1 cho tất cả file có hash trong duplicate groups
-	markStartTime := time.Now()
-	placeholders := strings.Repeat("?,", len(duplicateHashes))
-	placeholders = placeholders[:len(placeholders)-1] // Remove trailing comma
+// rootWalker: trạng thái dùng chung của các worker khi quét một root
+type rootWalker struct {
+	ctx       context.Context
+	tag       string
+	tx        chan<- DbMsg
+	cfg       *Config
+	excl      *excludeMatcher
+	tags      *tagger     // thumuc + fs_tags của file
+	gate      *workerGate // số worker liệt kê thư mục cùng lúc (chung mọi root, ADAPTIVE); nil = không giới hạn
+	queue     *dirQueue
+	batchSize int
+	rootRowID int64               // scan_roots.id, gắn vào scan_errors
+	retry     *RetryableOperation // retry lỗi tạm thời của Lstat/ReadDir/Readlink
+
+	root     string   // đường dẫn tuyệt đối của root
+	realRoot string   // root sau khi resolve symlink, để xét target của link nằm trong/ngoài root
+	visited  sync.Map // devIno -> struct{}: thư mục đã duyệt (chỉ dùng khi FOLLOW_SYMLINKS)
+	rootDev  uint64
+	mounts   map[string]MountInfo // bảng mount của hệ thống (chỉ đọc sau khi khởi tạo)
+	nested   map[string]struct{}  // root con được quét riêng (OVERLAPPING_ROOTS = nested), không duyệt vào
+
+	totalFiles  atomic.Uint64
+	skippedDirs atomic.Uint64
+	scanErrors  atomic.Uint64
+
+	specialEntries atomic.Uint64
+	brokenLinks    atomic.Uint64
+	outsideLinks   atomic.Uint64
+	followedLinks  atomic.Uint64
+
+	mountPoints   atomic.Uint64
+	skippedMounts atomic.Uint64
+}
 
-	markQuery := fmt.Sprintf(`
-		UPDATE fs_files 
-		SET is_duplicate = 1 
-		WHERE hash_value IN (%s) AND hash_value IS NOT NULL
-	`, placeholders)
+// recordError ghi lỗi filesystem (đã retry) của entry p vào scan_errors; folderID bị đánh dấu incomplete
+func (w *rootWalker) recordError(folderID int64, p, op string, err error, attempts int) {
+	w.scanErrors.Add(1)
+	w.tx <- DbMsg{ScanErrors: []ScanErrorRow{{
+		RootRowID: w.rootRowID,
+		FolderID:  folderID,
+		Path:      p,
+		Op:        op,
+		Errno:     fsErrno(err),
+		Err:       err.Error(),
+		Attempts:  attempts,
+		At:        time.Now(),
+	}}}
+}
 
-	args := make([]interface{}, len(duplicateHashes))
-	for i, hash := range duplicateHashes {
-		args[i] = hash
+// scanDir liệt kê một thư mục: ghi file vào batch của worker, đưa thư mục con vào queue.
+// Chỉ trả lỗi khi không đọc được thư mục (đã ghi scan_errors, thư mục bị đánh dấu incomplete);
+// khi ctx bị huỷ giữa chừng thì không prune.
+func (w *rootWalker) scanDir(j dirJob, batch *[]FileRow) error {
+	var ents []os.DirEntry
+	if j.reused {
+		ents = knownDirEntries(j.folderID, w.tx, w.cfg.FollowSymlinks)
+	} else {
+		attempts, err := w.retry.Attempts(func() (err error) {
+			ents, err = os.ReadDir(j.path)
+			return err
+		})
+		if err != nil {
+			w.recordError(j.folderID, j.path, "readdir", err, attempts)
+			return err
+		}
 	}
 
-	result, err := db.ExecContext(ctx, markQuery, args...)
-	if err != nil {
-		logger.logger.WithError(err).Error("Failed to mark duplicate files")
-		return stats
+	// .scanignore của thư mục này (thư mục reused không có danh sách file nên đọc thẳng)
+	ignore := j.ignore
+	if j.reused || hasEntry(ents, scanIgnoreName) {
+		ignore = w.excl.loadScanIgnore(j.path, ignore)
 	}
 
-	markedCount, _ := result.RowsAffected()
-	markDuration := time.Since(markStartTime)
-	logger.logger.WithFields(logrus.Fields{
-		"filesMarked": markedCount,
-		"duration":    markDuration.Milliseconds(),
-	}).Info("Phase 2: Marked duplicate files")
-
-	// 2. Insert/Update vào bảng duplicate_groups
-	groupStartTime := time.Now()
-	tx, err := db.Begin()
-	if err != nil {
-		logger.logger.WithError(err).Error("Failed to begin transaction for duplicate_groups")
-		return stats
+	var seenFiles, seenDirs, seenSpecial map[string]struct{}
+	if w.cfg.Incremental && !j.reused {
+		seenFiles = make(map[string]struct{}, len(ents))
+		seenDirs = map[string]struct{}{}
+		seenSpecial = map[string]struct{}{}
 	}
+	var specials []SpecialRow
 
-	stmt, err := tx.PrepareContext(ctx, `
-		INSERT INTO duplicate_groups (hash_value, file_count, total_size, first_seen, last_updated)
-		VALUES (?, ?, ?, ?, ?)
-		ON CONFLICT(hash_value) DO UPDATE SET
-			file_count = excluded.file_count,
-			total_size = excluded.total_size,
-			last_updated = excluded.last_updated
-	`)
-	if err != nil {
-		tx.Rollback()
-		logger.logger.WithError(err).Error("Failed to prepare duplicate_groups statement")
-		return stats
-	}
+	for _, de := range ents {
+		if w.ctx.Err() != nil {
+			return nil
+		}
 
-	now := time.Now()
-	groupsInserted := 0
-	for _, group := range duplicateGroups {
-		if _, err := stmt.ExecContext(ctx, group.hashValue, group.fileCount, group.totalSize, group.firstSeen, now); err != nil {
-			logger.logger.WithFields(logrus.Fields{
-				"hash":  group.hashValue,
-				"error": err.Error(),
-			}).Warn("Failed to insert duplicate group")
+		name := de.Name()
+		p := filepath.Join(j.path, name)
+		if w.excl.match(p, name, de.IsDir()) != nil {
+			continue
+		}
+		if ignore != nil && ignore.match(p, de.IsDir()) {
 			continue
 		}
-		groupsInserted++
-	}
-	stmt.Close()
 
-	if err := tx.Commit(); err != nil {
-		logger.logger.WithError(err).Error("Failed to commit duplicate_groups")
-		return stats
-	}
+		var fi os.FileInfo
+		attempts, err := w.retry.Attempts(func() (err error) {
+			fi, err = os.Lstat(p)
+			return err
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // bị xoá giữa ReadDir và Lstat
+		}
+		if err != nil {
+			log.Printf("WARN: Lstat failed for %s: %v", p, err)
+			w.recordError(j.folderID, p, "lstat", err, attempts)
+			// Giữ nguyên dữ liệu cũ của entry (không prune) khi không stat được
+			if seenFiles != nil {
+				seenFiles[name] = struct{}{}
+				seenDirs[name] = struct{}{}
+				seenSpecial[name] = struct{}{}
+			}
+			continue
+		}
+		inf := statInfo(fi)
 
-	groupDuration := time.Since(groupStartTime)
-	totalDuration := time.Since(startTime)
+		if fi.IsDir() {
+			// Trong cây đến qua symlink, thư mục đã duyệt qua đường khác thì bỏ qua để không ghi trùng
+			if w.cfg.FollowSymlinks && !w.markVisited(inf) && j.followed {
+				log.Printf("INFO: %s already scanned via another symlink, skipped", p)
+				continue
+			}
+			if _, ok := w.nested[p]; ok {
+				// Root con tự ghi fs_folders với tag riêng; giữ trong seenDirs để không bị prune
+				if seenDirs != nil {
+					seenDirs[name] = struct{}{}
+				}
+				continue
+			}
+			if m, ok := w.crossesMount(j, p, inf); ok {
+				w.recordMount(j, p, inf, m, !w.cfg.OneFileSystem)
+				if w.cfg.OneFileSystem {
+					continue // không ghi fs_folders: dữ liệu cũ bên dưới (nếu có) bị prune
+				}
+			}
+			if seenDirs != nil {
+				seenDirs[name] = struct{}{}
+			}
+			w.pushDir(j, p, name, inf, ignore, j.followed)
+		} else if !fi.Mode().IsRegular() {
+			if seenSpecial != nil {
+				seenSpecial[name] = struct{}{}
+			}
+			sp := SpecialRow{
+				FolderID:   j.folderID,
+				Path:       p,
+				DirPath:    j.path,
+				Filename:   name,
+				EntryType:  specialType(fi.Mode()),
+				LoaiThuMuc: w.tag,
+				Mtime:      fi.ModTime(),
+				Stat:       inf,
+			}
+			w.specialEntries.Add(1)
+			if sp.EntryType == "symlink" {
+				target := w.resolveLink(&sp)
+				if !sp.TargetOK {
+					w.brokenLinks.Add(1)
+				}
+				if sp.Outside {
+					w.outsideLinks.Add(1)
+				}
+				if target != nil && target.IsDir() && w.cfg.FollowSymlinks {
+					tinf := statInfo(target)
+					if w.shouldFollow(&sp, tinf) {
+						// Thư mục target được ghi dưới đường dẫn của link
+						w.followedLinks.Add(1)
+						if seenDirs != nil {
+							seenDirs[name] = struct{}{}
+						}
+						w.pushDir(j, p, name, tinf, ignore, true)
+					}
+				}
+			}
+			specials = append(specials, sp)
+		} else {
+			if seenFiles != nil {
+				seenFiles[name] = struct{}{}
+			}
+			w.totalFiles.Add(1)
 
-	logger.logger.WithFields(logrus.Fields{
-		"duplicateGroups": stats.Groups,
-		"duplicateFiles":  stats.Files,
-		"duplicateSizeMB": fmt.Sprintf("%.2f", float64(stats.TotalSize)/1024/1024),
-		"duplicateSizeGB": fmt.Sprintf("%.2f", float64(stats.TotalSize)/1024/1024/1024),
-		"groupsInserted":  groupsInserted,
-		"markDuration":    markDuration.Milliseconds(),
-		"groupDuration":   groupDuration.Milliseconds(),
-		"totalDuration":   totalDuration.Milliseconds(),
-	}).Info("Phase 2: Duplicate detection and marking completed successfully")
-
-	return stats
-}
+			thumuc, tags := w.tags.classify(p)
+			*batch = append(*batch, FileRow{
+				FolderID:   j.folderID,
+				Path:       p,
+				DirPath:    j.path,
+				Filename:   name,
+				FileExt:    filepath.Ext(name),
+				Size:       fi.Size(),
+				Mtime:      fi.ModTime(),
+				LoaiThuMuc: w.tag,
+				ThuMuc:     thumuc,
+				Tags:       tags,
+				Stat:       inf,
+			})
 
-// commitHashBatch commits a batch of hash updates in a single transaction
-func commitHashBatch(ctx context.Context, db *sql.DB, batch []HashResult, logger *ScannerLogger) int {
-	if len(batch) == 0 {
-		return 0
+			if len(*batch) >= w.batchSize {
+				w.tx <- DbMsg{InsertFiles: *batch}
+				*batch = make([]FileRow, 0, w.batchSize)
+			}
+		}
 	}
 
-	startTime := time.Now()
-	tx, err := db.Begin()
-	if err != nil {
-		logger.logger.WithError(err).Error("Failed to begin transaction for hash batch")
-		return 0
+	if len(specials) > 0 {
+		w.tx <- DbMsg{InsertSpecial: specials}
+	}
+	if seenFiles != nil {
+		w.tx <- DbMsg{PruneDir: &PruneDirReq{
+			FolderID:    j.folderID,
+			SeenFiles:   seenFiles,
+			SeenDirs:    seenDirs,
+			SeenSpecial: seenSpecial,
+		}}
+	}
+	if j.reused {
+		// Entry cũ của thư mục reused không đi qua vòng lặp trên: luật loại trừ mới (config, .scanignore)
+		// phải được áp dụng lên dữ liệu mang sang từ lần quét trước
+		w.tx <- DbMsg{PruneDir: &PruneDirReq{
+			FolderID: j.folderID,
+			Path:     j.path,
+			Drop: func(p, name string, isDir bool) bool {
+				return w.excl.match(p, name, isDir) != nil || ignore != nil && ignore.match(p, isDir)
+			},
+		}}
+	}
+	return nil
+}
+
+// pushDir ghi thư mục con p (stat inf) của j vào fs_folders rồi đưa vào queue để liệt kê
+func (w *rootWalker) pushDir(j dirJob, p, name string, inf StatInfo, ignore *scanIgnore, followed bool) {
+	respChild := make(chan DirInsertResp, 1)
+	w.tx <- DbMsg{InsertDir: &DirInsertReq{
+		ParentID:   j.folderID,
+		EntryPath:  p,
+		EntryName:  name,
+		Info:       inf,
+		LoaiThuMuc: w.tag,
+		Resp:       respChild,
+	}}
+	child := <-respChild
+	if child.ID > 0 {
+		reused := w.cfg.Incremental && w.cfg.SkipUnchangedDirs && child.Unchanged
+		if reused {
+			w.skippedDirs.Add(1)
+		}
+		w.queue.push(dirJob{path: p, folderID: child.ID, reused: reused, ignore: ignore, followed: followed, dev: inf.Device})
 	}
+}
 
-	// Use prepared statement for better performance
-	stmt, err := tx.PrepareContext(ctx, `UPDATE fs_files SET hash_value = ? WHERE id = ?`)
-	if err != nil {
-		tx.Rollback()
-		logger.logger.WithError(err).Error("Failed to prepare update statement")
-		return 0
+// hasEntry: ents có entry tên name (không phải thư mục) hay không
+func hasEntry(ents []os.DirEntry, name string) bool {
+	for _, de := range ents {
+		if de.Name() == name && !de.IsDir() {
+			return true
+		}
 	}
+	return false
+}
 
-	updated := 0
-	failed := 0
-	for _, res := range batch {
-		if _, err := stmt.ExecContext(ctx, res.Hash.String, res.ID); err != nil {
-			failed++
-			logger.logger.WithFields(logrus.Fields{
-				"id":    res.ID,
-				"error": err.Error(),
-			}).Debug("Failed to update hash")
-		} else {
-			updated++
+// work: vòng lặp của một worker, lấy thư mục từ queue đến khi hết việc
+func (w *rootWalker) work() {
+	batch := make([]FileRow, 0, w.batchSize)
+	for {
+		j, ok := w.queue.pop()
+		if !ok {
+			break
+		}
+		if !w.gate.enter() {
+			w.queue.done()
+			break
+		}
+		if err := w.scanDir(j, &batch); err != nil {
+			log.Printf("WARN: cannot read dir %s: %v", j.path, err)
 		}
+		w.gate.leave()
+		w.queue.done()
 	}
-	stmt.Close()
+	if len(batch) > 0 {
+		w.tx <- DbMsg{InsertFiles: batch}
+	}
+}
 
-	if err := tx.Commit(); err != nil {
-		logger.logger.WithError(err).Error("Failed to commit hash batch")
-		return 0
+// scanRoot (cho scanner Phase 1)
+// Thư mục gốc được liệt kê trước, sau đó cfg.workersForRoot(root) worker chia nhau các thư mục con
+// qua dirQueue; gate (ADAPTIVE) giới hạn số worker thực sự chạy cùng lúc. parent_id/folder_id lấy từ ID do dbWriter trả về nên không phụ thuộc thứ tự duyệt.
+// Khi ctx bị huỷ, dừng ngay (không prune các thư mục đang dở) và trả về ctx.Err().
+func scanRoot(ctx context.Context, root, tag string, tx chan<- DbMsg, cfg *Config, excl *excludeMatcher, tags *tagger, gate *workerGate, batchSize int, rootRowID int64) (uint64, error) {
+	abs := root
+	if p, err := filepath.Abs(root); err == nil {
+		abs = p
+	}
+	retry := NewFSRetryableOperation()
+	var fi os.FileInfo
+	attempts, err := retry.Attempts(func() (err error) {
+		fi, err = os.Lstat(abs)
+		return err
+	})
+	if err == nil && !fi.IsDir() {
+		err = &fs.PathError{Op: "lstat", Path: abs, Err: syscall.ENOTDIR}
+	}
+	if err != nil {
+		// Root không truy cập được: ghi lỗi để root không bị hiểu là rỗng
+		tx <- DbMsg{ScanErrors: []ScanErrorRow{{
+			RootRowID: rootRowID, Path: abs, Op: "lstat", Errno: fsErrno(err), Err: err.Error(), Attempts: attempts, At: time.Now(),
+		}}}
+		return 0, fmt.Errorf("cannot access root: %w", err)
 	}
+	info := statInfo(fi)
 
-	duration := time.Since(startTime)
-	logger.LogBatchOperation("hash_update", updated, duration, nil)
+	respRoot := make(chan DirInsertResp, 1)
+	tx <- DbMsg{InsertDir: &DirInsertReq{
+		ParentID:   0,
+		EntryPath:  abs,
+		EntryName:  filepath.Base(strings.TrimRight(abs, string(os.PathSeparator))),
+		Info:       info,
+		LoaiThuMuc: tag,
+		Resp:       respRoot,
+	}}
+	rootResp := <-respRoot
+	rootID := rootResp.ID
+	if rootID <= 0 {
+		return 0, fmt.Errorf("failed to insert root folder: %s", abs)
+	}
 
-	// Detailed logging for batch commit
-	if updated > 0 {
-		logger.logger.WithFields(logrus.Fields{
-			"batchSize":  len(batch),
-			"updated":    updated,
-			"failed":     failed,
-			"duration":   duration.Milliseconds(),
-			"throughput": fmt.Sprintf("%.2f updates/sec", float64(updated)/duration.Seconds()),
-		}).Debug("Hash batch committed")
+	w := &rootWalker{
+		ctx:       ctx,
+		tag:       tag,
+		tx:        tx,
+		cfg:       cfg,
+		excl:      excl,
+		tags:      tags,
+		gate:      gate,
+		queue:     newDirQueue(),
+		batchSize: batchSize,
+		rootRowID: rootRowID,
+		retry:     retry,
+		root:      abs,
+		realRoot:  abs,
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		w.realRoot = real
+	}
+	if cfg.FollowSymlinks {
+		w.markVisited(info)
+	}
+	w.rootDev, w.mounts = info.Device, mountTable()
+	if nested := cfg.NestedRoots[abs]; len(nested) > 0 {
+		w.nested = make(map[string]struct{}, len(nested))
+		for _, p := range nested {
+			w.nested[p] = struct{}{}
+		}
 	}
+	tx <- DbMsg{InsertMounts: []MountRow{{
+		RootRowID: rootRowID, Path: abs, Device: info.Device, Mount: mountOf(w.mounts, w.realRoot), Root: true,
+	}}}
+	stop := context.AfterFunc(ctx, w.queue.close)
+	defer stop()
 
-	return updated
-}
+	rootJob := dirJob{path: abs, folderID: rootID, dev: info.Device}
+	if cfg.Incremental && cfg.SkipUnchangedDirs && rootResp.Unchanged {
+		w.skippedDirs.Add(1)
+		rootJob.reused = true
+	}
+	batch := make([]FileRow, 0, batchSize)
+	if err := w.scanDir(rootJob, &batch); err != nil {
+		log.Printf("ERROR: cannot read root dir %s: %v", abs, err)
+		return 0, err
+	}
+	if len(batch) > 0 {
+		tx <- DbMsg{InsertFiles: batch}
+	}
 
-// configureDB configures database connection settings for optimal performance
-func configureDB(db *sql.DB, phase string, workers int) {
-	switch phase {
-	case "scan":
-		// Phase 1: Write-heavy, single connection is optimal
-		db.SetMaxOpenConns(1)
-		db.SetMaxIdleConns(1)
-	case "hash":
-		// Phase 2: Read-heavy operations
-		db.SetMaxOpenConns(workers + 2)
-		db.SetMaxIdleConns(workers)
-		db.SetConnMaxLifetime(time.Hour)
-		db.SetConnMaxIdleTime(time.Minute * 30)
-	case "delete":
-		// Deletion: Mixed read/write operations
-		db.SetMaxOpenConns(2)
-		db.SetMaxIdleConns(1)
-		db.SetConnMaxLifetime(30 * time.Minute)
-	case "report":
-		// Reporting: Read-only operations, optimized for complex queries
-		db.SetMaxOpenConns(2)
-		db.SetMaxIdleConns(1)
-		db.SetConnMaxLifetime(10 * time.Minute)
-	}
-
-	// Optimize SQLite settings for performance
-	db.Exec("PRAGMA journal_mode = WAL")
-	db.Exec("PRAGMA synchronous = NORMAL")
-	db.Exec("PRAGMA cache_size = -64000") // 64MB cache
-	db.Exec("PRAGMA temp_store = MEMORY")
-	db.Exec("PRAGMA mmap_size = 268435456") // 256MB memory map
-	db.Exec("PRAGMA busy_timeout = 5000")
-
-	// Additional optimizations for specific phases
-	switch phase {
-	case "delete":
-		db.Exec("PRAGMA foreign_keys = ON")
-	case "report":
-		db.Exec("PRAGMA query_only = 1")        // Read-only for reporting
-		db.Exec("PRAGMA cache_size = -128000")  // 128MB cache for reporting
-		db.Exec("PRAGMA mmap_size = 536870912") // 512MB memory map for reporting
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.workersForRoot(root); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
 	}
-}
+	wg.Wait()
 
-// runHashingPhase (legacy function - kept for compatibility)
-func runHashingPhase(ctx context.Context, db *sql.DB, cfg *Config) {
-	runHashingPhaseOptimized(ctx, db, cfg)
+	totalFiles := w.totalFiles.Load()
+	if err := ctx.Err(); err != nil {
+		return totalFiles, err
+	}
+	if n := w.skippedDirs.Load(); n > 0 {
+		log.Printf("INFO: incremental %s: %d unchanged dirs not re-listed", abs, n)
+	}
+	if stats := excl.scanIgnoreStats(); len(stats) > 0 {
+		var hits int64
+		for _, s := range stats {
+			hits += s.Hits
+		}
+		log.Printf("INFO: %s: %d %s files excluded %d entries", abs, len(stats), scanIgnoreName, hits)
+	}
+	if n := w.scanErrors.Load(); n > 0 {
+		log.Printf("WARN: %s: %d filesystem errors recorded in scan_errors, affected folders marked incomplete", abs, n)
+	}
+	if n := w.skippedMounts.Load(); n > 0 {
+		log.Printf("INFO: %s: %d mount points not descended (one-filesystem), see scan_mounts", abs, n)
+	} else if n := w.mountPoints.Load(); n > 0 {
+		log.Printf("INFO: %s: crossed %d mount points, see scan_mounts", abs, n)
+	}
+	if n := w.specialEntries.Load(); n > 0 {
+		log.Printf("INFO: %s: %d special entries (symlinks: %d broken, %d pointing outside root, %d followed)",
+			abs, n, w.brokenLinks.Load(), w.outsideLinks.Load(), w.followedLinks.Load())
+	}
+	return totalFiles, nil
 }
 
 // =================================================================
-// DYNAMIC CONFIGURATION
+// PHASE 2: HASHING (DUPLICATES)
 // =================================================================
 
-// DynamicConfig implements runtime configuration adjustment
-type DynamicConfig struct {
-	*Config
-	logger         *ScannerLogger
-	memLimit       int64
-	lastAdjustment time.Time
-
-	// Runtime tunable parameters
-	AdjustedBatchSize int
-	AdjustedWorkers   int
-	AdjustedTimeout   time.Duration
-}
-
-// NewDynamicConfig creates a new dynamic configuration
-func NewDynamicConfig(baseCfg *Config, memLimitMB int64, logger *ScannerLogger) *DynamicConfig {
-	return &DynamicConfig{
-		Config:            baseCfg,
-		logger:            logger,
-		memLimit:          memLimitMB * 1024 * 1024, // Convert to bytes
-		lastAdjustment:    time.Now(),
-		AdjustedBatchSize: baseCfg.BatchSize,
-		AdjustedWorkers:   baseCfg.MaxWorkers,
-		AdjustedTimeout:   30 * time.Second,
+// calculateHash (dùng cho Phase 2); algo rỗng = HASH_ALGO mặc định
+func calculateHash(filePath, algo string) (sql.NullString, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return sql.NullString{}, err
 	}
-}
-
-// AutoAdjust dynamically adjusts configuration based on system conditions
-func (dc *DynamicConfig) AutoAdjust() {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
+	defer f.Close()
 
-	// Only adjust every 30 seconds
-	if time.Since(dc.lastAdjustment) < 30*time.Second {
-		return
+	fi, err := f.Stat()
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	if fi.Size() == 0 {
+		return sql.NullString{Valid: false}, nil
 	}
 
-	adjusted := false
-
-	// Adjust batch size based on memory pressure
-	if m.Alloc > uint64(float64(dc.memLimit)*0.8) {
-		// Reduce batch size if memory pressure is high
-		newBatchSize := max(100, dc.AdjustedBatchSize/2)
-		if newBatchSize != dc.AdjustedBatchSize {
-			dc.logger.logger.WithFields(logrus.Fields{
-				"oldBatchSize": dc.AdjustedBatchSize,
-				"newBatchSize": newBatchSize,
-				"memoryUsage":  m.Alloc,
-				"memoryLimit":  dc.memLimit,
-			}).Info("Reducing batch size due to memory pressure")
-			dc.AdjustedBatchSize = newBatchSize
-			adjusted = true
-		}
-	} else if m.Alloc < uint64(float64(dc.memLimit)*0.4) {
-		// Increase batch size if memory usage is low
-		newBatchSize := min(10000, dc.AdjustedBatchSize*3/2)
-		if newBatchSize != dc.AdjustedBatchSize {
-			dc.logger.logger.WithFields(logrus.Fields{
-				"oldBatchSize": dc.AdjustedBatchSize,
-				"newBatchSize": newBatchSize,
-				"memoryUsage":  m.Alloc,
-				"memoryLimit":  dc.memLimit,
-			}).Info("Increasing batch size due to low memory usage")
-			dc.AdjustedBatchSize = newBatchSize
-			adjusted = true
-		}
-	}
-
-	// Adjust worker count based on CPU usage
-	if adjusted || time.Since(dc.lastAdjustment) > time.Minute {
-		cpuCount := runtime.NumCPU()
-		loadPercent := getCPULoad()
-
-		if loadPercent > 80 {
-			// Reduce workers if CPU is busy
-			newWorkers := max(1, dc.AdjustedWorkers-1)
-			if newWorkers != dc.AdjustedWorkers {
-				dc.logger.logger.WithFields(logrus.Fields{
-					"oldWorkers": dc.AdjustedWorkers,
-					"newWorkers": newWorkers,
-					"cpuLoad":    loadPercent,
-				}).Info("Reducing worker count due to high CPU usage")
-				dc.AdjustedWorkers = newWorkers
-			}
-		} else if loadPercent < 40 && dc.AdjustedWorkers < cpuCount*2 {
-			// Increase workers if CPU is available
-			newWorkers := min(cpuCount*2, dc.AdjustedWorkers+1)
-			if newWorkers != dc.AdjustedWorkers {
-				dc.logger.logger.WithFields(logrus.Fields{
-					"oldWorkers": dc.AdjustedWorkers,
-					"newWorkers": newWorkers,
-					"cpuLoad":    loadPercent,
-				}).Info("Increasing worker count due to low CPU usage")
-				dc.AdjustedWorkers = newWorkers
-			}
-		}
+	h, err := newHasher(algo)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return sql.NullString{}, err
 	}
 
-	dc.lastAdjustment = time.Now()
+	hashStr := hex.EncodeToString(h.Sum(nil))
+	return sql.NullString{String: hashStr, Valid: true}, nil
 }
 
-// getCPULoad estimates CPU load (simplified version)
-func getCPULoad() float64 {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-
-	// Use GC pause as a rough indicator of system load
-	// This is a simplified approach - in production you might want to use
-	// system-specific CPU metrics
-	if m.NumGC > 0 {
-		return float64(m.PauseTotalNs) / float64(m.NumGC) / float64(time.Millisecond) * 100
+// hashWorker (dùng cho Phase 2)
+func hashWorker(jobs <-chan FileToHash, results chan<- HashResult, algo string) {
+	for job := range jobs {
+		hash, err := calculateHash(job.Path, algo)
+		if err != nil {
+			log.Printf("WARN: Failed to hash %s (ID: %d): %v", job.Path, job.ID, err)
+		}
+		results <- HashResult{ID: job.ID, Hash: hash, Err: err}
 	}
-	return 0.0
+}
+
+// runHashingPhase (legacy function - kept for compatibility)
+func runHashingPhase(ctx context.Context, db *sql.DB, cfg *Config) {
+	runHashingPhaseOptimized(ctx, db, cfg, nil, HashScope{})
 }
 
 // =================================================================
@@ -1326,6 +1524,150 @@ func getCPULoad() float64 {
 // =================================================================
 
 func main() {
+	// Cấu hình: config.ini < biến môi trường SCANDIR_* < cờ dòng lệnh
+	defaultConfig := "config.ini"
+	if v, ok := os.LookupEnv(envPrefix + "CONFIG"); ok {
+		defaultConfig = v
+	}
+	configPath := flag.String("config", defaultConfig, "Path to config.ini (empty = defaults + SCANDIR_* environment only)")
+	dbOut := flag.String("db", "", "Output database path (default: <output_dir>/scan_<timestamp>.db); with -phase hash: existing scan DB")
+	roots := flag.String("roots", "", "Roots to scan as ';'-separated path:Tag list (overrides [paths])")
+	workers := flag.Int("workers", 0, "Number of parallel workers (0 = MAX_WORKERS from config)")
+	batch := flag.Int("batch", 0, "Files per insert batch (0 = BATCH_SIZE from config)")
+	memLimit := flag.Int64("mem-limit-mb", 0, "Memory limit in MB for dynamic tuning (0 = MEM_LIMIT_MB from config)")
+	rootWorkers := flag.Int("root-workers", 0, "Directory walkers per root (0 = ROOT_WORKERS from config; path:Tag:N overrides per root)")
+	followSymlinks := flag.Bool("follow-symlinks", false, "Traverse symlinked directories outside the root (with loop detection); default records symlinks only")
+	oneFS := flag.Bool("one-file-system", false, "Do not descend into mount points (other devices, bind/snapshot mounts); they are recorded in scan_mounts")
+	overlapping := flag.String("overlapping-roots", "", "How to handle nested/duplicate roots: error, merge or nested (default OVERLAPPING_ROOTS from config)")
+	thumucDepth := flag.Int("thumuc-depth", -1, "Derive thumuc from the Nth folder below each root (0 = legacy /share/VOLUME/ROOT layout; -1 = THUMUC_DEPTH from config)")
+	adaptive := flag.Bool("adaptive", true, "Resize running scan/hash worker pools from system CPU/iowait/memory load (-adaptive=false to disable; default ADAPTIVE from config)")
+	hashBW := flag.String("hash-bwlimit", "", "Phase 2 read bandwidth limit, e.g. 20M (bytes/s; 0 = unlimited; default HASH_BWLIMIT from config)")
+	hashIOPS := flag.Int("hash-iops", -1, "Phase 2 read operations per second (0 = unlimited; -1 = HASH_IOPS from config)")
+	hashControl := flag.String("hash-control-file", "", "Control file polled during Phase 2 for PAUSE, HASH_BWLIMIT, HASH_IOPS (default HASH_CONTROL_FILE from config)")
+	hashDevWorkers := flag.Int("hash-device-workers", -1, "Phase 2 readers per device (st_dev) (0 = no per-device limit; -1 = HASH_DEVICE_WORKERS from config; [hash_devices] still applies)")
+	hashOrder := flag.String("hash-order", "", "Phase 2 read order within a device: inode or path (default HASH_ORDER from config)")
+	hashAlgo := flag.String("hash-algo", "", "Phase 2 hash algorithm: sha256, blake2b, xxh64 (fast, dedup only) or md5 (default HASH_ALGO from config)")
+	hashRehash := flag.String("hash-rehash", "", "When to rehash rows hashed with another algorithm: lazy or all (default HASH_REHASH from config)")
+	verifyDup := flag.String("verify-duplicates", "", "Verify duplicate groups before marking: off, bytes (byte-by-byte) or hash (second independent hash) (default VERIFY_DUPLICATES from config)")
+	hashMode := flag.String("hash-mode", "", "Phase 2 mode: suspects (only files sharing a size) or catalog (every file, integrity baseline) (default HASH_MODE from config)")
+	catalogTags := flag.String("hash-catalog-tags", "", "Catalog mode: only hash all files of these loaithumuc tags, comma-separated (default HASH_CATALOG_TAGS from config)")
+	catalogExts := flag.String("hash-catalog-ext", "", "Catalog mode: only hash all files with these extensions, e.g. pdf,docx (default HASH_CATALOG_EXTENSIONS from config)")
+	hashCache := flag.Bool("hash-cache", true, "Reuse hashes of unchanged files from the persistent hash cache (-hash-cache=false to disable; default HASH_CACHE from config)")
+	hashCacheFile := flag.String("hash-cache-file", "", "Persistent hash cache database (default HASH_CACHE_FILE from config, or hash_cache.db in output_dir)")
+	partialHash := flag.Bool("partial-hash", true, "Hash head/middle/tail samples first and fully hash only files whose samples still collide (-partial-hash=false to disable; default PARTIAL_HASH from config)")
+	phase := flag.String("phase", "both", "Phases to run: scan, hash or both")
+	resume := flag.Bool("resume", false, "Resume an interrupted scan in -db (default: newest scan_*.db in output_dir), skipping finished roots")
+	validate := flag.Bool("validate", false, "Preflight only: check config, roots, excludes and output_dir, print JSON result and exit (1 = errors)")
+	flag.Parse()
+
+	var hashBWBytes int64
+	if *hashBW != "" {
+		n, err := parseByteRate(*hashBW)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -hash-bwlimit: %v\n", err)
+			os.Exit(2)
+		}
+		hashBWBytes = n
+	}
+
+	// Cờ dòng lệnh ghi đè config.ini và biến môi trường
+	applyFlags := func(cfg *Config) {
+		if *roots != "" {
+			cfg.Paths, cfg.RootWorkersOverride = parsePathList(*roots)
+		}
+		if *workers > 0 {
+			cfg.MaxWorkers = *workers
+		}
+		if *batch > 0 {
+			cfg.BatchSize = *batch
+		}
+		if *memLimit > 0 {
+			cfg.MemLimitMB = *memLimit
+		}
+		if *rootWorkers > 0 {
+			cfg.RootWorkers = *rootWorkers
+		}
+		if *resume {
+			cfg.Resume = true
+		}
+		if *followSymlinks {
+			cfg.FollowSymlinks = true
+		}
+		if *oneFS {
+			cfg.OneFileSystem = true
+		}
+		if *overlapping != "" {
+			cfg.OverlappingRoots = *overlapping
+		}
+		if *thumucDepth >= 0 {
+			cfg.ThuMucDepth = *thumucDepth
+		}
+		if *hashBW != "" {
+			cfg.HashBandwidth = hashBWBytes
+		}
+		if *hashIOPS >= 0 {
+			cfg.HashIOPS = *hashIOPS
+		}
+		if *hashControl != "" {
+			cfg.HashControlFile = *hashControl
+		}
+		if *hashDevWorkers >= 0 {
+			cfg.HashDeviceWorkers = *hashDevWorkers
+		}
+		if *hashOrder != "" {
+			cfg.HashOrder = *hashOrder
+		}
+		if *hashAlgo != "" {
+			cfg.HashAlgo = *hashAlgo
+		}
+		if *hashRehash != "" {
+			cfg.HashRehash = *hashRehash
+		}
+		if *verifyDup != "" {
+			cfg.VerifyDuplicates = *verifyDup
+		}
+		if *hashMode != "" {
+			cfg.HashMode = *hashMode
+		}
+		if *catalogTags != "" {
+			cfg.HashCatalogTags = splitNonEmpty(*catalogTags, ",")
+		}
+		if *catalogExts != "" {
+			cfg.HashCatalogExtensions = splitNonEmpty(*catalogExts, ",")
+		}
+		if *hashCacheFile != "" {
+			cfg.HashCacheFile = *hashCacheFile
+		}
+		// Cờ bool mặc định true: chỉ ghi đè khi được truyền tường minh
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "adaptive":
+				cfg.Adaptive = *adaptive
+			case "partial-hash":
+				cfg.PartialHash = *partialHash
+			case "hash-cache":
+				cfg.HashCache = *hashCache
+			}
+		})
+	}
+	if *validate {
+		os.Exit(runValidate(*configPath, *dbOut, applyFlags))
+	}
+
+	runScan, runHash := false, false
+	switch *phase {
+	case "scan":
+		runScan = true
+	case "hash":
+		runHash = true
+	case "both":
+		runScan, runHash = true, true
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -phase %q (use scan, hash or both)\n", *phase)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// Initialize structured logging
 	logger := NewScannerLogger()
 	logger.logger.WithFields(logrus.Fields{
@@ -1333,30 +1675,105 @@ func main() {
 		"os":        runtime.GOOS,
 		"arch":      runtime.GOARCH,
 		"startTime": time.Now(),
+		"phase":     *phase,
 	}).Info("Go Scanner (Optimized 2-Phase: Scan + Hash) starting...")
 
 	// Load configuration
-	cfg, err := loadConfig("config.ini")
+	cfg, err := loadConfig(*configPath, applyFlags)
 	if err != nil {
 		logger.logger.Fatalf("Failed to load configuration: %v", err)
 	}
+	if cfg.MaxWorkers <= 0 || cfg.BatchSize <= 0 {
+		logger.logger.Fatalf("MAX_WORKERS and BATCH_SIZE must be > 0 (got %d, %d)", cfg.MaxWorkers, cfg.BatchSize)
+	}
+	// output_dir (DB quét, hash cache) chỉ được tạo khi quét thật, không tạo khi đọc cấu hình (-validate, hasher)
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		logger.logger.Fatalf("Cannot create output dir %s: %v", cfg.OutputDir, err)
+	}
 
 	// Initialize dynamic configuration
-	dynamicCfg := NewDynamicConfig(cfg, 2048, logger) // 2GB memory limit
+	dynamicCfg := NewDynamicConfig(cfg, cfg.MemLimitMB, logger)
+
+	// Chỉ chạy Phase 2 trên DB đã quét sẵn
+	if !runScan {
+		if *dbOut == "" {
+			logger.logger.Fatal("-phase hash requires -db <existing scan DB>")
+		}
+		if _, err := os.Stat(*dbOut); err != nil {
+			logger.logger.Fatalf("Scan database not found: %v", err)
+		}
+		db, err := openDBSQLite(*dbOut)
+		if err != nil {
+			logger.logger.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+
+		ctx, cancel := notifyShutdown(context.Background(), func(sig os.Signal) {
+			logger.logger.WithField("signal", sig.String()).Warn("Shutdown requested, committing hashed files")
+		})
+		defer cancel()
+		go dynamicCfg.Run(ctx)
+
+		runHashingPhaseOptimized(ctx, db, dynamicCfg.Config, dynamicCfg, HashScope{})
+		if ctx.Err() != nil {
+			db.Close()
+			os.Exit(exitInterrupted)
+		}
+		logger.logger.WithField("dbPath", *dbOut).Info("Hashing phase completed")
+		return
+	}
 
 	// Create output database
-	dbName := fmt.Sprintf("scan_%s.db", time.Now().Format("20060102_150405"))
-	dbPath := filepath.Join(cfg.OutputDir, dbName)
+	dbPath := *dbOut
+	if dbPath == "" && cfg.Resume {
+		if dbPath, err = findLatestScanDB(cfg.OutputDir); err != nil {
+			logger.logger.Fatalf("Resume mode: %v", err)
+		}
+	}
+	if dbPath == "" {
+		dbName := fmt.Sprintf("scan_%s.db", time.Now().Format("20060102_150405"))
+		dbPath = filepath.Join(cfg.OutputDir, dbName)
+	}
 	logger.logger.WithField("dbPath", dbPath).Info("Output database path")
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		logger.logger.Fatalf("Failed to create database directory: %v", err)
+	}
 
-	db, err := makeDBSQLite(dbPath)
+	var db *sql.DB
+	if cfg.Resume {
+		if _, err = os.Stat(dbPath); err == nil {
+			logger.logger.Info("Resume mode: reopening interrupted scan database")
+			if db, err = openDBSQLite(dbPath); err == nil {
+				db.SetMaxOpenConns(1) // Ghi đơn luồng trong Phase 1
+			}
+		}
+	} else if cfg.Incremental {
+		prevDB := cfg.PreviousDB
+		if prevDB == "" {
+			if prevDB, err = findLatestScanDB(cfg.OutputDir); err != nil {
+				logger.logger.Fatalf("Incremental mode: %v", err)
+			}
+		}
+		logger.logger.WithFields(logrus.Fields{
+			"previousDB":        prevDB,
+			"skipUnchangedDirs": cfg.SkipUnchangedDirs,
+		}).Info("Incremental mode: cloning previous scan database")
+		db, err = cloneDBSQLite(prevDB, dbPath)
+	} else {
+		db, err = makeDBSQLite(dbPath)
+	}
 	if err != nil {
 		logger.logger.Fatalf("Failed to create database: %v", err)
 	}
 	defer db.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := notifyShutdown(context.Background(), func(sig os.Signal) {
+		logger.logger.WithField("signal", sig.String()).Warn("Shutdown requested, stopping scan and flushing pending rows")
+	})
 	defer cancel()
+	go dynamicCfg.Run(ctx)
+	// Ghi sổ scan_runs/scan_roots vẫn phải chạy được sau khi ctx bị huỷ
+	dbCtx := context.WithoutCancel(ctx)
 
 	// --- PHASE 1: METADATA SCANNING ---
 	logger.logger.Info("-------------------------------------------------------")
@@ -1367,10 +1784,61 @@ func main() {
 	ready := make(chan bool, 1)
 
 	// Start optimized database writer
-	go dbWriterOptimized(ctx, db, dynamicCfg.Config, rx, ready)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		dbWriterOptimized(ctx, db, dynamicCfg.Config, rx, ready)
+	}()
 
 	<-ready // Wait for database to be ready
 
+	// Checkpoint: ghi lần chạy + từng root vào scan_runs/scan_roots
+	mode := "full"
+	var resumedFrom int64
+	var doneRoots map[string]int64
+	switch {
+	case cfg.Resume:
+		mode = "resume"
+		if resumedFrom, doneRoots, err = completedScanRoots(ctx, db); err != nil {
+			logger.logger.Fatalf("Resume mode: %v", err)
+		}
+		logger.logger.WithFields(logrus.Fields{
+			"resumedFrom":   resumedFrom,
+			"finishedRoots": len(doneRoots),
+		}).Info("Resume mode: skipping roots finished by previous run")
+	case cfg.Incremental:
+		mode = "incremental"
+	}
+	// Luật loại trừ và luật gắn tag được dựng trước khi ghi scan_runs: mẫu sai cú pháp thì dừng ngay
+	excludes := make([]*excludeMatcher, len(cfg.Paths))
+	taggers := make([]*tagger, len(cfg.Paths))
+	for i, rt := range cfg.Paths {
+		absRoot := rt[0]
+		if p, err := filepath.Abs(rt[0]); err == nil {
+			absRoot = p
+		}
+		if excludes[i], err = newExcludeMatcher(cfg, absRoot, rt[1]); err != nil {
+			logger.logger.Fatalf("Invalid exclude rules for %s: %v", rt[0], err)
+		}
+		if taggers[i], err = newTagger(cfg, absRoot, rt[1]); err != nil {
+			logger.logger.Fatalf("Invalid tagging rules for %s: %v", rt[0], err)
+		}
+	}
+	// Đổi cách phân loại so với lần quét trước: phải liệt kê lại mọi thư mục để file cũ nhận thumuc/tag mới
+	if cfg.Incremental && cfg.SkipUnchangedDirs {
+		if changed, err := classificationChanged(ctx, db, cfg); err != nil {
+			logger.logger.WithError(err).Warn("Cannot compare tagging rules with previous scan")
+		} else if changed {
+			logger.logger.Info("Incremental mode: THUMUC_DEPTH/[thumuc]/[tags.*] changed since previous scan, re-listing all directories this run")
+			cfg.SkipUnchangedDirs = false
+		}
+	}
+
+	runID, err := startScanRun(dbCtx, db, cfg, mode, resumedFrom)
+	if err != nil {
+		logger.logger.Fatalf("Failed to record scan run: %v", err)
+	}
+
 	// Use optimized semaphore and wait group
 	sem := make(chan struct{}, dynamicCfg.AdjustedWorkers)
 	var wg sync.WaitGroup
@@ -1379,36 +1847,94 @@ func main() {
 
 	// Validate paths before starting
 	if len(cfg.Paths) == 0 {
-		logger.logger.Fatal("No paths configured in config.ini")
+		logger.logger.Fatal("No paths configured ([paths], SCANDIR_PATHS or -roots)")
 	}
 
-	// Start periodic configuration adjustment
-	adjustTicker := time.NewTicker(1 * time.Minute)
-	defer adjustTicker.Stop()
+	// Worker liệt kê thư mục của mọi root dùng chung một gate: ADAPTIVE giảm/tăng số worker chạy cùng lúc
+	// trong khoảng [ADAPTIVE_MIN_WORKERS, tổng số worker đã khởi động]
+	scanWorkers := 0
+	for _, rt := range cfg.Paths {
+		scanWorkers += cfg.workersForRoot(rt[0])
+	}
+	scanGate := dynamicCfg.NewGate(ctx, "scan", scanWorkers, scanWorkers)
 
 	// Launch scanner for each path
-	for _, rt := range cfg.Paths {
+	var failedRoots int
+	for i, rt := range cfg.Paths {
+		if ctx.Err() != nil {
+			break // các root chưa chạy giữ trạng thái pending/không ghi, -resume sẽ quét tiếp
+		}
 		root, tag := rt[0], rt[1]
+		absRoot := root
+		if p, err := filepath.Abs(root); err == nil {
+			absRoot = p
+		}
+
+		if n, ok := doneRoots[absRoot]; ok {
+			if _, err := addScanRoot(dbCtx, db, runID, absRoot, tag, "skipped", n); err != nil {
+				logger.logger.WithError(err).Warn("Failed to record skipped root")
+			}
+			logger.logger.WithFields(logrus.Fields{
+				"path":      root,
+				"fileCount": n,
+			}).Info("Resume mode: root already scanned, skipping")
+			mu.Lock()
+			totalFiles += uint64(n)
+			mu.Unlock()
+			continue
+		}
+		rootRowID, err := addScanRoot(dbCtx, db, runID, absRoot, tag, "pending", 0)
+		if err != nil {
+			logger.logger.Fatalf("Failed to record scan root %s: %v", root, err)
+		}
+		excl, tags := excludes[i], taggers[i]
+		if err := recordExcludeRules(dbCtx, db, runID, rootRowID, excl); err != nil {
+			logger.logger.WithError(err).Warn("Failed to record exclude rules")
+		}
 
-		wg.Add(1)
 		sem <- struct{}{}
-		go func(root, tag string) {
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(root, tag string, rootRowID int64, excl *excludeMatcher, tags *tagger) {
 			defer wg.Done()
 			defer func() { <-sem }()
 
 			// Log the start of scanning for this path
 			logger.logger.WithFields(logrus.Fields{
-				"path": root,
-				"tag":  tag,
+				"path":           root,
+				"tag":            tag,
+				"workers":        cfg.workersForRoot(root),
+				"excludeRules":   len(excl.rules),
+				"tagRules":       len(tags.rules) + len(tags.thumuc),
+				"followSymlinks": cfg.FollowSymlinks,
+				"oneFileSystem":  cfg.OneFileSystem,
 			}).Info("Starting path scan")
+			rx <- DbMsg{RootStatus: &RootStatusReq{RootRowID: rootRowID, Status: "running"}}
 
 			startTime := time.Now()
-			if count, err := scanRoot(root, tag, rx, cfg.Exclude, dynamicCfg.AdjustedBatchSize); err != nil {
+			if count, err := scanRoot(ctx, root, tag, rx, cfg, excl, tags, scanGate, dynamicCfg.AdjustedBatchSize, rootRowID); errors.Is(err, context.Canceled) {
+				logger.logger.WithFields(logrus.Fields{
+					"path":      root,
+					"fileCount": count,
+				}).Warn("Phase 1: path scan interrupted")
+				rx <- DbMsg{RootStatus: &RootStatusReq{RootRowID: rootRowID, Status: "interrupted", FileCount: count, ExcludeHits: excl.hits(), ScanIgnores: excl.scanIgnoreStats()}}
+				mu.Lock()
+				totalFiles += count
+				mu.Unlock()
+			} else if err != nil {
 				logger.logger.WithFields(logrus.Fields{
 					"path":  root,
 					"error": err.Error(),
 				}).Error("Phase 1: scan error")
+				rx <- DbMsg{RootStatus: &RootStatusReq{RootRowID: rootRowID, Status: "failed", FileCount: count, Err: err.Error(), ExcludeHits: excl.hits(), ScanIgnores: excl.scanIgnoreStats()}}
+				mu.Lock()
+				failedRoots++
+				mu.Unlock()
 			} else {
+				rx <- DbMsg{RootStatus: &RootStatusReq{RootRowID: rootRowID, Status: "done", FileCount: count, ExcludeHits: excl.hits(), ScanIgnores: excl.scanIgnoreStats()}}
 				duration := time.Since(startTime)
 				logger.logger.WithFields(logrus.Fields{
 					"path":       root,
@@ -1422,41 +1948,92 @@ func main() {
 				totalFiles += count
 				mu.Unlock()
 			}
-		}(root, tag)
+		}(root, tag, rootRowID, excl, tags)
 	}
 
-	// Monitor and adjust configuration during scanning
-	go func() {
-		for {
-			select {
-			case <-adjustTicker.C:
-				dynamicCfg.AutoAdjust()
-				logger.logger.WithFields(logrus.Fields{
-					"batchSize": dynamicCfg.AdjustedBatchSize,
-					"workers":   dynamicCfg.AdjustedWorkers,
-				}).Debug("Configuration auto-adjusted")
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-
 	// Wait for all scanning to complete
 	wg.Wait()
+	dynamicCfg.Release(scanGate)
 
 	// Signal shutdown to database writer
 	rx <- DbMsg{Shutdown: true}
 	close(rx)
+	<-writerDone
+
+	// exitIfInterrupted: đánh dấu lần chạy interrupted rồi thoát với exitInterrupted (-resume để chạy tiếp)
+	exitIfInterrupted := func(phase string) {
+		if ctx.Err() == nil {
+			return
+		}
+		if err := finishScanRun(dbCtx, db, runID, "interrupted", totalFiles); err != nil {
+			logger.logger.WithError(err).Warn("Failed to finalize scan run")
+		}
+		logger.logger.WithFields(logrus.Fields{
+			"phase":      phase,
+			"runID":      runID,
+			"totalFiles": totalFiles,
+			"dbPath":     dbPath,
+		}).Warn("Scan interrupted; run again with -resume -db to continue")
+		db.Close()
+		os.Exit(exitInterrupted)
+	}
+	exitIfInterrupted("scan")
+
+	if cfg.Incremental {
+		roots := make([]string, 0, len(cfg.Paths))
+		for _, rt := range cfg.Paths {
+			roots = append(roots, rt[0])
+		}
+		if n, err := pruneRemovedRoots(ctx, db, roots); err != nil {
+			logger.logger.WithError(err).Warn("Phase 1: Failed to prune roots removed from config")
+		} else if n > 0 {
+			logger.logger.WithField("filesPruned", n).Info("Phase 1: Pruned roots removed from config")
+		}
+	}
+
+	// Tổng hợp dung lượng/số file theo thư mục (trực tiếp + đệ quy theo parent_id)
+	aggStart := time.Now()
+	if aggStats, err := updateFolderAggregates(ctx, db); err != nil {
+		logger.logger.WithError(err).Error("Phase 1: Failed to compute folder aggregates")
+	} else {
+		logger.logger.WithFields(logrus.Fields{
+			"folders":  aggStats.Folders,
+			"files":    aggStats.RootFiles,
+			"size":     aggStats.RootSize,
+			"orphans":  aggStats.Orphans,
+			"duration": time.Since(aggStart).Milliseconds(),
+		}).Info("Phase 1: Folder aggregates updated")
+		if hl := aggStats.Hardlinks; hl.LinkedFiles > 0 {
+			logger.logger.WithFields(logrus.Fields{
+				"inodes":      hl.Groups,
+				"linkedFiles": hl.LinkedFiles,
+				"linkedSize":  hl.LinkedSize,
+			}).Info("Phase 1: Hardlinks detected (linked copies counted once)")
+		}
+	}
 
 	logger.logger.WithField("totalFiles", totalFiles).Info("Phase 1: All metadata scanning completed")
 	logger.logger.Info("-------------------------------------------------------")
 	// --- END PHASE 1 ---
 
 	// --- PHASE 2: HASHING DUPLICATES ---
-	logger.logger.Info("Starting Phase 2: Hashing potential duplicates")
-	runHashingPhaseOptimized(ctx, db, dynamicCfg.Config)
+	if runHash {
+		logger.logger.Info("Starting Phase 2: Hashing potential duplicates")
+		runHashingPhaseOptimized(ctx, db, dynamicCfg.Config, dynamicCfg, HashScope{})
+		exitIfInterrupted("hash")
+	} else {
+		logger.logger.Info("Phase 2 skipped (-phase scan); run later with -phase hash -db " + dbPath)
+	}
 	// --- END PHASE 2 ---
 
+	runStatus := "done"
+	if failedRoots > 0 {
+		runStatus = "failed"
+	}
+	if err := finishScanRun(dbCtx, db, runID, runStatus, totalFiles); err != nil {
+		logger.logger.WithError(err).Warn("Failed to finalize scan run")
+	}
+
 	// Final performance summary
 	logger.logger.WithFields(logrus.Fields{
 		"dbPath":     dbPath,
@@ -1476,6 +2053,9 @@ func mainLegacy() {
 	if err != nil {
 		log.Fatalf("config: %v", err)
 	}
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		log.Fatalf("cannot create output dir %s: %v", cfg.OutputDir, err)
+	}
 
 	dbName := fmt.Sprintf("scan_%s.db", time.Now().Format("20060102_150405"))
 	dbPath := filepath.Join(cfg.OutputDir, dbName)
@@ -1514,7 +2094,19 @@ func mainLegacy() {
 		go func(root, tag string) {
 			defer wg.Done()
 			defer func() { <-sem }()
-			if count, err := scanRoot(root, tag, rx, cfg.Exclude, cfg.BatchSize); err != nil {
+			absRoot := root
+			if p, err := filepath.Abs(root); err == nil {
+				absRoot = p
+			}
+			excl, err := newExcludeMatcher(cfg, absRoot, tag)
+			if err != nil {
+				log.Fatalf("Invalid exclude rules for %s: %v", root, err)
+			}
+			tags, err := newTagger(cfg, absRoot, tag)
+			if err != nil {
+				log.Fatalf("Invalid tagging rules for %s: %v", root, err)
+			}
+			if count, err := scanRoot(ctx, root, tag, rx, cfg, excl, tags, nil, cfg.BatchSize, 0); err != nil {
 				log.Printf("Phase 1: scan %s error: %v", root, err)
 			} else {
 				log.Printf("Phase 1: done %s total files found %d", root, count)
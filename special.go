@@ -0,0 +1,165 @@
+// special.go
+//go:build scanner
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// specialType: loại của entry không phải file thường/thư mục (cột fs_special.entry_type)
+func specialType(m fs.FileMode) string {
+	switch {
+	case m&fs.ModeSymlink != 0:
+		return "symlink"
+	case m&fs.ModeSocket != 0:
+		return "socket"
+	case m&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case m&fs.ModeCharDevice != 0:
+		return "chardev"
+	case m&fs.ModeDevice != 0:
+		return "blockdev"
+	default:
+		return "other"
+	}
+}
+
+// withinDir: p nằm trong (hoặc chính là) thư mục dir; cả hai đều là đường dẫn tuyệt đối đã Clean
+func withinDir(p, dir string) bool {
+	if p == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(os.PathSeparator)) {
+		dir += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(p, dir)
+}
+
+// resolveLink đọc target của symlink r.Path và điền các cột link_* của r.
+// Trả về stat của target, nil nếu link hỏng (target không tồn tại, vòng lặp symlink, không có quyền).
+func (w *rootWalker) resolveLink(r *SpecialRow) os.FileInfo {
+	var dest string
+	attempts, err := w.retry.Attempts(func() (err error) {
+		dest, err = os.Readlink(r.Path)
+		return err
+	})
+	if err != nil {
+		log.Printf("WARN: readlink failed for %s: %v", r.Path, err)
+		w.recordError(r.FolderID, r.Path, "readlink", err, attempts)
+		return nil
+	}
+	r.LinkTarget = dest
+
+	real, err := filepath.EvalSymlinks(r.Path)
+	if err != nil {
+		// Link hỏng: xét ngoài root theo đường dẫn viết trong link
+		lexical := dest
+		if !filepath.IsAbs(lexical) {
+			lexical = filepath.Join(r.DirPath, lexical)
+		}
+		r.Outside = !withinDir(filepath.Clean(lexical), w.root)
+		return nil
+	}
+	fi, err := os.Stat(real)
+	if err != nil {
+		r.Outside = !withinDir(real, w.realRoot)
+		return nil
+	}
+
+	r.TargetPath, r.TargetOK = real, true
+	r.Outside = !withinDir(real, w.realRoot)
+	switch {
+	case fi.IsDir():
+		r.TargetType = "dir"
+	case fi.Mode().IsRegular():
+		r.TargetType = "file"
+	default:
+		r.TargetType = "other"
+	}
+	return fi
+}
+
+// devIno: định danh thư mục đã duyệt, dùng phát hiện vòng lặp khi FOLLOW_SYMLINKS
+type devIno struct {
+	dev, ino uint64
+}
+
+// markVisited ghi nhận thư mục đã được duyệt; false nếu đã có từ trước.
+// Hệ thống không có inode (Windows) luôn trả về true, chỉ dựa vào kiểm tra đường dẫn.
+func (w *rootWalker) markVisited(st StatInfo) bool {
+	if st.Inode == 0 {
+		return true
+	}
+	_, loaded := w.visited.LoadOrStore(devIno{st.Device, st.Inode}, struct{}{})
+	return !loaded
+}
+
+// shouldFollow quyết định có duyệt thư mục mà symlink r trỏ tới hay không (chỉ khi FOLLOW_SYMLINKS).
+// Không duyệt target nằm trong root (đã quét theo đường dẫn thật), target là thư mục cha của root
+// hoặc của chính link (vòng lặp), target ở filesystem khác khi ONE_FILESYSTEM và thư mục đã duyệt qua đường khác.
+func (w *rootWalker) shouldFollow(r *SpecialRow, target StatInfo) bool {
+	linkDir := r.DirPath
+	if real, err := filepath.EvalSymlinks(linkDir); err == nil {
+		linkDir = real
+	}
+	switch {
+	case !r.Outside:
+		r.FollowNote = "inside_root"
+	case withinDir(w.realRoot, r.TargetPath), withinDir(linkDir, r.TargetPath):
+		r.FollowNote = "loop"
+	case w.cfg.OneFileSystem && target.Device != w.rootDev:
+		r.FollowNote = "other_fs"
+	case !w.markVisited(target):
+		r.FollowNote = "visited"
+	default:
+		r.Followed = true
+	}
+	return r.Followed
+}
+
+// insertSpecials ghi (upsert theo path) các entry đặc biệt vào fs_special trong một transaction
+func insertSpecials(ctx context.Context, db *sql.DB, rows []SpecialRow) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO fs_special (folder_id, path, dir_path, filename, entry_type, link_target, target_path, target_type,
+		                        target_ok, outside_root, followed, follow_note, loaithumuc, st_mtime, `+statColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, `+statPlaceholders+`)
+		ON CONFLICT(path) DO UPDATE SET
+		  folder_id=excluded.folder_id, entry_type=excluded.entry_type, link_target=excluded.link_target,
+		  target_path=excluded.target_path, target_type=excluded.target_type, target_ok=excluded.target_ok,
+		  outside_root=excluded.outside_root, followed=excluded.followed, follow_note=excluded.follow_note,
+		  loaithumuc=excluded.loaithumuc, st_mtime=excluded.st_mtime, `+statUpdates+`
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	nullable := func(s string) sql.NullString {
+		return sql.NullString{String: s, Valid: s != ""}
+	}
+	for _, r := range rows {
+		args := append([]any{
+			r.FolderID, r.Path, r.DirPath, r.Filename, r.EntryType,
+			nullable(r.LinkTarget), nullable(r.TargetPath), nullable(r.TargetType),
+			r.TargetOK, r.Outside, r.Followed, nullable(r.FollowNote), r.LoaiThuMuc, r.Mtime,
+		}, statArgs(r.Stat)...)
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("insert %s: %w", r.Path, err)
+		}
+	}
+	return tx.Commit()
+}
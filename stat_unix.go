@@ -3,41 +3,128 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"os"
 	"os/user"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
+// ownerNames: cache uid -> username, tránh gọi user.LookupId cho từng entry
+var ownerNames sync.Map
+
+// lookupOwner trả về username của uid; tra không được (ví dụ container không có /etc/passwd)
+// thì dùng uid dạng số. Kết quả (kể cả thất bại) được cache.
+func lookupOwner(uid uint32) string {
+	if v, ok := ownerNames.Load(uid); ok {
+		return v.(string)
+	}
+	id := strconv.FormatUint(uint64(uid), 10)
+	name := id
+	if u, err := user.LookupId(id); err == nil && u.Username != "" {
+		name = u.Username
+	}
+	v, _ := ownerNames.LoadOrStore(uid, name)
+	return v.(string)
+}
+
 // Linux-only: best-effort atime/ctime via unix.Stat_t; fallback to mtime if fields missing.
-// Improved: obtain real UID from Stat_t and lookup username; fallback to numeric uid string.
+// uid/gid/mode/inode/device/nlink/blocks lấy thẳng từ Stat_t; owner tra theo uid (có cache).
 func statInfo(fi os.FileInfo) StatInfo {
 	mtime := fi.ModTime()
-	atime := mtime
-	ctime := mtime
+	info := StatInfo{
+		Size: fi.Size(), Atime: mtime, Mtime: mtime, Ctime: mtime,
+		Mode: uint32(fi.Mode().Perm()),
+	}
 
-	var uid uint32 = 0
 	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
 		if st.Atim.Sec != 0 {
-			atime = time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+			info.Atime = time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
 		}
 		if st.Ctim.Sec != 0 {
-			ctime = time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+			info.Ctime = time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+		}
+		info.Uid = st.Uid
+		info.Gid = st.Gid
+		info.Mode = uint32(st.Mode)
+		info.Inode = uint64(st.Ino)
+		info.Device = uint64(st.Dev)
+		info.Nlink = uint64(st.Nlink)
+		info.Blocks = int64(st.Blocks)
+	}
+	info.Username = lookupOwner(info.Uid)
+
+	return info
+}
+
+// isTransientFSError: lỗi filesystem có thể tự hết khi thử lại (SMB/NFS mất kết nối chốc lát, file handle cũ...).
+// ENOENT/EACCES/ENOTDIR... là lỗi cố định, không retry.
+func isTransientFSError(err error) bool {
+	var en syscall.Errno
+	if !errors.As(err, &en) {
+		return false
+	}
+	switch en {
+	case syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ETIMEDOUT, syscall.ESTALE,
+		syscall.ECONNRESET, syscall.ECONNABORTED, syscall.ENETDOWN, syscall.ENETUNREACH, syscall.ENETRESET,
+		syscall.EHOSTDOWN, syscall.EHOSTUNREACH, syscall.ENOLCK:
+		return true
+	}
+	return false
+}
+
+// mountTable đọc /proc/self/mountinfo: mount point -> mount. Gồm cả bind mount (cùng st_dev với
+// filesystem gốc nên không phát hiện được bằng st_dev). Trả về nil nếu không đọc được (không phải Linux).
+func mountTable() map[string]MountInfo {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	// Dạng dòng: id parent major:minor root mount_point options [optional...] - fstype source super_options
+	out := map[string]MountInfo{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		pre, post, ok := strings.Cut(sc.Text(), " - ")
+		fields, tail := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(fields) < 5 || len(tail) < 2 {
+			continue
 		}
-		uid = st.Uid
+		mp := unescapeMountField(fields[4])
+		out[mp] = MountInfo{MountPoint: mp, FsType: tail[0], Source: unescapeMountField(tail[1])}
 	}
+	return out
+}
 
-	// Lookup username by UID. If lookup fails (e.g., no /etc/passwd inside container),
-	// return numeric uid as string instead of a fixed "0".
-	username := strconv.FormatUint(uint64(uid), 10)
-	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
-		if u.Username != "" {
-			username = u.Username
+// unescapeMountField giải mã ký tự đặc biệt dạng \ooo (bát phân) trong mountinfo, ví dụ \040 = dấu cách
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
 		}
+		b.WriteByte(s[i])
 	}
+	return b.String()
+}
 
-	return StatInfo{
-		Size: fi.Size(), Atime: atime, Mtime: mtime, Ctime: ctime, Username: username,
+// diskFree: số byte trống mà user hiện tại dùng được trên filesystem chứa path
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
 	}
+	return st.Bavail * uint64(st.Bsize), nil
 }
@@ -0,0 +1,27 @@
+// stat_unix_test.go
+//go:build !windows && (scanner || deleter)
+
+package main
+
+import "testing"
+
+func TestUnescapeMountField(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"/mnt/data", "/mnt/data"},
+		{`/mnt/my\040share`, "/mnt/my share"},
+		{`/mnt/tab\011here`, "/mnt/tab\there"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`//nas/share\040name`, "//nas/share name"},
+		{`/mnt/a\040`, "/mnt/a "},
+		{`/mnt/short\04`, `/mnt/short\04`},
+		{`/mnt/bad\999`, `/mnt/bad\999`},
+		{`\`, `\`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMountField(tt.in); got != tt.want {
+			t.Errorf("unescapeMountField(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -3,23 +3,79 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"os/user"
+	"sync"
+	"syscall"
+	"unsafe"
 )
 
+// currentUser: Windows không có uid trong FileInfo, dùng user hiện tại (tra một lần)
+var currentUser = sync.OnceValue(func() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "0"
+})
+
 // Windows-specific: best-effort atime/ctime via fi.ModTime();
+// mode được quy đổi sang st_mode POSIX (bit loại file + quyền), các trường inode/device/blocks để 0.
 func statInfo(fi os.FileInfo) StatInfo {
 	mtime := fi.ModTime()
-	atime := mtime
-	ctime := mtime
 
-	username := "0"
-	// Attempt to get username, but it might not be directly comparable to Unix UIDs.
-	if u, err := user.Current(); err == nil {
-		username = u.Username
+	mode := uint32(fi.Mode().Perm())
+	switch {
+	case fi.IsDir():
+		mode |= 0o040000
+	case fi.Mode().IsRegular():
+		mode |= 0o100000
 	}
 
 	return StatInfo{
-		Size: fi.Size(), Atime: atime, Mtime: mtime, Ctime: ctime, Username: username,
+		Size: fi.Size(), Atime: mtime, Mtime: mtime, Ctime: mtime, Username: currentUser(),
+		Mode: mode, Nlink: 1,
+	}
+}
+
+// Mã lỗi Win32 của share mạng chập chờn (winerror.h)
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+	errorUnexpNetErr      syscall.Errno = 59
+	errorNetnameDeleted   syscall.Errno = 64
+	errorSemTimeout       syscall.Errno = 121
+)
+
+// isTransientFSError: lỗi filesystem có thể tự hết khi thử lại (share SMB mất kết nối chốc lát, file đang bị khoá)
+func isTransientFSError(err error) bool {
+	var en syscall.Errno
+	if !errors.As(err, &en) {
+		return false
+	}
+	switch en {
+	case errorSharingViolation, errorLockViolation, errorUnexpNetErr, errorNetnameDeleted, errorSemTimeout:
+		return true
+	}
+	return false
+}
+
+// mountTable: Windows không có bảng mount kiểu Linux; volume của root lấy theo ký tự ổ/UNC (xem mountOf)
+func mountTable() map[string]MountInfo {
+	return nil
+}
+
+var procGetDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskFree: số byte trống mà user hiện tại dùng được trên ổ/share chứa path
+func diskFree(path string) (uint64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if r, _, e := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {
+		return 0, e
 	}
+	return free, nil
 }
@@ -0,0 +1,74 @@
+//go:build linux && (scanner || hasher)
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readSysSample đọc bộ đếm CPU (dòng "cpu" của /proc/stat, đơn vị jiffies) và RAM (/proc/meminfo)
+func readSysSample() (sysSample, error) {
+	var s sysSample
+
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return s, err
+	}
+	sc := bufio.NewScanner(f)
+	sc.Scan()
+	line := sc.Text()
+	f.Close()
+	fields := strings.Fields(line)
+	if len(fields) < 6 || fields[0] != "cpu" {
+		return s, fmt.Errorf("unexpected /proc/stat line %q", line)
+	}
+	// user nice system idle iowait irq softirq steal (guest đã nằm trong user)
+	for i, v := range fields[1:min(len(fields), 9)] {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("parse /proc/stat: %w", err)
+		}
+		s.cpuTotal += n
+		switch i {
+		case 3:
+			s.cpuIdle = n
+		case 4:
+			s.cpuIOWait = n
+		}
+	}
+
+	f, err = os.Open("/proc/meminfo")
+	if err != nil {
+		return s, err
+	}
+	defer f.Close()
+	sc = bufio.NewScanner(f)
+	for sc.Scan() {
+		key, rest, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		var dst *uint64
+		switch key {
+		case "MemTotal":
+			dst = &s.memTotal
+		case "MemAvailable":
+			dst = &s.memAvailable
+		default:
+			continue
+		}
+		kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(rest), " kB"), 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("parse /proc/meminfo %s: %w", key, err)
+		}
+		*dst = kb * 1024
+	}
+	if s.memTotal == 0 {
+		return s, fmt.Errorf("MemTotal not found in /proc/meminfo")
+	}
+	return s, sc.Err()
+}
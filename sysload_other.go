@@ -0,0 +1,10 @@
+//go:build !linux && (scanner || hasher)
+
+package main
+
+import "errors"
+
+// readSysSample: chỉ đọc được tải hệ thống qua /proc trên Linux; nơi khác DynamicConfig chỉ dựa vào heap của Go
+func readSysSample() (sysSample, error) {
+	return sysSample{}, errors.New("system load is only available from /proc on Linux")
+}
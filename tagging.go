@@ -0,0 +1,197 @@
+// tagging.go
+//go:build scanner
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Phân loại file khi quét: cột fs_files.thumuc và các tag trong fs_tags.
+//
+// thumuc là thành phần thứ THUMUC_DEPTH của đường dẫn tính từ root (1 = thư mục con trực tiếp của root;
+// file nằm nông hơn thì để rỗng). THUMUC_DEPTH = 0 giữ cách cũ: topFolder(p, 4) trên đường dẫn tuyệt đối
+// (bố cục /share/VOLUME/ROOT/...). [thumuc] cho phép đặt độ sâu riêng theo tag của root.
+//
+// Mỗi section [tags.<kind>] là một nhóm luật, key là giá trị tag, value là regex trên đường dẫn tuyệt đối
+// dạng '/'. Giá trị tag được mở rộng theo nhóm bắt của regex ($1, ${1}, ${name}):
+//
+//	[tags.department]
+//	${1} = ^/share/Data/Phong/([^/]+)/
+//	[tags.project]
+//	DuAnA = /Projects/(A|A-archive)/
+//
+// File nhận mọi tag khớp (có thể nhiều tag cùng kind). Kind "thumuc" không ghi vào fs_tags mà thay giá trị
+// cột thumuc (luật khớp đầu tiên), dùng khi tên phòng ban không nằm ở một độ sâu cố định.
+type tagRule struct {
+	TagRuleSpec
+	re *regexp.Regexp
+}
+
+// tagger: luật phân loại có hiệu lực cho một root
+type tagger struct {
+	root   string // đường dẫn tuyệt đối của root, dạng '/'
+	depth  int
+	thumuc []*tagRule // kind "thumuc"
+	rules  []*tagRule
+}
+
+// newTagger dựng luật phân loại cho root absRoot có tag tag, báo lỗi nếu regex sai cú pháp
+func newTagger(cfg *Config, absRoot, tag string) (*tagger, error) {
+	t := &tagger{
+		root:  strings.TrimRight(filepath.ToSlash(absRoot), "/"),
+		depth: cfg.thumucDepth(tag),
+	}
+	if t.depth < 0 {
+		return nil, fmt.Errorf("invalid THUMUC_DEPTH %d for %s (want >= 0)", t.depth, absRoot)
+	}
+	for _, spec := range cfg.TagRules {
+		re, err := regexp.Compile(spec.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("[tags.%s] %s: %w", spec.Kind, spec.Value, err)
+		}
+		r := &tagRule{TagRuleSpec: spec, re: re}
+		if spec.Kind == "thumuc" {
+			t.thumuc = append(t.thumuc, r)
+		} else {
+			t.rules = append(t.rules, r)
+		}
+	}
+	return t, nil
+}
+
+// classify trả về giá trị thumuc và các tag (đã sắp xếp, không trùng) của file p. An toàn khi gọi đồng thời.
+func (t *tagger) classify(p string) (string, []FileTag) {
+	sp := filepath.ToSlash(p)
+
+	thumuc, matched := "", false
+	for _, r := range t.thumuc {
+		if v, ok := r.expand(sp); ok {
+			thumuc, matched = v, true
+			break
+		}
+	}
+	if !matched {
+		thumuc = t.folderAtDepth(p, sp)
+	}
+
+	if len(t.rules) == 0 {
+		return thumuc, nil
+	}
+	var tags []FileTag
+	seen := map[FileTag]struct{}{}
+	for _, r := range t.rules {
+		v, ok := r.expand(sp)
+		if !ok {
+			continue
+		}
+		ft := FileTag{Kind: r.Kind, Tag: v}
+		if _, dup := seen[ft]; !dup {
+			seen[ft] = struct{}{}
+			tags = append(tags, ft)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Kind != tags[j].Kind {
+			return tags[i].Kind < tags[j].Kind
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return thumuc, tags
+}
+
+// folderAtDepth: thư mục ở độ sâu t.depth tính từ root chứa file (sp là p dạng '/')
+func (t *tagger) folderAtDepth(p, sp string) string {
+	if t.depth == 0 {
+		return topFolder(p, 4)
+	}
+	rel, ok := strings.CutPrefix(sp, t.root+"/")
+	if !ok {
+		return ""
+	}
+	dirs := strings.Split(rel, "/")
+	dirs = dirs[:len(dirs)-1] // bỏ tên file
+	if len(dirs) < t.depth {
+		return ""
+	}
+	return dirs[t.depth-1]
+}
+
+// expand: giá trị tag của luật cho đường dẫn sp; false nếu không khớp hoặc giá trị rỗng
+func (r *tagRule) expand(sp string) (string, bool) {
+	loc := r.re.FindStringSubmatchIndex(sp)
+	if loc == nil {
+		return "", false
+	}
+	v := strings.TrimSpace(string(r.re.ExpandString(nil, r.Value, sp, loc)))
+	return v, v != ""
+}
+
+// tagSet: chữ ký các tag của file ("kind=tag;..."), lưu ở fs_files.tag_set để upsert nhận ra tag thay đổi
+func tagSet(tags []FileTag) sql.NullString {
+	if len(tags) == 0 {
+		return sql.NullString{}
+	}
+	parts := make([]string, len(tags))
+	for i, t := range tags {
+		parts[i] = t.Kind + "=" + t.Tag
+	}
+	return sql.NullString{String: strings.Join(parts, ";"), Valid: true}
+}
+
+// classificationConfig: phần cấu hình quyết định thumuc/tag, so với lần quét trước
+type classificationConfig struct {
+	ThuMucDepth     int
+	RootThuMucDepth map[string]int
+	TagRules        []TagRuleSpec
+}
+
+func (c classificationConfig) normalize() classificationConfig {
+	if len(c.RootThuMucDepth) == 0 {
+		c.RootThuMucDepth = nil
+	}
+	if len(c.TagRules) == 0 {
+		c.TagRules = nil
+	}
+	return c
+}
+
+// classificationChanged: THUMUC_DEPTH, [thumuc] hoặc [tags.*] khác với lần quét mới nhất trong db.
+// Khi đó SKIP_UNCHANGED_DIRS phải tắt, nếu không file trong thư mục không đổi giữ thumuc/tag cũ.
+func classificationChanged(ctx context.Context, db *sql.DB, cfg *Config) (bool, error) {
+	var snapshot sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT config FROM scan_runs ORDER BY id DESC LIMIT 1`).Scan(&snapshot)
+	if err == sql.ErrNoRows || (err == nil && !snapshot.Valid) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var prev classificationConfig
+	if err := json.Unmarshal([]byte(snapshot.String), &prev); err != nil {
+		return false, fmt.Errorf("parse previous scan_runs.config: %w", err)
+	}
+	cur := classificationConfig{ThuMucDepth: cfg.ThuMucDepth, RootThuMucDepth: cfg.RootThuMucDepth, TagRules: cfg.TagRules}
+	return !reflect.DeepEqual(prev.normalize(), cur.normalize()), nil
+}
+
+// insertFileTags (dbWriter): thay toàn bộ tag của file id trong fs_tags
+func insertFileTags(ctx context.Context, del, ins *sql.Stmt, id int64, tags []FileTag) error {
+	if _, err := del.ExecContext(ctx, id); err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if _, err := ins.ExecContext(ctx, id, t.Kind, t.Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !windows && (scanner || hasher)
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// throttleSignals: SIGUSR1 tạm dừng hash, SIGUSR2 tiếp tục, SIGHUP đọc lại HASH_CONTROL_FILE ngay
+var throttleSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP}
+
+func throttleSignalAction(sig os.Signal) string {
+	switch sig {
+	case syscall.SIGUSR1:
+		return "pause"
+	case syscall.SIGUSR2:
+		return "resume"
+	case syscall.SIGHUP:
+		return "reload"
+	}
+	return ""
+}
@@ -0,0 +1,10 @@
+//go:build windows && (scanner || hasher)
+
+package main
+
+import "os"
+
+// throttleSignals: Windows không có SIGUSR1/SIGUSR2/SIGHUP, chỉ điều khiển được qua HASH_CONTROL_FILE
+var throttleSignals []os.Signal
+
+func throttleSignalAction(os.Signal) string { return "" }
@@ -0,0 +1,377 @@
+// validate.go
+//go:build scanner
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Kiểm tra trước khi chạy (scanner -validate): đọc cấu hình qua loadConfig giống lần quét thật, kiểm tra
+// từng root, luật loại trừ và output_dir (tạo được file SQLite, đủ dung lượng so với DB lần trước),
+// rồi in kết quả JSON ra stdout. Exit code 0 = không có lỗi (có thể có cảnh báo), 1 = có lỗi.
+
+// ValidateCheck: một mục kiểm tra
+type ValidateCheck struct {
+	Check   string `json:"check"`            // config|root|exclude|tags|previous_db|output_dir|sqlite|disk_space
+	Target  string `json:"target,omitempty"` // root, mẫu loại trừ hoặc đường dẫn được kiểm tra
+	Status  string `json:"status"`           // ok|warn|error|unchecked (không đủ dữ liệu để kết luận)
+	Message string `json:"message"`
+}
+
+// ValidateReport: kết quả in ra của -validate
+type ValidateReport struct {
+	OK         bool            `json:"ok"` // không có mục error
+	Errors     int             `json:"errors"`
+	Warnings   int             `json:"warnings"`
+	Config     string          `json:"config"`
+	OutputDir  string          `json:"outputDir,omitempty"`
+	PreviousDB string          `json:"previousDB,omitempty"`
+	FreeBytes  uint64          `json:"freeBytes,omitempty"`   // dung lượng trống của thư mục chứa DB
+	NeedBytes  int64           `json:"neededBytes,omitempty"` // ước tính theo DB lần trước
+	Checks     []ValidateCheck `json:"checks"`
+	CheckedAt  time.Time       `json:"checkedAt"`
+
+	globalRules map[string]ruleUse // luật global (EXCLUDE_DIRS, [exclude]) -> kết quả tốt nhất qua các root
+}
+
+// ruleUse: kết quả kiểm tra một luật loại trừ, giá trị lớn hơn thắng khi gộp luật global qua các root
+type ruleUse int
+
+const (
+	ruleUnmatched ruleUse = iota // không khớp entry nào
+	ruleUnchecked                // không khớp trong phần root đã duyệt (walkExcludes dừng ở validateWalkLimit)
+	ruleMatched
+)
+
+// validateWalkLimit: số entry tối đa duyệt trong mỗi root để kiểm tra luật chưa có thống kê ở DB lần trước
+// (name, regex, dirname) — -validate phải xong nhanh kể cả với share hàng triệu file
+const validateWalkLimit = 20000
+
+func (r *ValidateReport) add(check, target, status, format string, args ...any) {
+	switch status {
+	case "error":
+		r.Errors++
+	case "warn":
+		r.Warnings++
+	}
+	r.Checks = append(r.Checks, ValidateCheck{Check: check, Target: target, Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+// runValidate chạy các kiểm tra, in JSON ra stdout và trả về exit code
+func runValidate(configPath, dbOut string, apply func(*Config)) int {
+	rep := &ValidateReport{Config: configPath, CheckedAt: time.Now()}
+
+	cfg, err := loadConfig(configPath, apply)
+	if err != nil {
+		rep.add("config", configPath, "error", "%v", err)
+	} else {
+		rep.OutputDir = cfg.OutputDir
+		if len(cfg.Paths) == 0 {
+			rep.add("config", configPath, "error", "no paths configured ([paths], SCANDIR_PATHS or -roots)")
+		} else {
+			rep.add("config", configPath, "ok", "%d roots, output_dir %s", len(cfg.Paths), cfg.OutputDir)
+		}
+
+		rep.PreviousDB = cfg.PreviousDB
+		if rep.PreviousDB == "" {
+			rep.PreviousDB, _ = findLatestScanDB(cfg.OutputDir)
+		}
+		hits := rep.checkPreviousDB(cfg)
+		rep.globalRules = map[string]ruleUse{}
+		for _, rt := range cfg.Paths {
+			rep.checkRoot(cfg, rt[0], rt[1], hits)
+		}
+		// Luật global chỉ cảnh báo khi không khớp ở root nào (EXCLUDE_DIRS mặc định thường chỉ khớp vài root)
+		for _, target := range sortedKeys(rep.globalRules) {
+			switch rep.globalRules[target] {
+			case ruleUnmatched:
+				rep.add("exclude", target, "warn", "matched nothing in any root")
+			case ruleUnchecked:
+				rep.add("exclude", target, "unchecked", "no match in the first %d entries of each root", validateWalkLimit)
+			}
+		}
+
+		dir := cfg.OutputDir
+		if dbOut != "" {
+			dir = filepath.Dir(dbOut)
+		}
+		if dir = rep.checkOutputDir(dir); dir != "" {
+			rep.checkSQLite(dir)
+			rep.checkDiskSpace(dir)
+		}
+	}
+
+	rep.OK = rep.Errors == 0
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write validate result: %v\n", err)
+		return 1
+	}
+	if !rep.OK {
+		return 1
+	}
+	return 0
+}
+
+// checkPreviousDB kiểm tra DB lần trước (bắt buộc khi INCREMENTAL) và đọc số entry mỗi luật loại trừ đã bỏ qua
+// ở lần quét xong gần nhất của từng root: root_path|scope|kind|pattern -> hits. nil nếu không đọc được.
+func (r *ValidateReport) checkPreviousDB(cfg *Config) map[string]int64 {
+	if r.PreviousDB == "" {
+		if cfg.Incremental {
+			r.add("previous_db", cfg.OutputDir, "error", "INCREMENTAL is set but no scan_*.db found in output_dir")
+		}
+		return nil
+	}
+	if _, err := os.Stat(r.PreviousDB); err != nil {
+		status := "warn"
+		if cfg.Incremental {
+			status = "error"
+		}
+		r.add("previous_db", r.PreviousDB, status, "%v", err)
+		return nil
+	}
+
+	// Mở read-only: không nâng cấp schema DB cũ khi chỉ kiểm tra
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", r.PreviousDB))
+	if err != nil {
+		r.add("previous_db", r.PreviousDB, "warn", "cannot open: %v", err)
+		return nil
+	}
+	defer db.Close()
+	rows, err := db.QueryContext(context.Background(), `
+		SELECT r.root_path, e.scope, e.kind, e.pattern, e.hits
+		FROM scan_excludes e JOIN scan_roots r ON r.id = e.root_id
+		WHERE r.id IN (SELECT MAX(id) FROM scan_roots WHERE status = 'done' GROUP BY root_path)
+		  AND e.kind != 'scanignore'
+	`)
+	if err != nil {
+		r.add("previous_db", r.PreviousDB, "warn", "cannot read exclude statistics: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	hits := map[string]int64{}
+	for rows.Next() {
+		var root, scope, kind, pattern string
+		var n int64
+		if err := rows.Scan(&root, &scope, &kind, &pattern, &n); err != nil {
+			r.add("previous_db", r.PreviousDB, "warn", "cannot read exclude statistics: %v", err)
+			return nil
+		}
+		hits[root+"|"+scope+"|"+kind+"|"+pattern] = n
+	}
+	r.add("previous_db", r.PreviousDB, "ok", "previous scan database readable")
+	return hits
+}
+
+// checkRoot: root tồn tại, là thư mục, liệt kê được; luật loại trừ hợp lệ và có khớp entry nào không.
+// Luật của [exclude.<Tag>] được cảnh báo ngay, luật global được gom vào globalRules.
+func (r *ValidateReport) checkRoot(cfg *Config, root, tag string, hits map[string]int64) {
+	abs := root
+	if p, err := filepath.Abs(root); err == nil {
+		abs = p
+	}
+	fi, err := os.Stat(abs)
+	switch {
+	case err != nil:
+		r.add("root", abs, "error", "%v", err)
+		return
+	case !fi.IsDir():
+		r.add("root", abs, "error", "not a directory")
+		return
+	}
+	f, err := os.Open(abs)
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.add("root", abs, "error", "not readable: %v", err)
+		return
+	}
+	r.add("root", abs, "ok", "readable, tag %s", tag)
+
+	if _, err := newTagger(cfg, abs, tag); err != nil {
+		r.add("tags", abs, "error", "%v", err)
+	}
+
+	m, err := newExcludeMatcher(cfg, abs, tag)
+	if err != nil {
+		r.add("exclude", abs, "error", "%v", err)
+		return
+	}
+	unused := 0
+	walked, complete := false, false
+	for _, rule := range m.rules {
+		target := rule.Scope + ": " + rule.Pattern
+		use := ruleUnmatched
+		if n, ok := hits[abs+"|"+rule.Scope+"|"+rule.Kind+"|"+rule.Pattern]; ok {
+			if n > 0 {
+				use = ruleMatched
+			}
+		} else if rule.Kind == "path" || rule.Kind == "rel" {
+			// Chưa có thống kê: mẫu đường dẫn kiểm tra bằng glob trên đĩa
+			pattern := filepath.Join(abs, filepath.FromSlash(rule.glob))
+			if rule.Kind == "path" {
+				pattern = filepath.FromSlash(rule.glob)
+			}
+			if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+				use = ruleMatched
+			}
+		} else {
+			// Mẫu tên/regex: duyệt một phần root, áp dụng luật như scanner
+			if !walked {
+				complete, walked = walkExcludes(m, abs), true
+			}
+			switch {
+			case rule.hits.Load() > 0:
+				use = ruleMatched
+			case !complete:
+				use = ruleUnchecked
+			}
+		}
+
+		if rule.Scope == "global" {
+			if prev, seen := r.globalRules[target]; !seen || use > prev {
+				r.globalRules[target] = use
+			}
+			continue
+		}
+		switch use {
+		case ruleUnmatched:
+			unused++
+			r.add("exclude", target, "warn", "matched nothing under %s", abs)
+		case ruleUnchecked:
+			unused++
+			r.add("exclude", target, "unchecked", "no match in the first %d entries under %s", validateWalkLimit, abs)
+		}
+	}
+	if unused == 0 {
+		r.add("exclude", abs, "ok", "%d rules", len(m.rules))
+	}
+}
+
+// walkExcludes duyệt tối đa validateWalkLimit entry của root và áp dụng m lên từng entry như scanner (thư mục
+// bị loại trừ không được duyệt tiếp), số khớp được cộng vào hits của từng luật. true = đã duyệt hết root.
+func walkExcludes(m *excludeMatcher, root string) bool {
+	n := 0
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == root {
+			return nil // thư mục không đọc được: bỏ qua như scanner
+		}
+		if n++; n > validateWalkLimit {
+			return filepath.SkipAll
+		}
+		if m.match(p, d.Name(), d.IsDir()) != nil && d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return n <= validateWalkLimit
+}
+
+// sortedKeys: các key của m theo thứ tự tăng dần
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkOutputDir: thư mục chứa DB phải là thư mục. -validate không tạo gì: thư mục chưa có thì cảnh báo (scanner
+// tạo khi quét) và trả về thư mục cha gần nhất đã tồn tại để kiểm tra SQLite/dung lượng thay cho nó.
+// "" = không kiểm tra tiếp được.
+func (r *ValidateReport) checkOutputDir(dir string) string {
+	for p := dir; ; {
+		fi, err := os.Stat(p)
+		switch {
+		case err == nil && fi.IsDir():
+			if p != dir {
+				r.add("output_dir", dir, "warn", "does not exist, scanner will create it (checked %s instead)", p)
+			}
+			return p
+		case err == nil:
+			r.add("output_dir", dir, "error", "%s is not a directory", p)
+			return ""
+		case !errors.Is(err, fs.ErrNotExist):
+			r.add("output_dir", dir, "error", "%v", err)
+			return ""
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			r.add("output_dir", dir, "error", "no existing parent directory")
+			return ""
+		}
+		p = parent
+	}
+}
+
+// checkSQLite: tạo được DB SQLite (WAL) trong thư mục dir
+func (r *ValidateReport) checkSQLite(dir string) {
+	p := filepath.Join(dir, fmt.Sprintf(".validate_%d.db", os.Getpid()))
+	defer func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			os.Remove(p + suffix)
+		}
+	}()
+	err := func() error {
+		db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL", p))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if _, err := db.Exec(`CREATE TABLE validate_probe (id INTEGER PRIMARY KEY, v TEXT)`); err != nil {
+			return err
+		}
+		_, err = db.Exec(`INSERT INTO validate_probe (v) VALUES ('ok')`)
+		return err
+	}()
+	if err != nil {
+		r.add("sqlite", dir, "error", "cannot create SQLite database: %v", err)
+		return
+	}
+	r.add("sqlite", dir, "ok", "SQLite database can be created")
+}
+
+// checkDiskSpace so dung lượng trống của dir với DB lần trước: thiếu hơn kích thước DB cũ là lỗi,
+// dưới 2 lần (DB mới/bản copy incremental + WAL, index và phần tăng thêm) là cảnh báo
+func (r *ValidateReport) checkDiskSpace(dir string) {
+	free, err := diskFree(dir)
+	if err != nil {
+		r.add("disk_space", dir, "warn", "cannot determine free space: %v", err)
+		return
+	}
+	r.FreeBytes = free
+	if r.PreviousDB == "" {
+		r.add("disk_space", dir, "ok", "%d MiB free (no previous database to compare)", free>>20)
+		return
+	}
+	var prev int64
+	for _, suffix := range []string{"", "-wal"} {
+		if fi, err := os.Stat(r.PreviousDB + suffix); err == nil {
+			prev += fi.Size()
+		}
+	}
+	r.NeedBytes = 2 * prev
+	switch {
+	case free < uint64(prev):
+		r.add("disk_space", dir, "error", "%d MiB free, previous database is %d MiB", free>>20, prev>>20)
+	case free < uint64(r.NeedBytes):
+		r.add("disk_space", dir, "warn", "%d MiB free, recommended at least %d MiB (2x previous database)", free>>20, r.NeedBytes>>20)
+	default:
+		r.add("disk_space", dir, "ok", "%d MiB free, previous database is %d MiB", free>>20, prev>>20)
+	}
+}